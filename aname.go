@@ -0,0 +1,59 @@
+package corednstailscale
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// anameTimeout bounds the resolution of each external ANAME target.
+const anameTimeout = 5 * time.Second
+
+// resolver describes the subset of net.Resolver used to resolve ANAME targets
+// outside of the served zones.
+type resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// anames adds the addresses of the target of each configured ANAME to the apex
+// of its zone. Targets in served zones are found in r, and others are resolved
+// with res. Targets which can't be resolved are skipped until the next reload.
+func anames(config *Config, r records, res resolver) {
+	for zone, target := range config.ANAMEs {
+		var addrs []netip.Addr
+		if config.zoneOf(target) != "" {
+			hr := r[target]
+			if hr == nil {
+				log.Warningf("ANAME target %q of %q does not exist", target, zone)
+				continue
+			}
+			addrs = append(hr.v4[:len(hr.v4):len(hr.v4)], hr.v6...)
+			for _, rr := range hr.rrs {
+				addrs = append(addrs, addrOf(rr))
+			}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), anameTimeout)
+			var err error
+			addrs, err = res.LookupNetIP(ctx, "ip", target)
+			cancel()
+			if err != nil {
+				log.Warningf("Failed resolving ANAME target %q of %q: %v", target, zone, err)
+				continue
+			}
+			for i := range addrs {
+				addrs[i] = addrs[i].Unmap()
+			}
+		}
+		merge(r, addresses(config, zone, addrs))
+	}
+}
+
+// anameResolver returns the resolver of ANAME targets outside of the served
+// zones.
+func (ts *Tailscale) anameResolver() resolver {
+	if ts.resolver != nil {
+		return ts.resolver
+	}
+	return net.DefaultResolver
+}
@@ -0,0 +1,55 @@
+package corednstailscale
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+// fakeResolver resolves names from a map, failing for any others.
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	if addrs, has := r[host]; has {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestAnames(t *testing.T) {
+	config := fullTestConfig
+	config.ANAMEs = map[string]string{
+		"corp.example.com.":     "www.corp.example.com.",
+		"example.com.":          "lb.example.net.",
+		"rdu.corp.example.com.": "missing.example.net.",
+	}
+	res := fakeResolver{
+		"lb.example.net.": {netip.MustParseAddr("::ffff:192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+	}
+	www := &record{name: "www.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")}
+	r := records{"www.corp.example.com.": www}
+
+	anames(&config, r, res)
+	want := records{
+		"www.corp.example.com.": www,
+		"corp.example.com.": {
+			rrs: []dns.RR{
+				rr(t, "corp.example.com. 300 IN A 100.101.102.103"),
+				rr(t, "corp.example.com. 300 IN AAAA fd7a::abcd"),
+			},
+		},
+		"example.com.": {
+			rrs: []dns.RR{
+				rr(t, "example.com. 300 IN A 192.0.2.1"),
+				rr(t, "example.com. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+	}
+	if diff := cmp.Diff(r, want, cmpOpts...); diff != "" {
+		t.Errorf("mismatch: (-got,+want):\n%v", diff)
+	}
+}
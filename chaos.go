@@ -0,0 +1,72 @@
+package corednstailscale
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// modulePath of this plugin, whose version is reported in version.bind.
+const modulePath = "funkhouse.rs/coredns-tailscale"
+
+// version returns the version of this plugin as built into the binary.
+func version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	if bi.Main.Path == modulePath {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "(unknown)"
+}
+
+// identity returns the TXT data with which the CHAOS class query for qn is
+// answered, or false if qn does not identify the server.
+func (ts *Tailscale) identity(qn string) (string, bool) {
+	switch strings.ToLower(qn) {
+	case "version.bind.", "version.server.":
+		return fmt.Sprintf("%s %s", name, version()), true
+	case "hostname.bind.", "id.server.":
+		ts.RLock()
+		defer ts.RUnlock()
+		if ts.self == "" {
+			return "", false
+		}
+		return strings.TrimSuffix(ts.self, "."), true
+	}
+	return "", false
+}
+
+// serveChaos answers CHAOS class TXT queries identifying the server. Returns
+// false if the query is not one of them.
+func (ts *Tailscale) serveChaos(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, qt uint16) (int, bool, error) {
+	if !ts.Identify || (qt != dns.TypeTXT && qt != dns.TypeANY) {
+		return 0, false, nil
+	}
+	txt, ok := ts.identity(qn)
+	if !ok {
+		return 0, false, nil
+	}
+	ans := answer(&ts.Config, req)
+	ans.Answer = append(ans.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   qn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+		},
+		Txt: []string{txt},
+	})
+	if err := w.WriteMsg(ans); err != nil {
+		return dns.RcodeServerFailure, true, err
+	}
+	return dns.RcodeSuccess, true, nil
+}
@@ -0,0 +1,63 @@
+package corednstailscale
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestTailscale_serveChaos(t *testing.T) {
+	config := fullTestConfig
+	config.Identify = true
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts:  records{},
+		self:   "self.magic-dns.ts.net.",
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR
+	}{
+		"hostname.bind": {
+			qn:   "hostname.bind.",
+			qt:   dns.TypeTXT,
+			want: []dns.RR{rr(t, `hostname.bind. 0 CH TXT "self.magic-dns.ts.net"`)},
+		},
+		"id.server": {
+			qn:   "id.server.",
+			qt:   dns.TypeANY,
+			want: []dns.RR{rr(t, `id.server. 0 CH TXT "self.magic-dns.ts.net"`)},
+		},
+		"version.bind": {
+			qn:   "version.bind.",
+			qt:   dns.TypeTXT,
+			want: []dns.RR{rr(t, `version.bind. 0 CH TXT "tailscale `+version()+`"`)},
+		},
+		"wrong type":   {qn: "id.server.", qt: dns.TypeA},
+		"unknown name": {qn: "authors.bind.", qt: dns.TypeTXT},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			req.Question[0].Qclass = dns.ClassCHAOS
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if tc.want == nil {
+				if rec.got != nil {
+					t.Errorf("unexpected response: %v", rec.got)
+				}
+				return
+			}
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Command coredns-tailscale is CoreDNS built with the tailscale plugin, and the
+// plugins most often used alongside it.
+//
+// It takes the same flags as CoreDNS, and -validate, which checks the Corefile
+// given with -conf without starting any servers, exiting non-zero if it is
+// invalid. This allows Corefiles to be checked, such as in CI, before they are
+// rolled out.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/coremain"
+
+	corednstailscale "funkhouse.rs/coredns-tailscale"
+
+	_ "github.com/coredns/coredns/plugin/any"
+	_ "github.com/coredns/coredns/plugin/bind"
+	_ "github.com/coredns/coredns/plugin/bufsize"
+	_ "github.com/coredns/coredns/plugin/cache"
+	_ "github.com/coredns/coredns/plugin/cancel"
+	_ "github.com/coredns/coredns/plugin/chaos"
+	_ "github.com/coredns/coredns/plugin/debug"
+	_ "github.com/coredns/coredns/plugin/dnssec"
+	_ "github.com/coredns/coredns/plugin/errors"
+	_ "github.com/coredns/coredns/plugin/file"
+	_ "github.com/coredns/coredns/plugin/forward"
+	_ "github.com/coredns/coredns/plugin/header"
+	_ "github.com/coredns/coredns/plugin/health"
+	_ "github.com/coredns/coredns/plugin/hosts"
+	_ "github.com/coredns/coredns/plugin/loadbalance"
+	_ "github.com/coredns/coredns/plugin/local"
+	_ "github.com/coredns/coredns/plugin/log"
+	_ "github.com/coredns/coredns/plugin/loop"
+	_ "github.com/coredns/coredns/plugin/metadata"
+	_ "github.com/coredns/coredns/plugin/metrics"
+	_ "github.com/coredns/coredns/plugin/minimal"
+	_ "github.com/coredns/coredns/plugin/nsid"
+	_ "github.com/coredns/coredns/plugin/pprof"
+	_ "github.com/coredns/coredns/plugin/ready"
+	_ "github.com/coredns/coredns/plugin/reload"
+	_ "github.com/coredns/coredns/plugin/rewrite"
+	_ "github.com/coredns/coredns/plugin/root"
+	_ "github.com/coredns/coredns/plugin/secondary"
+	_ "github.com/coredns/coredns/plugin/template"
+	_ "github.com/coredns/coredns/plugin/timeouts"
+	_ "github.com/coredns/coredns/plugin/tls"
+	_ "github.com/coredns/coredns/plugin/transfer"
+	_ "github.com/coredns/coredns/plugin/tsig"
+	_ "github.com/coredns/coredns/plugin/whoami"
+)
+
+var validate = flag.Bool("validate", false, "Check the Corefile, and exit without starting any servers")
+
+func init() {
+	// The plugin passes queries outside of its zones down the chain, so it
+	// goes ahead of the plugins which answer them from elsewhere.
+	i := slices.Index(dnsserver.Directives, "hosts")
+	dnsserver.Directives = slices.Insert(dnsserver.Directives, i, "tailscale")
+}
+
+func main() {
+	flag.Parse()
+	if *validate {
+		if err := validateCorefile(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	coremain.Run()
+}
+
+// validateCorefile checks the Corefile given with -conf, or else the one in the
+// working directory, as CoreDNS would load it.
+func validateCorefile() error {
+	path := flag.Lookup("conf").Value.String()
+	if path == "" {
+		path = "Corefile"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return corednstailscale.Validate(path, f)
+}
@@ -0,0 +1,283 @@
+package corednstailscale
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Signatures are valid from a little before they are made, to allow for
+	// clock skew, until well after the answers they cover have expired.
+	signatureInception  = -time.Hour
+	signatureExpiration = 7 * 24 * time.Hour
+)
+
+// typeNXNAME is the pseudo-type which marks a compact denial of existence, per
+// RFC 9824. It is not yet known to miekg/dns.
+const typeNXNAME uint16 = 128
+
+// signingKey is a DNSSEC key with which answers are signed.
+type signingKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	tag    uint16
+}
+
+// readKey reads the DNSSEC key pair with the given base name, as written by
+// dnssec-keygen to base.key and base.private.
+func readKey(base string) (*signingKey, error) {
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".key"), ".private")
+	pub, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, base+".key")
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key does not contain a DNSKEY", base)
+	}
+
+	priv, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer priv.Close()
+	pk, err := key.ReadPrivateKey(priv, base+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private does not contain a usable private key", base)
+	}
+	key.Hdr.Name = dns.CanonicalName(key.Hdr.Name)
+	return &signingKey{key: key, signer: signer, tag: key.KeyTag()}, nil
+}
+
+// loadKeys reads the configured DNSSEC keys, and indexes them by the zones
+// they sign.
+func loadKeys(config *Config) error {
+	for _, base := range config.KeyFiles {
+		k, err := readKey(base)
+		if err != nil {
+			return fmt.Errorf("failed reading DNSSEC key %q: %v", base, err)
+		}
+		zone := k.key.Hdr.Name
+		if !config.fastZoneLookup[zone] {
+			return fmt.Errorf("DNSSEC key %q is for %q, which is not served", base, zone)
+		}
+		k.key.Hdr.Ttl = config.ttl()
+		if config.keys == nil {
+			config.keys = make(map[string][]*signingKey)
+		}
+		config.keys[zone] = append(config.keys[zone], k)
+	}
+	return nil
+}
+
+// dnskeys returns the DNSKEY records for zone.
+func (ts *Tailscale) dnskeys(zone string) []dns.RR {
+	var ret []dns.RR
+	for _, k := range ts.keys[zone] {
+		ret = append(ret, k.key)
+	}
+	return ret
+}
+
+// signers returns the keys of zone with which RRsets of type rt are signed.
+// When the zone has both key signing and zone signing keys, the former sign
+// only the DNSKEY RRset and the latter everything else. Otherwise, every key
+// signs everything.
+func (ts *Tailscale) signers(zone string, rt uint16) []*signingKey {
+	var ksks, zsks []*signingKey
+	for _, k := range ts.keys[zone] {
+		if k.key.Flags&dns.SEP != 0 {
+			ksks = append(ksks, k)
+		} else {
+			zsks = append(zsks, k)
+		}
+	}
+	if len(ksks) == 0 || len(zsks) == 0 {
+		return ts.keys[zone]
+	}
+	if rt == dns.TypeDNSKEY {
+		return ksks
+	}
+	return zsks
+}
+
+// sign adds signatures to the RRsets in the answer and authority sections of
+// m which belong to zones for which keys are configured.
+func (ts *Tailscale) sign(m *dns.Msg) {
+	now := time.Now()
+	m.Answer = ts.signSection(m.Answer, now)
+	m.Ns = ts.signSection(m.Ns, now)
+}
+
+// signSection returns rrs grouped into RRsets, each followed by its
+// signatures.
+func (ts *Tailscale) signSection(rrs []dns.RR, now time.Time) []dns.RR {
+	type rrsetKey struct {
+		name string
+		rt   uint16
+	}
+	var order []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		k := rrsetKey{name: dns.CanonicalName(h.Name), rt: h.Rrtype}
+		if _, has := rrsets[k]; !has {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+
+	var ret []dns.RR
+	for _, k := range order {
+		rrset := rrsets[k]
+		ret = append(ret, rrset...)
+		zone := ts.zoneOf(k.name)
+		for _, key := range ts.signers(zone, k.rt) {
+			sig := &dns.RRSIG{
+				Hdr: dns.RR_Header{
+					Name:   rrset[0].Header().Name,
+					Rrtype: dns.TypeRRSIG,
+					Class:  dns.ClassINET,
+					Ttl:    rrset[0].Header().Ttl,
+				},
+				KeyTag:     key.tag,
+				SignerName: zone,
+				Algorithm:  key.key.Algorithm,
+				Inception:  uint32(now.Add(signatureInception).Unix()),
+				Expiration: uint32(now.Add(signatureExpiration).Unix()),
+			}
+			if err := sig.Sign(key.signer, rrset); err != nil {
+				log.Errorf("Failed signing %s %s with key %d: %v", k.name, dns.TypeToString[k.rt], key.tag, err)
+				continue
+			}
+			ret = append(ret, sig)
+		}
+	}
+	return ret
+}
+
+// signingWriter signs the answers written through it.
+type signingWriter struct {
+	dns.ResponseWriter
+	ts *Tailscale
+}
+
+func (w *signingWriter) WriteMsg(m *dns.Msg) error {
+	if len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		w.ts.deny(m)
+	}
+	w.ts.sign(m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// deny adds an NSEC record proving the denial of existence in a negative
+// answer. Compact denial of existence is used, per RFC 9824: the NSEC is owned
+// by the qname and covers no other names, so it can be generated on the fly.
+// NXDOMAIN answers become NODATA answers whose NSEC carries the NXNAME type.
+func (ts *Tailscale) deny(m *dns.Msg) {
+	if len(m.Question) == 0 {
+		return
+	}
+	qn := dns.CanonicalName(m.Question[0].Name)
+	var soa *dns.SOA
+	for _, rr := range m.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	if m.Rcode == dns.RcodeNameError {
+		m.Rcode = dns.RcodeSuccess
+		types = append(types, typeNXNAME)
+	} else {
+		types = append(types, ts.types(qn)...)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	m.Ns = append(m.Ns, &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   qn,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: "\\000." + qn,
+		TypeBitMap: types,
+	})
+}
+
+// types returns the types of the records which exist at qn.
+func (ts *Tailscale) types(qn string) []uint16 {
+	var types []uint16
+	seen := make(map[uint16]bool)
+	zone := ts.zoneOf(qn)
+	add := func(rt uint16) {
+		if !seen[rt] && !ts.suppressed(zone, rt) {
+			types = append(types, rt)
+			seen[rt] = true
+		}
+	}
+	if ts.fastZoneLookup[qn] {
+		add(dns.TypeSOA)
+		add(dns.TypeNS)
+		if len(ts.keys[qn]) > 0 {
+			add(dns.TypeDNSKEY)
+		}
+	}
+	hr, _ := ts.lookup(qn, zone)
+	if hr == nil {
+		return types
+	}
+	switch {
+	case hr.name != "" && ts.flattened(qn, zone, hr):
+		if len(hr.v4) > 0 {
+			add(dns.TypeA)
+		}
+		if len(hr.v6) > 0 {
+			add(dns.TypeAAAA)
+		}
+	case hr.name != "":
+		add(dns.TypeCNAME)
+	}
+	for _, rr := range hr.rrs {
+		add(rr.Header().Rrtype)
+	}
+	return types
+}
+
+// serveDNSKEY answers with the DNSKEY RRset of zone.
+func (ts *Tailscale) serveDNSKEY(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, zone string, serial uint32) (int, error) {
+	keys := ts.dnskeys(zone)
+	if len(keys) == 0 {
+		return ts.serveNoData(ctx, w, req, zone, serial)
+	}
+	return ts.serveRRs(ctx, w, req, zone, keys)
+}
@@ -0,0 +1,202 @@
+package corednstailscale
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// writeKey generates a DNSSEC key pair for zone in dir, and returns its base
+// name.
+func writeKey(tb testing.TB, dir, zone string, flags uint16) string {
+	tb.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return base
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	zsk := writeKey(t, dir, "corp.example.com.", dns.ZONE)
+	ksk := writeKey(t, dir, "corp.example.com.", dns.ZONE|dns.SEP)
+	other := writeKey(t, dir, "example.net.", dns.ZONE)
+
+	config := fullTestConfig
+	config.KeyFiles = []string{zsk, ksk + ".key"}
+	if err := loadKeys(&config); err != nil {
+		t.Fatalf("loadKeys: %v", err)
+	}
+	if got := len(config.keys["corp.example.com."]); got != 2 {
+		t.Errorf("loadKeys: got %d keys for corp.example.com., want 2", got)
+	}
+
+	config = fullTestConfig
+	config.KeyFiles = []string{other}
+	if err := loadKeys(&config); err == nil {
+		t.Errorf("loadKeys: want error for key of zone which is not served")
+	}
+
+	config = fullTestConfig
+	config.KeyFiles = []string{filepath.Join(dir, "Kmissing")}
+	if err := loadKeys(&config); err == nil {
+		t.Errorf("loadKeys: want error for missing key")
+	}
+}
+
+func TestTailscale_ServeDNS_signed(t *testing.T) {
+	dir := t.TempDir()
+	config := fullTestConfig
+	config.KeyFiles = []string{
+		writeKey(t, dir, "corp.example.com.", dns.ZONE),
+		writeKey(t, dir, "corp.example.com.", dns.ZONE|dns.SEP),
+	}
+	if err := loadKeys(&config); err != nil {
+		t.Fatal(err)
+	}
+	zsk, ksk := config.keys["corp.example.com."][0].key, config.keys["corp.example.com."][1].key
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			"foo.example.com.":      {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+
+	for tn, tc := range map[string]struct {
+		qn, zone string
+		qt       uint16
+		do       bool
+		key      *dns.DNSKEY
+		want     map[uint16]int // number of signatures by type covered.
+	}{
+		"signed cname":    {qn: "foo.corp.example.com.", qt: dns.TypeA, do: true, key: zsk, want: map[uint16]int{dns.TypeCNAME: 1}},
+		"signed soa":      {qn: "corp.example.com.", qt: dns.TypeSOA, do: true, key: zsk, want: map[uint16]int{dns.TypeSOA: 1, dns.TypeNS: 1}},
+		"signed nxdomain": {qn: "bar.corp.example.com.", qt: dns.TypeA, do: true, key: zsk, want: map[uint16]int{dns.TypeSOA: 1, dns.TypeNSEC: 1}},
+		"signed nodata":   {qn: "foo.corp.example.com.", qt: dns.TypeMX, do: true, key: zsk, want: map[uint16]int{dns.TypeSOA: 1, dns.TypeNSEC: 1}},
+		"signed dnskey":   {qn: "corp.example.com.", qt: dns.TypeDNSKEY, do: true, key: ksk, want: map[uint16]int{dns.TypeDNSKEY: 1}},
+		"without do":      {qn: "foo.corp.example.com.", qt: dns.TypeA, want: map[uint16]int{}},
+		"unsigned zone":   {qn: "foo.example.com.", qt: dns.TypeA, do: true, want: map[uint16]int{}},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			req.SetEdns0(4096, tc.do)
+			rec := &recorder{ResponseWriter: test.ResponseWriter{}}
+			if _, err := ts.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+
+			got := make(map[uint16]int)
+			for _, section := range [][]dns.RR{rec.got.Answer, rec.got.Ns} {
+				for _, rr := range section {
+					sig, ok := rr.(*dns.RRSIG)
+					if !ok {
+						continue
+					}
+					got[sig.TypeCovered]++
+					var rrset []dns.RR
+					for _, rr := range section {
+						if rr.Header().Rrtype == sig.TypeCovered && rr.Header().Name == sig.Hdr.Name {
+							rrset = append(rrset, rr)
+						}
+					}
+					if err := sig.Verify(tc.key, rrset); err != nil {
+						t.Errorf("signature over %s failed verification: %v", dns.TypeToString[sig.TypeCovered], err)
+					}
+				}
+			}
+			if len(got) != len(tc.want) {
+				t.Errorf("got signatures %v, want %v", got, tc.want)
+			}
+			for rt, n := range tc.want {
+				if got[rt] != n {
+					t.Errorf("got %d signatures over %s, want %d", got[rt], dns.TypeToString[rt], n)
+				}
+			}
+		})
+	}
+}
+
+func TestTailscale_deny(t *testing.T) {
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {
+				name: "foo.magic-dns.ts.net.",
+				v4:   ips(t, "100.101.102.103"),
+				rrs:  []dns.RR{rr(t, `foo.magic-dns.ts.net. 300 IN TXT "os=linux"`)},
+			},
+			"mail.corp.example.com.": {rrs: []dns.RR{rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net.")}},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn        string
+		rcode     int
+		wantRcode int
+		want      dns.RR
+	}{
+		"nxdomain": {
+			qn:        "bar.corp.example.com.",
+			rcode:     dns.RcodeNameError,
+			wantRcode: dns.RcodeSuccess,
+			want:      rr(t, `bar.corp.example.com. 150 IN NSEC \000.bar.corp.example.com. RRSIG NSEC TYPE128`),
+		},
+		"nodata at peer": {
+			qn:        "foo.corp.example.com.",
+			wantRcode: dns.RcodeSuccess,
+			want:      rr(t, `foo.corp.example.com. 150 IN NSEC \000.foo.corp.example.com. CNAME TXT RRSIG NSEC`),
+		},
+		"nodata at static record": {
+			qn:        "mail.corp.example.com.",
+			wantRcode: dns.RcodeSuccess,
+			want:      rr(t, `mail.corp.example.com. 150 IN NSEC \000.mail.corp.example.com. MX RRSIG NSEC`),
+		},
+		"nodata at apex": {
+			qn:        "corp.example.com.",
+			wantRcode: dns.RcodeSuccess,
+			want:      rr(t, `corp.example.com. 150 IN NSEC \000.corp.example.com. NS SOA RRSIG NSEC`),
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			m := &dns.Msg{}
+			m.SetQuestion(tc.qn, dns.TypeAAAA)
+			m.Rcode = tc.rcode
+			m.Ns = []dns.RR{ts.authority("corp.example.com.", ts.serial)}
+			ts.deny(m)
+			if m.Rcode != tc.wantRcode {
+				t.Errorf("got rcode %v, want %v", dns.RcodeToString[m.Rcode], dns.RcodeToString[tc.wantRcode])
+			}
+			if len(m.Ns) != 2 {
+				t.Fatalf("got authority %v, want SOA and NSEC", m.Ns)
+			}
+			if got := m.Ns[1].String(); got != tc.want.String() {
+				t.Errorf("got NSEC %q, want %q", got, tc.want.String())
+			}
+		})
+	}
+}
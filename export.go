@@ -0,0 +1,146 @@
+package corednstailscale
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/miekg/dns"
+)
+
+// signedZone is a zone signed outside of this plugin, from an exported zone
+// file.
+type signedZone struct {
+	zone *file.Zone
+	file string
+	mod  int64 // modification time of file, in Unix nanoseconds.
+}
+
+// exportPath returns the path to which zone is exported.
+func (c *Config) exportPath(zone string) string {
+	return filepath.Join(c.ExportDir, "db."+strings.TrimSuffix(zone, "."))
+}
+
+// signedPath returns the path from which the signed version of zone is read.
+// This is where the sign plugin writes it when its directory is ExportDir.
+func (c *Config) signedPath(zone string) string {
+	return filepath.Join(c.ExportDir, "db."+zone+"signed")
+}
+
+// zones returns the zones served by this plugin, in order.
+func (c *Config) zones() []string {
+	zones := make([]string, 0, len(c.fastZoneLookup))
+	for zone := range c.fastZoneLookup {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// export writes each of zones to a zone file in ExportDir, and runs the
+// ExportCommand for each of them, so that they can be signed.
+func (ts *Tailscale) export(zones []string) {
+	if ts.ExportDir == "" {
+		return
+	}
+	ts.exporting.Lock()
+	defer ts.exporting.Unlock()
+
+	for _, zone := range zones {
+		var b strings.Builder
+		ts.RLock()
+		if ts.hosts == nil {
+			ts.RUnlock()
+			return
+		}
+		fmt.Fprintln(&b, ts.authority(zone, ts.serialOf(zone)))
+		for _, ns := range ts.nameservers(zone) {
+			fmt.Fprintln(&b, ns)
+		}
+		for _, rr := range ts.zoneRecords(zone) {
+			fmt.Fprintln(&b, rr)
+		}
+		ts.RUnlock()
+
+		path := ts.exportPath(zone)
+		if err := writeFile(path, []byte(b.String())); err != nil {
+			log.Errorf("Failed exporting %v to %q: %v", zone, path, err)
+			continue
+		}
+		if len(ts.ExportCommand) == 0 {
+			continue
+		}
+		args := append(ts.ExportCommand[1:len(ts.ExportCommand):len(ts.ExportCommand)], zone, path)
+		if out, err := exec.Command(ts.ExportCommand[0], args...).CombinedOutput(); err != nil {
+			log.Errorf("Failed running export command for %v: %v: %s", zone, err, out)
+		}
+	}
+	ts.loadSigned()
+}
+
+// loadSigned reads the signed zone files in ExportDir which are newer than
+// the zone files they were signed from. Answers for zones which have no
+// up-to-date signed zone file are served from the assembled records.
+func (ts *Tailscale) loadSigned() {
+	if ts.ExportDir == "" {
+		return
+	}
+	signed := make(map[string]*signedZone)
+	for _, zone := range ts.zones() {
+		unsigned, err := os.Stat(ts.exportPath(zone))
+		if err != nil {
+			continue
+		}
+		path := ts.signedPath(zone)
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Before(unsigned.ModTime()) {
+			continue
+		}
+		ts.RLock()
+		prev := ts.signed[zone]
+		ts.RUnlock()
+		if prev != nil && prev.mod == fi.ModTime().UnixNano() {
+			signed[zone] = prev
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			log.Errorf("Failed reading signed zone %v: %v", zone, err)
+			continue
+		}
+		z, err := file.Parse(f, zone, path, 0)
+		f.Close()
+		if err != nil {
+			log.Errorf("Failed parsing signed zone %v: %v", zone, err)
+			continue
+		}
+		log.Infof("Loaded signed zone %v from %q", zone, path)
+		signed[zone] = &signedZone{zone: z, file: path, mod: fi.ModTime().UnixNano()}
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+	ts.signed = signed
+}
+
+// serveSigned answers from the signed version of zone, if there is one.
+func (ts *Tailscale) serveSigned(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, zone string) (int, bool, error) {
+	ts.RLock()
+	sz := ts.signed[zone]
+	ts.RUnlock()
+	if sz == nil {
+		return 0, false, nil
+	}
+	f := file.File{
+		Next:  ts.next(ctx),
+		Zones: file.Zones{Z: map[string]*file.Zone{zone: sz.zone}, Names: []string{zone}},
+	}
+	rcode, err := f.ServeDNS(ctx, w, req)
+	return rcode, true, err
+}
@@ -0,0 +1,67 @@
+package corednstailscale
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestTailscale_export(t *testing.T) {
+	config := fullTestConfig
+	config.ExportDir = t.TempDir()
+	// Stand in for a signer by copying the exported zone to the signed path.
+	config.ExportCommand = []string{"sh", "-c", `cp "$2" "$2.signed"`, "sh"}
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			"foo.example.com.":      {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	ts.export(ts.zones())
+
+	b, err := os.ReadFile(ts.exportPath("corp.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "corp.example.com.\t300\tIN\tSOA\tns.corp.example.com. root.ns.corp.example.com. 8675309 300 150 600 150\n" +
+		"corp.example.com.\t300\tIN\tNS\tns.corp.example.com.\n" +
+		"foo.corp.example.com.\t300\tIN\tCNAME\tfoo.magic-dns.ts.net.\n" +
+		"den.corp.example.com.\t300\tIN\tNS\tns.den.corp.example.com.\n" +
+		"rdu.corp.example.com.\t300\tIN\tNS\tns.rdu.corp.example.com.\n"
+	if diff := cmp.Diff(string(b), want); diff != "" {
+		t.Errorf("exported zone mismatch: (-got,+want):\n%v", diff)
+	}
+
+	// Answers come from the signed zone, which has no addresses for the
+	// MagicDNS name, rather than from the assembled records.
+	req := &dns.Msg{}
+	req.SetQuestion("foo.corp.example.com.", dns.TypeA)
+	rec := &recorder{ResponseWriter: test.ResponseWriter{}}
+	if _, err := ts.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.got == nil {
+		t.Fatal("no response written")
+	}
+	if diff := cmp.Diff(rec.got.Answer, []dns.RR{rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net.")}, cmpOpts...); diff != "" {
+		t.Errorf("answer mismatch: (-got,+want):\n%v", diff)
+	}
+
+	// Once the signed zone is out of date, answers come from the assembled
+	// records again.
+	ts.ExportCommand = nil
+	ts.export(ts.zones())
+	rec = &recorder{ResponseWriter: test.ResponseWriter{}}
+	if _, err := ts.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(rec.got.Answer); got != 2 {
+		t.Errorf("got %d answers from assembled records, want 2", got)
+	}
+}
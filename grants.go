@@ -0,0 +1,156 @@
+package corednstailscale
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// grants returns the capabilities used by config which are granted to each
+// node in the network map nm, with their values. Grants reach this node as
+// capabilities in its packet filter, held on its addresses by the nodes
+// matching their sources.
+func grants(config *Config, nm *netmap.NetworkMap) map[tailcfg.StableNodeID]tailcfg.PeerCapMap {
+	if nm == nil || nm.SelfNode == nil || (len(config.Capabilities) == 0 && config.RecordCapability == "") {
+		return nil
+	}
+	ret := make(map[tailcfg.StableNodeID]tailcfg.PeerCapMap)
+	for _, node := range nodes(nm) {
+		if node == nil {
+			continue
+		}
+		for _, m := range nm.PacketFilter {
+			if !overlaps(m.Srcs, node.Addresses) {
+				continue
+			}
+			for _, cm := range m.Caps {
+				if config.Capabilities[string(cm.Cap)] == "" && string(cm.Cap) != config.RecordCapability {
+					continue
+				}
+				if !overlaps([]netip.Prefix{cm.Dst}, nm.SelfNode.Addresses) {
+					// Granted on a subnet routed by this node, not on it.
+					continue
+				}
+				if ret[node.StableID] == nil {
+					ret[node.StableID] = make(tailcfg.PeerCapMap)
+				}
+				ret[node.StableID][cm.Cap] = append(ret[node.StableID][cm.Cap], cm.Values...)
+			}
+		}
+	}
+	return ret
+}
+
+// overlaps reports whether any of the addresses is within any of prefixes.
+func overlaps(prefixes, addrs []netip.Prefix) bool {
+	for _, p := range prefixes {
+		for _, addr := range addrs {
+			if p.Contains(addr.Addr()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capabilityZones returns the zones of the capabilities in caps, ordered by
+// the names of the capabilities.
+func (c *Config) capabilityZones(caps tailcfg.PeerCapMap) []string {
+	var names []string
+	for cap := range caps {
+		if c.Capabilities[string(cap)] != "" {
+			names = append(names, string(cap))
+		}
+	}
+	sort.Strings(names)
+	zones := make([]string, len(names))
+	for i, name := range names {
+		zones[i] = c.Capabilities[name]
+	}
+	return zones
+}
+
+// peerRecords are the records a peer declares for itself in the values of the
+// record capability granted to it, such as:
+//
+//	{"names": ["grafana"], "txt": ["team=obs"], "srv": [{"service": "http", "proto": "tcp", "port": 3000}]}
+type peerRecords struct {
+	// Names are additional host names of the peer, served wherever its host
+	// name is.
+	Names []string `json:"names"`
+
+	// TXT are the strings of a TXT record served at the peer's names.
+	TXT []string `json:"txt"`
+
+	// SRV are services offered by the peer, served as SRV records under its
+	// names.
+	SRV []struct {
+		Service string `json:"service"`
+		Proto   string `json:"proto"`
+		Port    uint16 `json:"port"`
+	} `json:"srv"`
+}
+
+// declared returns the records the peer declares in the values of the record
+// capability caps grants it, merged. Invalid values are logged and skipped.
+func declared(config *Config, peer string, caps tailcfg.PeerCapMap) peerRecords {
+	var ret peerRecords
+	if config.RecordCapability == "" {
+		return ret
+	}
+	vals, err := tailcfg.UnmarshalCapJSON[peerRecords](caps, tailcfg.PeerCapability(config.RecordCapability))
+	if err != nil {
+		log.Warningf("Ignoring invalid %s capability of peer %q: %v", config.RecordCapability, peer, err)
+		return ret
+	}
+	for _, v := range vals {
+		for _, name := range v.Names {
+			name = strings.ToLower(name)
+			if _, ok := dns.IsDomainName(name); !ok || name == "" || strings.Contains(name, ".") {
+				log.Warningf("Ignoring invalid name %q declared by peer %q", name, peer)
+				continue
+			}
+			ret.Names = append(ret.Names, name)
+		}
+		for _, txt := range v.TXT {
+			if len(txt) > 255 {
+				log.Warningf("Ignoring TXT string longer than 255 bytes declared by peer %q", peer)
+				continue
+			}
+			ret.TXT = append(ret.TXT, txt)
+		}
+		for _, srv := range v.SRV {
+			if _, ok := dns.IsDomainName(srv.Service); !ok || srv.Service == "" || strings.Contains(srv.Service, ".") || (srv.Proto != "tcp" && srv.Proto != "udp") || srv.Port == 0 {
+				log.Warningf("Ignoring invalid service %s/%s:%d declared by peer %q", srv.Service, srv.Proto, srv.Port, peer)
+				continue
+			}
+			ret.SRV = append(ret.SRV, srv)
+		}
+	}
+	return ret
+}
+
+// assembleDeclaredServices assembles SRV records for the services declared by
+// a peer, under its name. As with advertised services, they target the peer's
+// MagicDNS name.
+func assembleDeclaredServices(config *Config, name, target string, decl peerRecords, r records) {
+	for _, svc := range decl.SRV {
+		owner := dns.CanonicalName(fmt.Sprintf("_%s._%s.%s", strings.ToLower(svc.Service), svc.Proto, name))
+		srv := &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    config.ttl(),
+			},
+			Port:   svc.Port,
+			Target: target,
+		}
+		merge(r, []dns.RR{srv})
+	}
+}
@@ -0,0 +1,130 @@
+package corednstailscale
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	tsfilter "tailscale.com/wgengine/filter"
+)
+
+func TestGrants(t *testing.T) {
+	config := Config{
+		DefaultZone: "corp.example.com.",
+		Capabilities: map[string]string{
+			"example.com/cap/dns-prod": "prod.corp.example.com.",
+			"example.com/cap/dns-lab":  "lab.corp.example.com.",
+		},
+	}
+	buildFastZoneLookup(&config)
+	nm := &netmap.NetworkMap{
+		SelfNode: &tailcfg.Node{
+			StableID:  "self",
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.111.112.113/32")},
+		},
+		Peers: []*tailcfg.Node{
+			{StableID: "web", Addresses: []netip.Prefix{netip.MustParsePrefix("100.101.102.1/32")}},
+			{StableID: "lab", Addresses: []netip.Prefix{netip.MustParsePrefix("100.101.102.2/32")}},
+			{StableID: "laptop", Addresses: []netip.Prefix{netip.MustParsePrefix("100.101.102.3/32")}},
+		},
+		PacketFilter: []tsfilter.Match{
+			{
+				Srcs: []netip.Prefix{netip.MustParsePrefix("100.101.102.1/32")},
+				Caps: []tsfilter.CapMatch{
+					{Dst: netip.MustParsePrefix("100.111.112.113/32"), Cap: "example.com/cap/dns-prod"},
+					{Dst: netip.MustParsePrefix("100.111.112.113/32"), Cap: "example.com/cap/other"},
+				},
+			},
+			{
+				Srcs: []netip.Prefix{netip.MustParsePrefix("100.101.102.0/30")},
+				Caps: []tsfilter.CapMatch{
+					{Dst: netip.MustParsePrefix("100.111.112.113/32"), Cap: "example.com/cap/dns-lab"},
+				},
+			},
+			{
+				// Granted on a routed subnet, rather than on this node.
+				Srcs: []netip.Prefix{netip.MustParsePrefix("100.101.102.3/32")},
+				Caps: []tsfilter.CapMatch{
+					{Dst: netip.MustParsePrefix("192.168.0.0/24"), Cap: "example.com/cap/dns-prod"},
+				},
+			},
+		},
+	}
+	want := map[tailcfg.StableNodeID]tailcfg.PeerCapMap{
+		"web":    {"example.com/cap/dns-prod": nil, "example.com/cap/dns-lab": nil},
+		"lab":    {"example.com/cap/dns-lab": nil},
+		"laptop": {"example.com/cap/dns-lab": nil},
+	}
+	got := grants(&config, nm)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatalf("grants mismatch: (-got,+want):\n%v", diff)
+	}
+
+	peers := []*ipnstate.PeerStatus{
+		{ID: "web", DNSName: "web.magic-dns.ts.net", TailscaleIPs: ips(t, "100.101.102.1")},
+		{ID: "lab", DNSName: "lab.magic-dns.ts.net", TailscaleIPs: ips(t, "100.101.102.2")},
+	}
+	r := assemble(&config, nil, peers, nil, got, nil)
+	for _, name := range []string{
+		"web.prod.corp.example.com.",
+		"web.lab.corp.example.com.",
+		"lab.lab.corp.example.com.",
+	} {
+		if r[name] == nil {
+			t.Errorf("no records for %q", name)
+		}
+	}
+	if r["lab.prod.corp.example.com."] != nil {
+		t.Errorf("records for lab.prod.corp.example.com., which wasn't granted")
+	}
+}
+
+func TestDeclared(t *testing.T) {
+	config := Config{
+		DefaultZone:      "corp.example.com.",
+		ReloadInterval:   time.Second * 300,
+		RecordCapability: "example.com/cap/dns",
+	}
+	buildFastZoneLookup(&config)
+	caps := map[tailcfg.StableNodeID]tailcfg.PeerCapMap{
+		"web": {"example.com/cap/dns": {
+			json.RawMessage(`{"names": ["Grafana", "bad.name"], "txt": ["team=obs"]}`),
+			json.RawMessage(`{"srv": [{"service": "http", "proto": "tcp", "port": 3000}, {"service": "ftp", "proto": "sctp", "port": 21}]}`),
+		}},
+		"bad": {"example.com/cap/dns": {
+			json.RawMessage(`{"names": "not a list"}`),
+		}},
+	}
+	peers := []*ipnstate.PeerStatus{
+		{ID: "web", DNSName: "web.magic-dns.ts.net", TailscaleIPs: ips(t, "100.101.102.1")},
+		{ID: "bad", DNSName: "bad.magic-dns.ts.net", TailscaleIPs: ips(t, "100.101.102.2")},
+	}
+	r := assemble(&config, nil, peers, nil, caps, nil)
+
+	if got := r["grafana.corp.example.com."]; got == nil || got.name != "web.magic-dns.ts.net." {
+		t.Errorf("declared name = %v, want the record of web", got)
+	}
+	for name := range r {
+		if strings.HasPrefix(name, "bad.name") || strings.HasPrefix(name, "_ftp.") {
+			t.Errorf("records for invalid declaration %q", name)
+		}
+	}
+	wantTXT := []dns.RR{rr(t, `web.magic-dns.ts.net. 300 IN TXT "team=obs"`)}
+	if diff := cmp.Diff(r["web.corp.example.com."].typed(dns.TypeTXT), wantTXT); diff != "" {
+		t.Errorf("TXT mismatch: (-got,+want):\n%v", diff)
+	}
+	wantSRV := []dns.RR{rr(t, "_http._tcp.web.corp.example.com. 300 IN SRV 0 0 3000 web.magic-dns.ts.net.")}
+	if diff := cmp.Diff(r["_http._tcp.web.corp.example.com."].typed(dns.TypeSRV), wantSRV); diff != "" {
+		t.Errorf("SRV mismatch: (-got,+want):\n%v", diff)
+	}
+	if got := r["bad.corp.example.com."]; got == nil || len(got.rrs) > 0 {
+		t.Errorf("peer with an invalid declaration = %v, want it served without declared records", got)
+	}
+}
@@ -0,0 +1,54 @@
+package corednstailscale
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readHosts reads the address records of the hosts-format file at path, and
+// returns them along with its modification time. Names in a served zone are
+// kept as they are, and single labels are placed in the DefaultZone. Any other
+// names are skipped, since they aren't ours to serve.
+func readHosts(config *Config, path string) ([]dns.RR, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var rrs []dns.RR
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			log.Warningf("Skipping hosts entry with invalid address %q in %s", fields[0], path)
+			continue
+		}
+		for _, host := range fields[1:] {
+			name := dns.CanonicalName(host)
+			if dns.CountLabel(name) == 1 {
+				name = dns.CanonicalName(host + "." + config.DefaultZone)
+			}
+			if _, ok := dns.IsDomainName(name); !ok || config.zoneOf(name) == "" {
+				log.Debugf("Skipping hosts entry %q outside of the served zones in %s", host, path)
+				continue
+			}
+			rrs = append(rrs, addresses(config, name, []netip.Addr{addr.Unmap()})...)
+		}
+	}
+	return rrs, fi.ModTime(), s.Err()
+}
@@ -0,0 +1,69 @@
+package corednstailscale
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestReadHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := `# Hand-maintained hosts.
+192.0.2.10  printer printer.den.corp.example.com.
+2001:db8::10 nas.example.com # In a served zone.
+::ffff:192.0.2.11 scanner
+192.0.2.12  elsewhere.example.net
+bogus       broken
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, mod, err := readHosts(&fullTestConfig, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); !mod.Equal(fi.ModTime()) {
+		t.Errorf("modification time = %v, want %v", mod, fi.ModTime())
+	}
+	want := []dns.RR{
+		rr(t, "printer.corp.example.com. 300 IN A 192.0.2.10"),
+		rr(t, "printer.den.corp.example.com. 300 IN A 192.0.2.10"),
+		rr(t, "nas.example.com. 300 IN AAAA 2001:db8::10"),
+		rr(t, "scanner.corp.example.com. 300 IN A 192.0.2.11"),
+	}
+	if diff := cmp.Diff(got, want, cmpOpts...); diff != "" {
+		t.Errorf("mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestTailscale_filesChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("192.0.2.10 printer\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := fullTestConfig
+	config.HostsFile = path
+	ts := &Tailscale{
+		Config: config,
+		client: &fakeLocalClient{},
+	}
+	ts.reload()
+	if ts.filesChanged() {
+		t.Errorf("hosts file reported changed right after reload")
+	}
+	if ts.hosts["printer.corp.example.com."] == nil {
+		t.Errorf("hosts entry not served after reload")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.filesChanged() {
+		t.Errorf("hosts file not reported changed after modification")
+	}
+}
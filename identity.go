@@ -0,0 +1,169 @@
+package corednstailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// identityCacheTTL is how long the identities of query sources are cached, so
+// that the Local API isn't asked about each query.
+const identityCacheTTL = time.Minute
+
+// maxIdentities bounds the number of query sources whose identities are cached,
+// so that sources spread across the tailnet's ranges can't grow it without
+// limit. Sources beyond it are identified afresh for each query until others
+// expire.
+const maxIdentities = 4096
+
+// errNoNode is returned by WhoIs when there is no node at the address on the
+// tailnet, as opposed to when tailscaled couldn't be asked.
+var errNoNode = errors.New("no node at address")
+
+// WhoIs returns the node at remoteAddr, or an error wrapping errNoNode if
+// tailscaled knows of none there. The Local API answers that case with 404 Not
+// Found, which the LocalClient only reports in the text of its error, so the
+// request is made here to tell it apart by its status.
+func (lc *localClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/whois?addr="+url.QueryEscape(remoteAddr), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", errNoNode, bytes.TrimSpace(body))
+	default:
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	who := new(apitype.WhoIsResponse)
+	if err := json.Unmarshal(body, who); err != nil {
+		return nil, fmt.Errorf("invalid whois response: %v", err)
+	}
+	return who, nil
+}
+
+// identities caches the identities of query sources.
+type identities struct {
+	sync.Mutex
+	cache map[netip.Addr]identity
+}
+
+// identity of a query source, or nil if it has none on the tailnet.
+type identity struct {
+	who     *apitype.WhoIsResponse
+	expires time.Time
+}
+
+// identify returns the tailnet identity of the node at addr, or nil if it has
+// none. Addresses outside of the tailnet's ranges have none without asking.
+func (ts *Tailscale) identify(ctx context.Context, addr net.Addr) *apitype.WhoIsResponse {
+	if addr == nil {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := ap.Addr().Unmap()
+	if !cgnatPrefix.Contains(ip) && !ulaPrefix.Contains(ip) {
+		return nil
+	}
+
+	ts.identities.Lock()
+	id, has := ts.identities.cache[ip]
+	ts.identities.Unlock()
+	if has && time.Now().Before(id.expires) {
+		return id.who
+	}
+	ctx, cancel := context.WithTimeout(ctx, ts.timeout())
+	defer cancel()
+	// Sources with no node are cached too, so that one which isn't on the
+	// tailnet can't have the Local API asked about each of its queries. Other
+	// failures aren't, so that sources are identified once tailscaled answers.
+	who, err := ts.client.WhoIs(ctx, ap.String())
+	if err != nil {
+		log.Debugf("Failed identifying query source %v: %v", addr, err)
+		if !errors.Is(err, errNoNode) {
+			return nil
+		}
+		who = nil
+	}
+	ts.identities.add(ip, who)
+	return who
+}
+
+// add caches the identity of the source at ip, once any expired identities are
+// swept, unless the cache is full.
+func (ids *identities) add(ip netip.Addr, who *apitype.WhoIsResponse) {
+	ids.Lock()
+	defer ids.Unlock()
+	if ids.cache == nil {
+		ids.cache = make(map[netip.Addr]identity)
+	}
+	now := time.Now()
+	for addr, id := range ids.cache {
+		if !now.Before(id.expires) {
+			delete(ids.cache, addr)
+		}
+	}
+	if _, has := ids.cache[ip]; !has && len(ids.cache) >= maxIdentities {
+		return
+	}
+	ids.cache[ip] = identity{who: who, expires: now.Add(identityCacheTTL)}
+}
+
+// ownerOf returns the user owning the untagged peer named qn, or a name beneath
+// it, in zone; zero if it isn't owned by anyone.
+func (r records) ownerOf(qn, zone string) tailcfg.UserID {
+	for name := qn; name != zone; {
+		if rec := r[name]; rec != nil && rec.owner != 0 {
+			return rec.owner
+		}
+		off, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[off:]
+	}
+	return 0
+}
+
+// visible reports whether the name qn in zone can be seen by the node at addr.
+// In the personal zone, the names of untagged peers are only visible to the
+// nodes of their owners, and any other querier is told they don't exist.
+func (ts *Tailscale) visible(ctx context.Context, addr net.Addr, qn, zone string) bool {
+	if zone == "" || zone != ts.PersonalZone {
+		return true
+	}
+	ts.RLock()
+	owner := ts.hosts.ownerOf(qn, zone)
+	ts.RUnlock()
+	if owner == 0 {
+		return true
+	}
+	who := ts.identify(ctx, addr)
+	return who != nil && who.Node != nil && who.Node.User == owner
+}
@@ -0,0 +1,305 @@
+package corednstailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func TestTailscale_ServeDNS_requireIdentity(t *testing.T) {
+	client := &fakeLocalClient{
+		whois: map[string]*apitype.WhoIsResponse{
+			"100.101.102.200:40212": {Node: &tailcfg.Node{Name: "laptop.magic-dns.ts.net."}},
+		},
+	}
+	config := fullTestConfig
+	config.RequireIdentity = true
+	config.Identify = true
+	ts := &Tailscale{
+		Config: config,
+		client: client,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+		Next: test.NextHandler(dns.RcodeNotImplemented, nil),
+	}
+	for tn, tc := range map[string]struct {
+		remote    string
+		qn        string
+		qt        uint16
+		class     uint16
+		update    bool
+		wantRcode int
+	}{
+		"identified":          {remote: "100.101.102.200", qn: "foo.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"unknown tailnet":     {remote: "100.101.102.201", qn: "foo.corp.example.com.", wantRcode: dns.RcodeRefused},
+		"outside tailnet":     {remote: "192.0.2.1", qn: "foo.corp.example.com.", wantRcode: dns.RcodeRefused},
+		"not in zones":        {remote: "192.0.2.1", qn: "foo.example.net.", wantRcode: dns.RcodeNotImplemented},
+		"identified again":    {remote: "100.101.102.200", qn: "bar.corp.example.com.", wantRcode: dns.RcodeNameError},
+		"unknown tailnet 2":   {remote: "100.101.102.201", qn: "bar.corp.example.com.", wantRcode: dns.RcodeRefused},
+		"chaos identified":    {remote: "100.101.102.200", qn: "version.server.", qt: dns.TypeTXT, class: dns.ClassCHAOS, wantRcode: dns.RcodeSuccess},
+		"chaos outside":       {remote: "192.0.2.1", qn: "version.server.", qt: dns.TypeTXT, class: dns.ClassCHAOS, wantRcode: dns.RcodeRefused},
+		"update outside":      {remote: "192.0.2.1", qn: "corp.example.com.", qt: dns.TypeSOA, update: true, wantRcode: dns.RcodeRefused},
+		"update not in zones": {remote: "192.0.2.1", qn: "example.net.", qt: dns.TypeSOA, update: true, wantRcode: dns.RcodeRefused},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := new(dns.Msg)
+			if tc.qt == 0 {
+				tc.qt = dns.TypeA
+			}
+			req.SetQuestion(tc.qn, tc.qt)
+			if tc.class != 0 {
+				req.Question[0].Qclass = tc.class
+			}
+			if tc.update {
+				req.SetUpdate(tc.qn)
+				req.Insert([]dns.RR{&dns.TXT{
+					Hdr: dns.RR_Header{Name: "foo." + tc.qn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{"update"},
+				}})
+			}
+			w := &recorder{ResponseWriter: test.ResponseWriter{RemoteIP: tc.remote}}
+			rcode, err := ts.ServeDNS(context.Background(), w, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rcode != tc.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tc.wantRcode])
+			}
+		})
+	}
+	// Each tailnet source is only looked up once, and others not at all.
+	if calls := client.whoisCalls.Load(); calls != 2 {
+		t.Errorf("WhoIs called %d times, want 2", calls)
+	}
+}
+
+func TestTailscale_identify(t *testing.T) {
+	laptop := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "laptop.magic-dns.ts.net."}}
+	client := &fakeLocalClient{
+		whois: map[string]*apitype.WhoIsResponse{"100.101.102.200:40212": laptop},
+		err:   errors.New("connection refused"),
+	}
+	ts := &Tailscale{Config: fullTestConfig, client: client}
+	known := &net.UDPAddr{IP: net.ParseIP("100.101.102.200"), Port: 40212}
+	unknown := &net.UDPAddr{IP: net.ParseIP("100.101.102.201"), Port: 40212}
+
+	// Failing to ask tailscaled isn't cached, so the source is identified once
+	// it answers.
+	if who := ts.identify(context.Background(), known); who != nil {
+		t.Errorf("identified %v while tailscaled is down", who)
+	}
+	client.err = nil
+	if who := ts.identify(context.Background(), known); who != laptop {
+		t.Errorf("identified %v, want %v", who, laptop)
+	}
+	if calls := client.whoisCalls.Load(); calls != 2 {
+		t.Errorf("WhoIs called %d times, want 2", calls)
+	}
+
+	// A source with no node is cached.
+	for i := 0; i < 2; i++ {
+		if who := ts.identify(context.Background(), unknown); who != nil {
+			t.Errorf("identified %v, want nil", who)
+		}
+	}
+	if calls := client.whoisCalls.Load(); calls != 3 {
+		t.Errorf("WhoIs called %d times, want 3", calls)
+	}
+}
+
+func TestLocalClient_WhoIs(t *testing.T) {
+	laptop := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.magic-dns.ts.net."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	// The Local API of tailscaled answers as its whois handler does.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/whois" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.FormValue("addr") {
+		case "100.101.102.200:40212":
+			json.NewEncoder(w).Encode(laptop)
+		case "100.101.102.201:40212":
+			http.Error(w, "no match for IP:port", 404)
+		default:
+			http.Error(w, "invalid 'addr' parameter", 400)
+		}
+	}))
+	defer srv.Close()
+	lc := &localClient{tailscale.LocalClient{
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+		},
+	}}
+
+	who, err := lc.WhoIs(context.Background(), "100.101.102.200:40212")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if who.Node == nil || who.Node.Name != laptop.Node.Name || who.UserProfile == nil || who.UserProfile.LoginName != laptop.UserProfile.LoginName {
+		t.Errorf("got %+v, want %+v", who, laptop)
+	}
+	if _, err := lc.WhoIs(context.Background(), "100.101.102.201:40212"); !errors.Is(err, errNoNode) {
+		t.Errorf("got error %v for an address with no node, want %v", err, errNoNode)
+	}
+	if _, err := lc.WhoIs(context.Background(), "bogus"); err == nil || errors.Is(err, errNoNode) {
+		t.Errorf("got error %v for a bad request, want another", err)
+	}
+	srv.Close()
+	if _, err := lc.WhoIs(context.Background(), "100.101.102.201:40212"); err == nil || errors.Is(err, errNoNode) {
+		t.Errorf("got error %v with tailscaled down, want another", err)
+	}
+}
+
+func TestIdentities_add(t *testing.T) {
+	var ids identities
+	addr := netip.MustParseAddr("100.64.0.0")
+	for i := 0; i < maxIdentities; i++ {
+		ids.add(addr, nil)
+		addr = addr.Next()
+	}
+	if len(ids.cache) != maxIdentities {
+		t.Fatalf("cached %d identities, want %d", len(ids.cache), maxIdentities)
+	}
+
+	// Past the limit, new sources aren't cached, while cached ones are still
+	// refreshed.
+	ids.add(addr, nil)
+	if _, has := ids.cache[addr]; has {
+		t.Errorf("cached %v past the limit", addr)
+	}
+	first := netip.MustParseAddr("100.64.0.0")
+	laptop := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "laptop.magic-dns.ts.net."}}
+	ids.add(first, laptop)
+	if got := ids.cache[first].who; got != laptop {
+		t.Errorf("cached %v at %v, want %v", got, first, laptop)
+	}
+
+	// Expired identities are swept, making room for others.
+	for ip, id := range ids.cache {
+		if ip != first {
+			id.expires = time.Now().Add(-time.Second)
+			ids.cache[ip] = id
+		}
+	}
+	ids.add(addr, nil)
+	if len(ids.cache) != 2 {
+		t.Errorf("cached %d identities after sweeping, want 2", len(ids.cache))
+	}
+	if _, has := ids.cache[addr]; !has {
+		t.Errorf("%v not cached after sweeping", addr)
+	}
+}
+
+func TestTailscale_ServeDNS_personalZone(t *testing.T) {
+	const alice, bob, tagged tailcfg.UserID = 1, 2, 3
+	config := Config{
+		DefaultZone:    "corp.example.com.",
+		PersonalZone:   "me.corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Wildcard:       true,
+	}
+	buildFastZoneLookup(&config)
+	self := &ipnstate.PeerStatus{
+		DNSName:      "dns.magic-dns.ts.net",
+		UserID:       tagged,
+		Tags:         vs(t, []string{"tag:infra"}),
+		TailscaleIPs: ips(t, "100.101.102.53"),
+	}
+	peers := []*ipnstate.PeerStatus{
+		{
+			DNSName:      "laptop.magic-dns.ts.net",
+			UserID:       alice,
+			TailscaleIPs: ips(t, "100.101.102.1"),
+		},
+		{
+			DNSName:      "phone.magic-dns.ts.net",
+			UserID:       bob,
+			TailscaleIPs: ips(t, "100.101.102.2"),
+		},
+		{
+			DNSName:      "printer.magic-dns.ts.net",
+			UserID:       tagged,
+			Tags:         vs(t, []string{"tag:infra"}),
+			TailscaleIPs: ips(t, "100.101.102.3"),
+		},
+	}
+	client := &fakeLocalClient{
+		whois: map[string]*apitype.WhoIsResponse{
+			"100.101.102.1:40212": {Node: &tailcfg.Node{User: alice}},
+			"100.101.102.2:40212": {Node: &tailcfg.Node{User: bob}},
+		},
+	}
+	ts := &Tailscale{
+		Config: config,
+		client: client,
+		serial: 8675309,
+		hosts:  assemble(&config, self, peers, nil, nil, nil),
+		Next:   test.NextHandler(dns.RcodeNotImplemented, nil),
+	}
+	for tn, tc := range map[string]struct {
+		remote    string
+		qn        string
+		wantRcode int
+	}{
+		"own device":                {remote: "100.101.102.1", qn: "laptop.me.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"own device wildcard":       {remote: "100.101.102.1", qn: "www.laptop.me.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"another user's device":     {remote: "100.101.102.2", qn: "laptop.me.corp.example.com.", wantRcode: dns.RcodeNameError},
+		"another user's wildcard":   {remote: "100.101.102.2", qn: "www.laptop.me.corp.example.com.", wantRcode: dns.RcodeNameError},
+		"unidentified":              {remote: "192.0.2.1", qn: "phone.me.corp.example.com.", wantRcode: dns.RcodeNameError},
+		"tagged":                    {remote: "100.101.102.2", qn: "printer.me.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"tagged unidentified":       {remote: "192.0.2.1", qn: "printer.me.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"default zone":              {remote: "100.101.102.2", qn: "laptop.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"default zone unidentified": {remote: "192.0.2.1", qn: "phone.corp.example.com.", wantRcode: dns.RcodeSuccess},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qn, dns.TypeA)
+			w := &recorder{ResponseWriter: test.ResponseWriter{RemoteIP: tc.remote}}
+			rcode, err := ts.ServeDNS(context.Background(), w, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rcode != tc.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tc.wantRcode])
+			}
+		})
+	}
+
+	// Transfers can't tell who is asking, so they only hold the tagged peers.
+	ts.RLock()
+	defer ts.RUnlock()
+	var got []string
+	for _, rr := range ts.zoneRecords("me.corp.example.com.") {
+		got = append(got, rr.Header().Name)
+	}
+	want := []string{
+		"*.dns.me.corp.example.com.",
+		"*.printer.me.corp.example.com.",
+		"dns.me.corp.example.com.",
+		"ns.me.corp.example.com.",
+		"printer.me.corp.example.com.",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("transferred names mismatch: (-got,+want):\n%v", diff)
+	}
+}
@@ -0,0 +1,86 @@
+package corednstailscale
+
+import (
+	"errors"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics of the plugin, labelled by the default zone of each instance. They
+// are registered with the default registry, which the prometheus plugin
+// serves.
+type metrics struct {
+	reloads    *prometheus.CounterVec
+	records    *prometheus.GaugeVec
+	lastReload *prometheus.GaugeVec
+}
+
+// newMetrics creates the metrics of the plugin in namespace, or the default
+// CoreDNS namespace if empty, and registers them. Metrics already registered
+// by another instance of the plugin are shared with it.
+func newMetrics(namespace string) (*metrics, error) {
+	if namespace == "" {
+		namespace = plugin.Namespace
+	}
+	m := &metrics{
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: name,
+			Name:      "reloads_total",
+			Help:      "Counter of reloads of the records of tailnet peers, by result.",
+		}, []string{"zone", "result"}),
+		records: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: name,
+			Name:      "records",
+			Help:      "The number of names served, as of the last reload.",
+		}, []string{"zone"}),
+		lastReload: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: name,
+			Name:      "last_reload_timestamp_seconds",
+			Help:      "The time of the last successful reload, in seconds since the epoch.",
+		}, []string{"zone"}),
+	}
+	var err error
+	if m.reloads, err = register(m.reloads); err != nil {
+		return nil, err
+	}
+	if m.records, err = register(m.records); err != nil {
+		return nil, err
+	}
+	if m.lastReload, err = register(m.lastReload); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// register c with the default registry, returning the collector registered
+// before it if there is one.
+func register[T prometheus.Collector](c T) (T, error) {
+	err := prometheus.DefaultRegisterer.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+// reloaded records the outcome of a reload of the records in zone. It may be
+// called on a nil *metrics, if metrics are disabled.
+func (m *metrics) reloaded(zone string, n int, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.reloads.WithLabelValues(zone, "failure").Inc()
+		return
+	}
+	m.reloads.WithLabelValues(zone, "success").Inc()
+	m.records.WithLabelValues(zone).Set(float64(n))
+	m.lastReload.WithLabelValues(zone).Set(float64(time.Now().Unix()))
+}
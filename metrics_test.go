@@ -0,0 +1,60 @@
+package corednstailscale
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// value returns the value of the counter or gauge c.
+func value(t *testing.T, c prometheus.Metric) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.Gauge.GetValue()
+}
+
+func TestMetrics(t *testing.T) {
+	m, err := newMetrics("test_metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance shares the metrics registered by the first.
+	if other, err := newMetrics("test_metrics"); err != nil || other.reloads != m.reloads {
+		t.Fatalf("metrics not shared between instances: %v", err)
+	}
+
+	client := &fakeLocalClient{
+		status: ipnstate.Status{Self: &ipnstate.PeerStatus{DNSName: "self.magic-dns.ts.net."}},
+	}
+	ts := &Tailscale{
+		Config:  fullTestConfig,
+		client:  client,
+		metrics: m,
+	}
+	ts.reload()
+	client.err = errors.New("tailscaled is down")
+	ts.reload()
+
+	const zone = "corp.example.com."
+	if got := value(t, m.reloads.WithLabelValues(zone, "success")); got != 1 {
+		t.Errorf("successful reloads = %v, want 1", got)
+	}
+	if got := value(t, m.reloads.WithLabelValues(zone, "failure")); got != 1 {
+		t.Errorf("failed reloads = %v, want 1", got)
+	}
+	if got := value(t, m.records.WithLabelValues(zone)); got == 0 {
+		t.Errorf("records not counted")
+	}
+	if got := value(t, m.lastReload.WithLabelValues(zone)); got == 0 {
+		t.Errorf("last reload time not recorded")
+	}
+}
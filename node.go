@@ -0,0 +1,102 @@
+package corednstailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// node is an embedded Tailscale node, which this plugin runs in place of the
+// tailscaled on the host.
+type node interface {
+	clientish
+	io.Closer
+
+	// start joins the tailnet, and serves queries arriving at the configured
+	// addresses on it with h.
+	start(h plugin.Handler) error
+}
+
+// authKey returns the key with which the node joins the tailnet, read from the
+// configured auth key file, or else from TS_AUTHKEY. It is empty when the node
+// is already logged in with its state, and neither is set.
+func authKey(config *TSNet) (string, error) {
+	if config.AuthKeyFile == "" {
+		return os.Getenv("TS_AUTHKEY"), nil
+	}
+	b, err := os.ReadFile(config.AuthKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed reading tsnet auth key: %v", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("tsnet auth key file %s is empty", config.AuthKeyFile)
+	}
+	return key, nil
+}
+
+// handlerFor adapts a plugin chain to a dns.Handler, answering queries which
+// the chain leaves unanswered with their rcode, as the CoreDNS server does.
+func handlerFor(h plugin.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		rcode, err := h.ServeDNS(context.Background(), w, req)
+		if err != nil {
+			log.Errorf("Failed serving %v over the embedded node: %v", req.Question, err)
+		}
+		if plugin.ClientWrite(rcode) {
+			return
+		}
+		ans := new(dns.Msg)
+		ans.SetRcode(req, rcode)
+		w.WriteMsg(ans)
+	})
+}
+
+// serveFlow serves the queries of a single UDP flow accepted by an embedded
+// node, whose listeners hand out a connection per flow rather than a shared
+// packet connection, until the flow is closed.
+func serveFlow(conn net.Conn, h dns.Handler) {
+	defer conn.Close()
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				log.Debugf("Failed reading from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		h.ServeDNS(&flowWriter{conn}, req)
+	}
+}
+
+// flowWriter writes answers to a UDP flow.
+type flowWriter struct {
+	net.Conn
+}
+
+func (w *flowWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Close is a no-op, since the flow may carry further queries.
+func (w *flowWriter) Close() error        { return nil }
+func (w *flowWriter) TsigStatus() error   { return nil }
+func (w *flowWriter) TsigTimersOnly(bool) {}
+func (w *flowWriter) Hijack()             {}
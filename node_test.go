@@ -0,0 +1,198 @@
+package corednstailscale
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// fakeNode is an embedded node which records how it is used.
+type fakeNode struct {
+	fakeLocalClient
+
+	handler plugin.Handler
+	err     error // returned by start.
+	closed  bool
+}
+
+func (n *fakeNode) start(h plugin.Handler) error {
+	n.handler = h
+	return n.err
+}
+
+func (n *fakeNode) Close() error {
+	n.closed = true
+	return nil
+}
+
+func TestInstance_node(t *testing.T) {
+	defer func() { instances.all = nil }()
+	node := &fakeNode{}
+	in, err := share(&fullTestConfig, func() (*Tailscale, error) {
+		return &Tailscale{Config: fullTestConfig, client: node, node: node}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &block{Tailscale: in.ts, next: test.NextHandler(dns.RcodeRefused, nil)}
+	second := &block{Tailscale: in.ts, next: test.NextHandler(dns.RcodeRefused, nil)}
+	in.serve(first)
+	in.serve(second)
+
+	if err := in.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if node.handler != first {
+		t.Errorf("node not serving the chain of the first block")
+	}
+	in.release()
+	if node.closed {
+		t.Errorf("node closed while still in use")
+	}
+	in.release()
+	if !node.closed {
+		t.Errorf("node not closed once released by every block")
+	}
+
+	failing := &fakeNode{err: errors.New("no auth key")}
+	other := fullTestConfig
+	other.DefaultZone = "other.example.com."
+	in, err = share(&other, func() (*Tailscale, error) {
+		return &Tailscale{Config: other, client: failing, node: failing}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.acquire(); err == nil {
+		t.Errorf("no error starting a failing node")
+	}
+	if in.ts.Ready() {
+		t.Errorf("ready without the node started")
+	}
+}
+
+func TestServeFlow(t *testing.T) {
+	// A connected pair of UDP sockets stands in for a flow accepted by the
+	// embedded node.
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte{0}); err != nil { // to learn its address.
+		t.Fatal(err)
+	}
+	_, addr, err := server.ReadFromUDP(make([]byte, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	flow, err := net.DialUDP("udp", server.LocalAddr().(*net.UDPAddr), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	chain := &block{Tailscale: ts, next: test.NextHandler(dns.RcodeRefused, nil)}
+	go serveFlow(flow, handlerFor(chain))
+	defer flow.Close()
+
+	for qn, want := range map[string]int{
+		"foo.corp.example.com.": dns.RcodeSuccess,
+		"foo.example.net.":      dns.RcodeRefused, // written for the chain.
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(qn, dns.TypeA)
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans := new(dns.Msg)
+		if err := ans.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if ans.Id != req.Id || ans.Rcode != want {
+			t.Errorf("%s: got id %d rcode %s, want id %d rcode %s", qn, ans.Id, dns.RcodeToString[ans.Rcode], req.Id, dns.RcodeToString[want])
+		}
+	}
+}
+
+func TestAuthKey(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "authkey")
+	if err := os.WriteFile(file, []byte("tskey-auth-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TS_AUTHKEY", "tskey-auth-env")
+
+	for _, tc := range []struct {
+		name    string
+		config  TSNet
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "from env",
+			config: TSNet{},
+			want:   "tskey-auth-env",
+		},
+		{
+			name:   "file before env",
+			config: TSNet{AuthKeyFile: file},
+			want:   "tskey-auth-file",
+		},
+		{
+			name:    "missing file",
+			config:  TSNet{AuthKeyFile: filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+		{
+			name:    "empty file",
+			config:  TSNet{AuthKeyFile: empty},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := authKey(&tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("authKey(): unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("authKey(): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
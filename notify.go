@@ -0,0 +1,56 @@
+package corednstailscale
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// parseNotify parses the address of a DNS server, such as a secondary, with the
+// port defaulting to 53 if omitted, and returns it in host:port form.
+func parseNotify(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q is not an IP address", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// notify sends NOTIFY messages for each of zones to the configured secondary
+// servers, so that they transfer the changed zones promptly.
+func (ts *Tailscale) notify(zones []string) {
+	if len(ts.Notify) == 0 {
+		return
+	}
+	c := &dns.Client{}
+	for _, zone := range zones {
+		m := &dns.Msg{}
+		m.SetNotify(zone)
+		for _, addr := range ts.Notify {
+			if err := sendNotify(c, m, addr); err != nil {
+				log.Warningf("Failed notifying %v of change to %v: %v", addr, zone, err)
+			}
+		}
+	}
+	log.Debugf("Sent notifies for %d zones to %v", len(zones), ts.Notify)
+}
+
+// sendNotify sends m to addr, retrying a few times if it is not acknowledged.
+func sendNotify(c *dns.Client, m *dns.Msg, addr string) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		var ret *dns.Msg
+		if ret, _, err = c.Exchange(m, addr); err != nil {
+			continue
+		}
+		if ret.Rcode == dns.RcodeSuccess {
+			return nil
+		}
+		err = fmt.Errorf("rcode was %v", dns.RcodeToString[ret.Rcode])
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package corednstailscale
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestTailscale_notify(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fullTestConfig
+	config.Notify = []string{pc.LocalAddr().String()}
+	var want []string
+	for zone := range config.fastZoneLookup {
+		want = append(want, zone)
+	}
+	sort.Strings(want)
+
+	got := make(chan string, len(want))
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			if req.Opcode == dns.OpcodeNotify {
+				got <- req.Question[0].Name
+			}
+			ans := &dns.Msg{}
+			ans.SetReply(req)
+			w.WriteMsg(ans)
+		}),
+	}
+	go srv.ActivateAndServe()
+	<-started
+
+	ts := &Tailscale{Config: config}
+	ts.notify(ts.zones())
+	srv.Shutdown()
+
+	var zones []string
+	for range want {
+		select {
+		case zone := <-got:
+			zones = append(zones, zone)
+		case <-time.After(time.Second):
+			t.Fatalf("got notifies for %v, want %v", zones, want)
+		}
+	}
+	sort.Strings(zones)
+	if diff := cmp.Diff(zones, want); diff != "" {
+		t.Errorf("notified zones mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestParseNotify(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		"ipv4":           {addr: "10.240.0.1", want: "10.240.0.1:53"},
+		"ipv4 with port": {addr: "10.240.0.1:5353", want: "10.240.0.1:5353"},
+		"ipv6":           {addr: "fd00::1", want: "[fd00::1]:53"},
+		"ipv6 with port": {addr: "[fd00::1]:5353", want: "[fd00::1]:5353"},
+		"hostname":       {addr: "ns2.example.com.", wantErr: true},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got, err := parseNotify(tc.addr)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseNotify(%q): got error %v, wantErr %v", tc.addr, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("parseNotify(%q): got %q, want %q", tc.addr, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package corednstailscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAPIBaseURL is the base URL of the Tailscale API.
+const defaultAPIBaseURL = "https://api.tailscale.com"
+
+// oauthClient exchanges OAuth client credentials for access tokens to the
+// Tailscale API, which are used as API keys. Tokens are cached until shortly
+// before they expire, so that a fleet of servers reloading often doesn't
+// request a token each time.
+type oauthClient struct {
+	id, secret string
+	scopes     []string
+
+	sync.Mutex // protects the following.
+	token      string
+	expiry     time.Time
+}
+
+// oauthClients are shared by the instances of this plugin, keyed by client ID
+// and scopes.
+var oauthClients struct {
+	sync.Mutex
+	all map[string]*oauthClient
+}
+
+// oauthTokenMargin is how long before their expiry tokens are replaced.
+const oauthTokenMargin = time.Minute
+
+// oauthClientFor returns the client with the given credentials.
+func oauthClientFor(id, secret string, scopes []string) *oauthClient {
+	oauthClients.Lock()
+	defer oauthClients.Unlock()
+	key := id + " " + strings.Join(scopes, " ")
+	if c, has := oauthClients.all[key]; has && c.secret == secret {
+		return c
+	}
+	c := &oauthClient{id: id, secret: secret, scopes: scopes}
+	if oauthClients.all == nil {
+		oauthClients.all = make(map[string]*oauthClient)
+	}
+	oauthClients.all[key] = c
+	return c
+}
+
+// accessToken returns a current access token, requesting a new one from the
+// API at baseURL if needed.
+func (c *oauthClient) accessToken(ctx context.Context, baseURL string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.token != "" && time.Now().Add(oauthTokenMargin).Before(c.expiry) {
+		return c.token, nil
+	}
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.scopes) > 0 {
+		form.Set("scope", strings.Join(c.scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.id), url.QueryEscape(c.secret))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth token request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("invalid oauth token response: %v", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("oauth token response without an access token")
+	}
+	c.token = tok.AccessToken
+	c.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return c.token, nil
+}
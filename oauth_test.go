@@ -0,0 +1,115 @@
+package corednstailscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeOAuthAPI serves OAuth tokens for the client "k123" with secret
+// "tskey-client-test", and the test policy to holders of its tokens.
+type fakeOAuthAPI struct {
+	tokens    int // number of tokens issued.
+	expiresIn int
+}
+
+func (api *fakeOAuthAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v2/oauth/token":
+		id, secret, _ := r.BasicAuth()
+		if id != "k123" || secret != "tskey-client-test" || r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, `{"message":"invalid client"}`, http.StatusUnauthorized)
+			return
+		}
+		api.tokens++
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("tskey-api-token%d", api.tokens),
+			"token_type":   "Bearer",
+			"expires_in":   api.expiresIn,
+			"scope":        r.FormValue("scope"),
+		})
+	case "/api/v2/tailnet/example.com/acl":
+		if user, _, _ := r.BasicAuth(); user != fmt.Sprintf("tskey-api-token%d", api.tokens) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			ACL []byte `json:"acl"`
+		}{[]byte(testPolicy)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestOAuthClient_accessToken(t *testing.T) {
+	api := &fakeOAuthAPI{expiresIn: 3600}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	c := &oauthClient{id: "k123", secret: "tskey-client-test", scopes: []string{"acl:read"}}
+	for i := 0; i < 2; i++ {
+		token, err := c.accessToken(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "tskey-api-token1" {
+			t.Errorf("token %d = %q, want the first one issued", i, token)
+		}
+	}
+
+	// Tokens are replaced shortly before they expire.
+	c.expiry = time.Now().Add(oauthTokenMargin / 2)
+	token, err := c.accessToken(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "tskey-api-token2" {
+		t.Errorf("token = %q after expiry, want a new one", token)
+	}
+
+	bad := &oauthClient{id: "k123", secret: "wrong"}
+	if _, err := bad.accessToken(context.Background(), srv.URL); err == nil {
+		t.Errorf("no error for invalid credentials")
+	}
+}
+
+func TestParseConfig_aclPolicyOAuth(t *testing.T) {
+	defer func() { oauthClients.all = nil }()
+	srv := httptest.NewServer(&fakeOAuthAPI{expiresIn: 3600})
+	defer srv.Close()
+
+	c := caddy.NewTestController("dns", fmt.Sprintf(`tailscale corp.example.com. {
+		acl-policy oauth example.com k123 tskey-client-test acl:read
+		api-url %s
+	}`, srv.URL))
+	var got Config
+	if err := parse(c, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"prod":       "example.com.",
+		"campus-den": "den.corp.example.com.",
+		"lab":        "lab.corp.example.com.",
+	}
+	if diff := cmp.Diff(got.Zones, want); diff != "" {
+		t.Errorf("zones mismatch: (-got,+want):\n%v", diff)
+	}
+	if diff := cmp.Diff(got.PolicyOAuthScopes, []string{"acl:read"}); diff != "" {
+		t.Errorf("scopes mismatch: (-got,+want):\n%v", diff)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`tailscale corp.example.com. {
+		acl-policy oauth example.com k123 wrong
+		api-url %s
+	}`, srv.URL))
+	if err := parse(c, &Config{}); err == nil {
+		t.Errorf("no error for invalid oauth client")
+	}
+}
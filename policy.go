@@ -0,0 +1,230 @@
+package corednstailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+)
+
+// zoneAnnotation matches the annotations of tags in tailnet policies, which
+// name the zones in which tagged peers are served.
+var zoneAnnotation = regexp.MustCompile(`dns-zone:\s*(\S+)`)
+
+// policySource returns true if a tailnet policy file is configured.
+func (c *Config) policySource() bool {
+	return c.PolicyFile != "" || c.PolicyTailnet != "" || c.PolicyHeadscaleKey != ""
+}
+
+// readPolicy returns the tailnet policy file configured by config, read from
+// disk or fetched from the Tailscale or Headscale API.
+func readPolicy(config *Config) ([]byte, error) {
+	if config.PolicyFile != "" {
+		return os.ReadFile(config.PolicyFile)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout())
+	defer cancel()
+	if config.PolicyHeadscaleKey != "" {
+		return readHeadscalePolicy(ctx, config.APIURL, config.PolicyHeadscaleKey)
+	}
+	key := config.PolicyAPIKey
+	if config.PolicyOAuthClientID != "" {
+		// Access tokens are used as API keys.
+		oc := oauthClientFor(config.PolicyOAuthClientID, config.PolicyOAuthSecret, config.PolicyOAuthScopes)
+		token, err := oc.accessToken(ctx, config.APIURL)
+		if err != nil {
+			return nil, err
+		}
+		key = token
+	}
+	tailscale.I_Acknowledge_This_API_Is_Unstable = true
+	client := tailscale.NewClient(config.PolicyTailnet, tailscale.APIKey(key))
+	client.BaseURL = config.APIURL
+	acl, err := client.ACLHuJSON(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(acl.ACL), nil
+}
+
+// localPolicy returns the tailnet policy file configured by config if it is
+// read from disk, or nil if it is fetched from an API, so that configurations
+// can be checked without contacting one.
+func localPolicy(config *Config) ([]byte, error) {
+	if config.PolicyFile == "" {
+		return nil, nil
+	}
+	return readPolicy(config)
+}
+
+// applyPolicy adds the tag zones declared by the tailnet policy file doc to
+// config.
+func applyPolicy(config *Config, doc []byte) error {
+	zones, err := policyZones(doc)
+	if err != nil {
+		return err
+	}
+	return (&zonesFrom{Tags: zones}).apply(config)
+}
+
+// readHeadscalePolicy fetches the policy from the Headscale server at baseURL,
+// whose API differs from Tailscale's.
+func readHeadscalePolicy(ctx context.Context, baseURL, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/api/v1/policy", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("headscale policy request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var policy struct {
+		Policy string `json:"policy"`
+	}
+	if err := json.Unmarshal(body, &policy); err != nil {
+		return nil, fmt.Errorf("invalid headscale policy response: %v", err)
+	}
+	return []byte(policy.Policy), nil
+}
+
+// policyToken is a token of a HuJSON document.
+type policyToken struct {
+	kind byte // '"' for strings, '/' for comments, or the punctuation itself.
+	text string
+	line int
+}
+
+// lexPolicy splits a HuJSON document into strings, comments and punctuation.
+// Literals other than strings are returned as a single 'v' token each.
+func lexPolicy(doc []byte) ([]policyToken, error) {
+	var tokens []policyToken
+	line := 1
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(doc) && doc[j] != '"'; j++ {
+				if doc[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(doc) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			var s string
+			if err := json.Unmarshal(doc[i:j+1], &s); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			tokens = append(tokens, policyToken{kind: '"', text: s, line: line})
+			i = j + 1
+		case bytes.HasPrefix(doc[i:], []byte("//")):
+			j := bytes.IndexByte(doc[i:], '\n')
+			if j < 0 {
+				j = len(doc) - i
+			}
+			tokens = append(tokens, policyToken{kind: '/', text: string(doc[i+2 : i+j]), line: line})
+			i += j
+		case bytes.HasPrefix(doc[i:], []byte("/*")):
+			j := bytes.Index(doc[i+2:], []byte("*/"))
+			if j < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			text := doc[i+2 : i+2+j]
+			tokens = append(tokens, policyToken{kind: '/', text: string(text), line: line})
+			line += bytes.Count(text, []byte("\n"))
+			i += j + 4
+		case strings.IndexByte("{}[]:,", c) >= 0:
+			tokens = append(tokens, policyToken{kind: c, line: line})
+			i++
+		default:
+			j := i
+			for j < len(doc) && strings.IndexByte("{}[]:,\"/ \t\r\n", doc[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, policyToken{kind: 'v', text: string(doc[i:j]), line: line})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// policyZones returns the zones of the tags annotated in a tailnet policy, in
+// HuJSON, keyed by tag without its "tag:" prefix. A tag is annotated where it
+// is a key, as in tagOwners, by a comment containing dns-zone: and the zone,
+// either on the lines right above it or at the end of its line.
+func policyZones(doc []byte) (map[string]string, error) {
+	tokens, err := lexPolicy(doc)
+	if err != nil {
+		return nil, err
+	}
+	// next returns the index of the first token from i which isn't a comment.
+	next := func(i int) int {
+		for i < len(tokens) && tokens[i].kind == '/' {
+			i++
+		}
+		return i
+	}
+
+	zones := make(map[string]string)
+	prev := -1 // index of the last token which isn't a comment.
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.kind == '/' {
+			continue
+		}
+		isKey := tok.kind == '"' && strings.HasPrefix(tok.text, "tag:")
+		if n := next(i + 1); !isKey || n >= len(tokens) || tokens[n].kind != ':' {
+			prev = i
+			continue
+		}
+		var comments []policyToken
+		// Comments right above the key, other than those trailing the previous
+		// token on its line...
+		for j := prev + 1; j < i; j++ {
+			if prev < 0 || tokens[j].line > tokens[prev].line {
+				comments = append(comments, tokens[j])
+			}
+		}
+		// ... and those at the end of its line.
+		for j := i + 1; j < len(tokens) && tokens[j].line == tok.line; j++ {
+			if tokens[j].kind == '/' {
+				comments = append(comments, tokens[j])
+			}
+		}
+		tag := strings.TrimPrefix(tok.text, "tag:")
+		for _, c := range comments {
+			m := zoneAnnotation.FindStringSubmatch(c.text)
+			if m == nil {
+				continue
+			}
+			if prev, has := zones[tag]; has && prev != m[1] {
+				return nil, fmt.Errorf("line %d: tag %q annotated with zones %q and %q", c.line, tag, prev, m[1])
+			}
+			zones[tag] = m[1]
+		}
+		prev = i
+	}
+	return zones, nil
+}
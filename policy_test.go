@@ -0,0 +1,164 @@
+package corednstailscale
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testPolicy = `{
+	// Tags are served in zones named by annotations.
+	"tagOwners": {
+		// Production servers.
+		// dns-zone: example.com.
+		"tag:prod": ["group:ops"],
+		"tag:campus-den": ["group:den"], // dns-zone: den.corp.example.com.
+		/* dns-zone: lab.corp.example.com. */ "tag:lab": [],
+		"tag:ci-runner": ["autogroup:admin"], // not served in a zone.
+	},
+	"acls": [
+		// dns-zone: ignored.example.com.
+		{"action": "accept", "src": ["tag:prod"], "dst": ["tag:lab:*"]},
+	],
+}`
+
+func TestPolicyZones(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		doc     string
+		want    map[string]string
+		wantErr bool
+	}{
+		"annotations": {
+			doc: testPolicy,
+			want: map[string]string{
+				"prod":       "example.com.",
+				"campus-den": "den.corp.example.com.",
+				"lab":        "lab.corp.example.com.",
+			},
+		},
+		"trailing comment of previous line": {
+			doc: `{"tagOwners": {
+				"tag:a": [], // dns-zone: a.example.com.
+				"tag:b": [],
+			}}`,
+			want: map[string]string{"a": "a.example.com."},
+		},
+		"conflicting annotations": {
+			doc: `{"tagOwners": {
+				// dns-zone: a.example.com.
+				"tag:a": [], // dns-zone: b.example.com.
+			}}`,
+			wantErr: true,
+		},
+		"unterminated string": {
+			doc:     `{"tagOwners": {"tag:a`,
+			wantErr: true,
+		},
+		"unterminated comment": {
+			doc:     `{/* dns-zone: a.example.com.`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got, err := policyZones([]byte(tc.doc))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error value: %v", err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfig_aclPolicy(t *testing.T) {
+	wantZones := map[string]string{
+		"prod":       "example.com.",
+		"campus-den": "den.corp.example.com.",
+		"lab":        "lab.corp.example.com.",
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.hujson")
+	if err := os.WriteFile(path, []byte(testPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := caddy.NewTestController("dns", fmt.Sprintf(`tailscale corp.example.com. {
+		acl-policy %s
+	}`, path))
+	var got Config
+	if err := parse(c, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got.Zones, wantZones); diff != "" {
+		t.Errorf("zones from file mismatch: (-got,+want):\n%v", diff)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/tailnet/example.com/acl":
+			if user, _, _ := r.BasicAuth(); user != "tskey-api-test" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(struct {
+				ACL []byte `json:"acl"`
+			}{[]byte(testPolicy)})
+		case "/api/v1/policy": // Headscale.
+			if r.Header.Get("Authorization") != "Bearer hs-test" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"policy":    testPolicy,
+				"updatedAt": "2023-09-01T00:00:00Z",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, input := range []string{
+		`acl-policy api example.com tskey-api-test`,
+		`acl-policy headscale hs-test`,
+	} {
+		c = caddy.NewTestController("dns", fmt.Sprintf(`tailscale corp.example.com. {
+			%s
+			api-url %s/
+		}`, input, srv.URL))
+		got = Config{}
+		if err := parse(c, &got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got.Zones, wantZones); diff != "" {
+			t.Errorf("zones from %q mismatch: (-got,+want):\n%v", input, diff)
+		}
+	}
+
+	for _, input := range []string{
+		`acl-policy`,
+		`acl-policy api example.com`,
+		fmt.Sprintf("acl-policy %s\nacl-policy %s", path, path),
+		fmt.Sprintf("acl-policy %s\ntag prod example.net.", path),
+		fmt.Sprintf("acl-policy api example.com tskey-api-wrong\napi-url %s", srv.URL),
+		fmt.Sprintf("acl-policy headscale hs-wrong\napi-url %s", srv.URL),
+		`acl-policy headscale hs-test`,
+		`api-url headscale.example.com`,
+		fmt.Sprintf("acl-policy %s", filepath.Join(t.TempDir(), "missing.hujson")),
+	} {
+		c := caddy.NewTestController("dns", fmt.Sprintf("tailscale corp.example.com. {\n%s\n}", input))
+		if err := parse(c, &Config{}); err == nil {
+			t.Errorf("no error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package corednstailscale
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bumpSerials changes the serial of each of zones, which have changed at now,
+// according to the serial mode. The last serial set also becomes the serial of
+// the last change. Must be called with the lock held.
+func (ts *Tailscale) bumpSerials(zones []string, now time.Time) {
+	if ts.serials == nil {
+		ts.serials = make(map[string]uint32)
+	}
+	s := serial(now)
+	for _, zone := range zones {
+		prev := ts.serialOf(zone)
+		switch ts.Serial {
+		case SerialIncrement:
+			s = next(prev)
+		case SerialDate:
+			s = dateSerial(now)
+			if s <= prev {
+				s = next(prev)
+			}
+		case SerialUnix:
+			s = uint32(now.Unix())
+			if s <= prev {
+				s = next(prev)
+			}
+		}
+		ts.serials[zone] = s
+	}
+	ts.serial = s
+	if err := ts.saveSerials(); err != nil {
+		log.Errorf("Failed saving serials to %q: %v", ts.SerialFile, err)
+	}
+}
+
+// next returns the serial following s.
+func next(s uint32) uint32 {
+	s++
+	if s == 0 {
+		// Zero means there is no serial, so skip it on wrapping. This is fine by
+		// RFC 1982 serial number arithmetic.
+		s = 1
+	}
+	return s
+}
+
+// dateSerial returns the first serial of the day of now in the YYYYMMDDnn
+// form, in UTC.
+func dateSerial(now time.Time) uint32 {
+	y, m, d := now.UTC().Date()
+	return uint32(y*1000000 + int(m)*10000 + d*100)
+}
+
+// serialOf returns the serial of zone, which defaults to the serial of the last
+// change. Must be called with the read lock held.
+func (ts *Tailscale) serialOf(zone string) uint32 {
+	if s, has := ts.serials[zone]; has {
+		return s
+	}
+	return ts.serial
+}
+
+// loadSerials reads the serial of each zone from the serial file, if one is
+// configured and exists, so that serials don't go backwards across restarts.
+func (ts *Tailscale) loadSerials() error {
+	if ts.SerialFile == "" {
+		return nil
+	}
+	f, err := os.Open(ts.SerialFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	serials := make(map[string]uint32)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var zone string
+		var s uint32
+		if _, err := fmt.Sscanf(sc.Text(), "%s %d", &zone, &s); err != nil {
+			return fmt.Errorf("bad serial %q: %v", sc.Text(), err)
+		}
+		if ts.fastZoneLookup[zone] {
+			serials[zone] = s
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+	ts.serials = serials
+	return nil
+}
+
+// saveSerials writes the serial of each zone to the serial file, if one is
+// configured. Must be called with the lock held.
+func (ts *Tailscale) saveSerials() error {
+	if ts.SerialFile == "" {
+		return nil
+	}
+	zones := make([]string, 0, len(ts.serials))
+	for zone := range ts.serials {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	var b strings.Builder
+	for _, zone := range zones {
+		fmt.Fprintf(&b, "%s %d\n", zone, ts.serials[zone])
+	}
+	return writeFile(ts.SerialFile, []byte(b.String()))
+}
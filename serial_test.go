@@ -0,0 +1,94 @@
+package corednstailscale
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTailscale_bumpSerials(t *testing.T) {
+	serialFile := filepath.Join(t.TempDir(), "serials")
+	config := fullTestConfig
+	config.Serial = SerialIncrement
+	config.SerialFile = serialFile
+	ts := &Tailscale{
+		Config:  config,
+		serials: map[string]uint32{"example.com.": 41, "corp.example.com.": 0xffffffff},
+	}
+
+	ts.bumpSerials([]string{"corp.example.com.", "example.com.", "den.corp.example.com."}, time.Now())
+	want := map[string]uint32{
+		"corp.example.com.":     1,
+		"example.com.":          42,
+		"den.corp.example.com.": 1,
+	}
+	if diff := cmp.Diff(ts.serials, want); diff != "" {
+		t.Errorf("serials mismatch: (-got,+want):\n%v", diff)
+	}
+
+	// The serials should survive a restart.
+	b, err := os.ReadFile(serialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "corp.example.com. 1\nden.corp.example.com. 1\nexample.com. 42\n"; got != want {
+		t.Errorf("serial file: got %q, want %q", got, want)
+	}
+	ts.serials = nil
+	if err := ts.loadSerials(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ts.serials, want); diff != "" {
+		t.Errorf("loaded serials mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestTailscale_bumpSerialsModes(t *testing.T) {
+	now := time.Date(2024, time.March, 9, 12, 0, 0, 0, time.UTC)
+	for tn, tc := range map[string]struct {
+		mode    SerialMode
+		serials map[string]uint32
+		want    map[string]uint32
+	}{
+		"hash": {
+			mode: SerialHash,
+			want: map[string]uint32{"corp.example.com.": serial(now)},
+		},
+		"date": {
+			mode: SerialDate,
+			want: map[string]uint32{"corp.example.com.": 2024030900},
+		},
+		"date changed earlier that day": {
+			mode:    SerialDate,
+			serials: map[string]uint32{"corp.example.com.": 2024030904},
+			want:    map[string]uint32{"corp.example.com.": 2024030905},
+		},
+		"date from an earlier day": {
+			mode:    SerialDate,
+			serials: map[string]uint32{"corp.example.com.": 2024030812},
+			want:    map[string]uint32{"corp.example.com.": 2024030900},
+		},
+		"unix": {
+			mode: SerialUnix,
+			want: map[string]uint32{"corp.example.com.": uint32(now.Unix())},
+		},
+		"unix changed within the second": {
+			mode:    SerialUnix,
+			serials: map[string]uint32{"corp.example.com.": uint32(now.Unix())},
+			want:    map[string]uint32{"corp.example.com.": uint32(now.Unix()) + 1},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			config := fullTestConfig
+			config.Serial = tc.mode
+			ts := &Tailscale{Config: config, serials: tc.serials}
+			ts.bumpSerials([]string{"corp.example.com."}, now)
+			if diff := cmp.Diff(ts.serials, tc.want); diff != "" {
+				t.Errorf("serials mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -1,12 +1,23 @@
 package corednstailscale
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	corelog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
 	"tailscale.com/client/tailscale"
 )
 
@@ -25,58 +36,769 @@ type Config struct {
 	// DefaultZone in which all peers should appear.
 	DefaultZone string
 
+	// ExtraZones are further zones in which all peers appear, as in the
+	// DefaultZone. Names in the DefaultZone are still preferred wherever one
+	// name of a peer is chosen, such as in CNAME targets and reverse records.
+	ExtraZones []string
+
 	// Zones maps Tailscale ACL tags to additional zones in which tagged peers
 	// should appear in addition to the DefaultZone.
 	Zones map[string]string
 
+	// Users maps the login names of Tailscale users, in lower case, to zones
+	// in which the peers they own should appear.
+	Users map[string]string
+
+	// OwnerZone, if set, is a zone in which the peers owned by each user
+	// appear beneath a label formed from the user's login name, such as
+	// laptop.alice.users.corp.example.com. for alice@example.com.
+	OwnerZone string
+
+	// OSZones maps the operating systems of peers, such as linux or macos, to
+	// zones in which peers running them should appear.
+	OSZones map[string]string
+
+	// Capabilities maps capabilities granted to peers in the policy's grants,
+	// such as example.com/cap/dns-prod, to zones in which peers holding them
+	// on this node should appear.
+	Capabilities map[string]string
+
+	// RecordCapability, if set, is the capability whose values, granted to a
+	// peer, declare additional names, TXT strings and services of the peer.
+	RecordCapability string
+
+	// FunnelZone, if set, is a zone in which peers with Funnel enabled appear
+	// as aliases of their MagicDNS names, under which they are reachable from
+	// the internet.
+	FunnelZone string
+
+	// PersonalZone, if set, is a zone in which all peers appear, but in which
+	// the names of untagged peers are only visible to the nodes of their
+	// owners.
+	PersonalZone string
+
+	// ANAMEs maps served zones to names whose addresses are served at their
+	// apex, resolved on each reload.
+	ANAMEs map[string]string
+
+	// Normalize determines the normalization of the host names of peers.
+	Normalize Normalization
+
+	// LabelSource determines where the host names of peers are taken from.
+	// The zero value takes them from their MagicDNS names.
+	LabelSource LabelSource
+
+	// ShortNames enables answering queries for the addresses of peers by their
+	// host names alone, such as grafana., as for their names in the
+	// DefaultZone.
+	ShortNames bool
+
+	// ExcludeSelf omits the node on which this plugin runs from the served
+	// zones as a host. It is still served as their nameserver.
+	ExcludeSelf bool
+
+	// SelfZones, if not empty, are the only zones in which the node on which
+	// this plugin runs is served as a host. It is still served as the
+	// nameserver of all zones.
+	SelfZones map[string]bool
+
+	// RequireTags are the ACL tags of which peers must carry at least one to
+	// be served in the DefaultZone and ExtraZones. All peers are served in
+	// them if empty.
+	RequireTags map[string]bool
+
+	// ExcludeTags are the ACL tags of peers which are omitted from all zones.
+	ExcludeTags map[string]bool
+
+	// IncludeOS, if not empty, are the only operating systems of peers which
+	// are served, such as linux or windows. Others are omitted from all zones.
+	IncludeOS map[string]bool
+
+	// ExcludeOS are the operating systems of peers which are omitted from all
+	// zones.
+	ExcludeOS map[string]bool
+
+	// OnlineOnly omits peers which tailscaled doesn't report as online from
+	// all zones, so that names of machines which are off don't resolve.
+	OnlineOnly bool
+
+	// ExcludeExpired omits peers whose node keys have expired from all zones,
+	// since they can't be reached.
+	ExcludeExpired bool
+
+	// KeyExpiryTTL cuts the TTLs of the address and CNAME records of peers
+	// short as their key expiry approaches, and omits them once it has
+	// passed, so that their names aren't cached beyond it.
+	KeyExpiryTTL bool
+
+	// Shared determines how peers of other tailnets, shared into this one or
+	// owned by users it is shared with, are served. By default, they are
+	// served like any other peer.
+	Shared SharedPeers
+
+	// SharedZone is the zone in which peers of other tailnets are served when
+	// Shared is SharedZone.
+	SharedZone string
+
+	// PruneAfter, if not zero, omits offline peers which were last seen
+	// longer ago than it from all zones, though they remain in the tailnet.
+	PruneAfter time.Duration
+
+	// NameTagPrefix, if not empty, is the prefix of ACL tags which override
+	// the host names of peers carrying them, such as dns-name- for
+	// tag:dns-name-mail.
+	NameTagPrefix string
+
+	// AliasTagPrefix, if not empty, is the prefix of ACL tags which give
+	// additional host names to peers carrying them, such as dns-alias- for
+	// tag:dns-alias-grafana.
+	AliasTagPrefix string
+
+	// Templates maps served zones to the templates from which the names of
+	// peers in them are formed, in which {host} is replaced by the peer's host
+	// name and {tag} by the tag which placed it in the zone. Peers are named by
+	// their host name alone in zones without a template.
+	Templates map[string]string
+
+	// Aliases maps additional host names to the host names of the peers they
+	// are served as, in each zone in which the peers are served.
+	Aliases map[string]string
+
+	// Labels maps Tailscale ACL tags to labels below the DefaultZone, under
+	// which tagged peers also appear, as in db1.iad.corp.example.com.
+	Labels map[string]string
+
+	// Apex maps Tailscale ACL tags to zones at whose apex the addresses of
+	// tagged peers are served.
+	Apex map[string]string
+
 	// ReloadInterval at which polling for changes to peers should occur. Also
-	// used as the TTL for responses.
+	// used as the TTL for responses if no TTL is configured.
 	ReloadInterval time.Duration
 
+	// TTL of records in responses. Defaults to the ReloadInterval if zero.
+	TTL time.Duration
+
+	// EphemeralTTL is the TTL of the address and CNAME records of peers
+	// carrying any of the EphemeralTags, which may disappear at any moment.
+	EphemeralTTL time.Duration
+
+	// EphemeralTags are the ACL tags of ephemeral peers, which are served
+	// with the EphemeralTTL.
+	EphemeralTags map[string]bool
+
+	// MaxStale, if not zero, is how long records may be served after the last
+	// successful reload. Beyond it, the plugin is not ready, and queries in
+	// the served zones fail.
+	MaxStale time.Duration
+
+	// Upstream, if not empty, is the address of a resolver, such as
+	// 100.100.100.100:53, which resolves the MagicDNS names to which CNAMEs
+	// point, for the addresses following them in answers.
+	Upstream string
+
+	// NoMetrics disables the plugin's metrics.
+	NoMetrics bool
+
+	// MetricsNamespace is the namespace of the plugin's metrics, which
+	// defaults to that of other CoreDNS metrics if empty.
+	MetricsNamespace string
+
+	// Socket is the path of the tailscaled socket. If empty, the platform's
+	// default is used, falling back to other means of finding tailscaled.
+	Socket string
+
+	// RequireIdentity refuses queries in the served zones, updates and CHAOS
+	// queries from sources which Tailscale can't identify as nodes of the
+	// tailnet.
+	RequireIdentity bool
+
+	// BindTailnet limits the server block to listening on the Tailscale
+	// addresses of the node running this plugin, which are looked up at setup.
+	BindTailnet bool
+
+	// TSNet, if set, configures an embedded Tailscale node which this plugin
+	// runs in place of the tailscaled on the host.
+	TSNet *TSNet
+
+	// NoWatch disables watching the IPN bus for changes to the network map,
+	// which are otherwise served as they happen rather than at the next reload.
+	NoWatch bool
+
+	// Timeout bounds each call to the Tailscale Local API, so that a hung
+	// tailscaled can't stall reloads. Defaults to defaultTimeout if zero.
+	Timeout time.Duration
+
+	// SOA holds the timers of the served zones' SOA records. Any which are
+	// zero are derived from the ReloadInterval.
+	SOA SOATimers
+
+	// ZoneSOA maps served zones to the timers of their SOA records, in place
+	// of SOA.
+	ZoneSOA map[string]SOATimers
+
+	// NegativeTTL for which negative answers are cached, which is published as
+	// the SOA minimum. Derived from the ReloadInterval if zero.
+	NegativeTTL time.Duration
+
+	// Mailboxes maps served zones to the mailboxes of the persons responsible
+	// for them, in domain name form, as published in their SOA records. The
+	// mailbox for the empty zone applies to zones without their own.
+	Mailboxes map[string]string
+
+	// Serial determines how the serials of zones change along with their
+	// records.
+	Serial SerialMode
+
+	// SerialFile in which the serials of zones are persisted, so that they
+	// don't go backwards across restarts.
+	SerialFile string
+
+	// Answer determines how queries for peers' addresses are answered.
+	Answer AnswerMode
+
+	// ZoneAnswers maps served zones to the modes in which queries for peers'
+	// addresses in them are answered, overriding the Answer.
+	ZoneAnswers map[string]AnswerMode
+
+	// DNS64 is the prefix with which AAAA records are synthesized from the
+	// IPv4 addresses of peers which have no IPv6 address, per RFC 6147. No
+	// records are synthesized if it is invalid.
+	DNS64 netip.Prefix
+
+	// Types maps served zones to the only record types served in them, other
+	// than SOA and NS records. Peers are flattened in zones which don't serve
+	// CNAME records. All types are served in zones which aren't listed.
+	Types map[string]map[uint16]bool
+
+	// Families maps served zones to the address families to which their
+	// address records are limited. The empty zone holds the default for zones
+	// not listed. Both families are served if neither is configured.
+	Families map[string]AddressFamily
+
+	// Order determines the order of address records in answers. They are
+	// answered in the order Tailscale reports them if empty.
+	Order OrderMode
+
+	// Reverse enables serving PTR records for peers' Tailscale addresses.
+	Reverse bool
+
+	// Metadata enables serving TXT records containing peer metadata, such as
+	// OS and creation time, at each peer's name.
+	Metadata bool
+
+	// TagsTXT enables serving TXT records listing the ACL tags of each peer at
+	// each peer's name.
+	TagsTXT bool
+
+	// NodeAttrs are the node attributes, such as funnel, which are listed in
+	// TXT records at the names of peers which have them. Attributes with
+	// parameters are matched by the part before them.
+	NodeAttrs map[string]bool
+
+	// HINFO enables serving HINFO records describing each peer's platform at
+	// each peer's name.
+	HINFO bool
+
+	// Posture enables serving TXT records of facts about each peer's posture,
+	// such as its Tailscale version and key expiry, at _posture beneath each
+	// peer's name.
+	Posture bool
+
+	// VIPServices enables serving the virtual IPs of Tailscale Services in the
+	// default zones, by the first labels of their MagicDNS names.
+	VIPServices bool
+
+	// Authority enables attaching the zone's NS RRset to the authority section
+	// of positive answers for peers, for caching resolvers which refresh
+	// delegation data from it.
+	Authority bool
+
+	// NoAuthority limits this plugin to answering queries for the records of
+	// peers, for deployments where another source is authoritative for the
+	// served zones. No nameserver records are synthesized, and queries which
+	// would be answered negatively or from the SOA or NS RRsets are passed on.
+	NoAuthority bool
+
+	// NoAuthoritative clears the Authoritative bit of answers, for deployments
+	// where this plugin fronts a recursive chain and shouldn't claim
+	// authority.
+	NoAuthoritative bool
+
+	// RecursionAvailable sets the RecursionAvailable bit of answers.
+	RecursionAvailable bool
+
+	// Minimal suppresses optional data in the authority and additional
+	// sections of answers, to keep responses small.
+	Minimal bool
+
+	// NoCompress disables name compression in answers, for networks with
+	// middleboxes which mishandle compressed messages.
+	NoCompress bool
+
+	// MaxUDPSize caps the size of answers sent over UDP, below the size
+	// advertised by the client. Larger answers are truncated. Zero leaves
+	// answers limited by the client alone.
+	MaxUDPSize uint16
+
+	// Identify enables answering CHAOS class TXT queries for version.bind,
+	// hostname.bind and id.server, which identify the server.
+	Identify bool
+
+	// Wildcard enables resolving any name below a peer's name to the peer, for
+	// peers which host several virtual hosts.
+	Wildcard bool
+
+	// Locations maps Tailscale ACL tags to the locations for which LOC records
+	// are served at tagged peers' names.
+	Locations map[string]Location
+
+	// Services maps ports advertised by peers, in the form "80/tcp", to the
+	// names of the services for which SRV records are served.
+	Services map[string]string
+
+	// TaggedServices are services for which SRV records are served in the
+	// zones of peers carrying a tag, such as _ldap._tcp.corp.example.com.
+	TaggedServices []TaggedService
+
+	// NSNames maps served zones to the names of self as their nameserver,
+	// which are relative to the zone unless fully qualified. The name for the
+	// empty zone applies to zones without their own. Defaults to "ns".
+	NSNames map[string]string
+
+	// NameserverTag is the Tailscale ACL tag of peers which are listed as
+	// nameservers of the served zones, in addition to self.
+	NameserverTag string
+
+	// UpdateTag is the Tailscale ACL tag which nodes must carry for their
+	// dynamic updates to be accepted. Dynamic updates are refused if empty.
+	UpdateTag string
+
+	// ACME enables dynamic updates of the TXT records for ACME DNS-01
+	// challenges, at _acme-challenge.<name>, by the peer which name belongs to.
+	ACME bool
+
+	// UpdateFile in which records added by dynamic updates are persisted.
+	UpdateFile string
+
+	// Notify holds the addresses of secondary servers which are sent NOTIFY
+	// messages when the served records change.
+	Notify []string
+
+	// ZonesFile is the path of a JSON file mapping tags to zones and filtering
+	// peers, alongside the options of the Corefile. CoreDNS is restarted to
+	// apply it whenever it changes, or on SIGHUP.
+	ZonesFile string
+
+	// PolicyFile is the path of a tailnet policy file whose tags are mapped to
+	// zones by dns-zone annotations in its comments.
+	PolicyFile string
+
+	// PolicyTailnet and PolicyAPIKey, when set, are used to fetch the tailnet
+	// policy file from the Tailscale API instead.
+	PolicyTailnet string
+	PolicyAPIKey  string
+
+	// PolicyHeadscaleKey, when set, is the API key with which the policy is
+	// fetched from the Headscale server at the APIURL instead.
+	PolicyHeadscaleKey string
+
+	// APIURL is the base URL of the control plane API, such as that of a
+	// Headscale server, in place of the Tailscale API.
+	APIURL string
+
+	// PolicyOAuthClientID and PolicyOAuthSecret, when set, are the OAuth
+	// client credentials exchanged for access tokens to the Tailscale API, in
+	// place of the PolicyAPIKey. The tokens are limited to the
+	// PolicyOAuthScopes, if any.
+	PolicyOAuthClientID string
+	PolicyOAuthSecret   string
+	PolicyOAuthScopes   []string
+
+	// HostsFile is the path of a hosts-format file whose entries are served
+	// alongside the records of peers, reread whenever it changes.
+	HostsFile string
+
+	// ZoneFiles maps served zones to the paths of zone files whose records
+	// are served in them, reread whenever they change.
+	ZoneFiles map[string]string
+
+	// Records are static records served in addition to those assembled for
+	// peers.
+	Records []dns.RR
+
+	// ExportDir is the directory to which served zones are exported as zone
+	// files when they change, so that they can be signed outside of this
+	// plugin. Signed zone files found there are served in their place.
+	ExportDir string
+
+	// ExportCommand is run for each exported zone, with the zone name and the
+	// path to the zone file appended to its arguments.
+	ExportCommand []string
+
+	// KeyFiles are the base names of the DNSSEC key pairs with which answers
+	// are signed, as written by dnssec-keygen.
+	KeyFiles []string
+
 	fastZoneLookup map[string]bool
+
+	// keys with which answers are signed, keyed by the zone they sign.
+	keys map[string][]*signingKey
+
+	// rawRecords hold the text of static records until the whole block has
+	// been parsed, so that they can inherit the configured TTL.
+	rawRecords []string
+
+	// zonesFromMod is the modification time of the ZonesFile when last seen.
+	zonesFromMod time.Time
+}
+
+// AnswerMode determines how queries for peers' addresses are answered.
+type AnswerMode string
+
+const (
+	// AnswerCNAME answers with a CNAME to the peer's MagicDNS name, followed by
+	// the peer's addresses. This is the default.
+	AnswerCNAME AnswerMode = "cname"
+
+	// AnswerFlatten answers with the peer's addresses owned by the qname, so
+	// that the MagicDNS name does not appear in answers.
+	AnswerFlatten AnswerMode = "flatten"
+
+	// AnswerZone answers with a CNAME to the peer's name in the DefaultZone,
+	// followed by the peer's addresses owned by that name, so that the
+	// MagicDNS name does not appear in answers.
+	AnswerZone AnswerMode = "zone"
+)
+
+// TSNet configures an embedded Tailscale node.
+type TSNet struct {
+	// Hostname of the node on the tailnet.
+	Hostname string
+
+	// StateDir in which the node keeps its state, or tsnet's default if empty.
+	StateDir string
+
+	// AuthKeyFile from which the auth key with which the node joins the
+	// tailnet is read. It is taken from TS_AUTHKEY if empty.
+	AuthKeyFile string
+
+	// Ephemeral nodes are removed from the tailnet once they go offline.
+	Ephemeral bool
+
+	// ControlURL of the coordination server, such as a Headscale server's,
+	// or Tailscale's if empty.
+	ControlURL string
+
+	// Listen holds the addresses on the tailnet at which queries are served
+	// over UDP and TCP, such as :53.
+	Listen []string
+}
+
+// defaultTSNetHostname is the host name of an embedded node if none is
+// configured.
+const defaultTSNetHostname = "coredns"
+
+// LabelSource determines where the host names of peers are taken from.
+type LabelSource string
+
+const (
+	// LabelDNSName takes host names from the first label of peers' MagicDNS
+	// names. This is the default.
+	LabelDNSName LabelSource = "dnsname"
+
+	// LabelHostName takes host names from the host names reported by peers'
+	// operating systems, as tailscaled does when it assigns MagicDNS names.
+	LabelHostName LabelSource = "hostname"
+)
+
+// SharedPeers determines how peers of other tailnets are served.
+type SharedPeers string
+
+const (
+	// SharedInclude serves peers of other tailnets like any other peer. This
+	// is the default.
+	SharedInclude SharedPeers = "include"
+
+	// SharedExclude omits peers of other tailnets from all zones.
+	SharedExclude SharedPeers = "exclude"
+
+	// SharedOwnZone serves peers of other tailnets only in a zone of their
+	// own, under their host names.
+	SharedOwnZone SharedPeers = "zone"
+)
+
+// Normalization of the host names of peers, for those whose machine names
+// produce labels which some resolvers refuse. Labels are always lowercased.
+type Normalization struct {
+	// Punycode converts Unicode labels to punycode, per RFC 3492.
+	Punycode bool
+
+	// Strip removes characters other than letters, digits and hyphens, and
+	// leading and trailing hyphens. Unicode letters and digits are kept for
+	// conversion to punycode, if enabled.
+	Strip bool
+}
+
+// AddressFamily limits the address records served in a zone.
+type AddressFamily string
+
+const (
+	// FamilyIPv4Only serves only A records, suppressing AAAA records.
+	FamilyIPv4Only AddressFamily = "ipv4-only"
+
+	// FamilyIPv6Only serves only AAAA records, suppressing A records.
+	FamilyIPv6Only AddressFamily = "ipv6-only"
+)
+
+// OrderMode determines the order of address records in answers.
+type OrderMode string
+
+const (
+	// OrderRoundRobin rotates address records by one with each answer, so that
+	// clients which use the first record spread their load.
+	OrderRoundRobin OrderMode = "round-robin"
+
+	// OrderSorted sorts address records, so that answers are stable across
+	// queries and reloads.
+	OrderSorted OrderMode = "sorted"
+)
+
+// SerialMode determines how the serials of zones change.
+type SerialMode string
+
+const (
+	// SerialHash sets serials to a hash of the time of the change. This is the
+	// default. Serials are not monotonic.
+	SerialHash SerialMode = "hash"
+
+	// SerialIncrement increments serials on each change.
+	SerialIncrement SerialMode = "increment"
+
+	// SerialDate sets serials to the date of the change in the YYYYMMDDnn
+	// form, incrementing nn for further changes that day.
+	SerialDate SerialMode = "date"
+
+	// SerialUnix sets serials to the Unix time of the change, incrementing
+	// them for further changes within the same second.
+	SerialUnix SerialMode = "unix"
+)
+
+// TaggedService is a service offered by each peer carrying a tag, regardless
+// of the ports the peer advertises.
+type TaggedService struct {
+	// Tag carried by the peers offering the service.
+	Tag string
+
+	// Name and Proto of the service, which name the SRV records.
+	Name, Proto string
+
+	// Port on which the service is offered.
+	Port uint16
+}
+
+// SOATimers are the timers published in SOA records, which tell secondaries
+// how to keep their copies of a zone current, and resolvers how long to cache
+// negative answers.
+type SOATimers struct {
+	Refresh, Retry, Expire, Minimum time.Duration
 }
 
-// setup the coredns tailscale plugin.
+// Location of a peer on the globe.
+type Location struct {
+	// Latitude and Longitude in decimal degrees.
+	Latitude, Longitude float64
+
+	// Altitude in meters.
+	Altitude float64
+}
+
+// setup the coredns tailscale plugin. Server blocks configuring the plugin
+// identically share a single instance, which polls for changes to peers once
+// for all of them.
 func setup(c *caddy.Controller) error {
-	ts := Tailscale{
-		client: &tailscale.LocalClient{}, // zero value is usable.
+	var config Config
+	if err := parse(c, &config); err != nil {
+		return plugin.Error(name, err)
 	}
-	if err := parse(c, &ts.Config); err != nil {
+	sc := dnsserver.GetConfig(c)
+	unrouted, err := checkBlock(&config, c.ServerBlockKeys, !slices.Equal(sc.ListenHosts, []string{""}))
+	if err != nil {
+		return plugin.Error(name, c.Err(err.Error()))
+	}
+	for _, zone := range unrouted {
+		log.Warningf("Zone %q is not within the zones of the server block, so will not be queried", zone)
+	}
+	if config.ZonesFile != "" {
+		registerStartupHook()
+	}
+	in, err := share(&config, func() (*Tailscale, error) {
+		ts := &Tailscale{Config: config}
+		if !ts.NoMetrics {
+			m, err := newMetrics(ts.MetricsNamespace)
+			if err != nil {
+				return nil, err
+			}
+			ts.metrics = m
+		}
+		if ts.TSNet != nil {
+			node, err := newNode(ts.TSNet)
+			if err != nil {
+				return nil, err
+			}
+			ts.client, ts.node = node, node
+			return ts, nil
+		}
+		// The zero value LocalClient finds tailscaled on its own. A configured
+		// socket is the only one tried.
+		ts.client = &localClient{tailscale.LocalClient{
+			Socket:        ts.Socket,
+			UseSocketOnly: ts.Socket != "",
+		}}
+		return ts, nil
+	})
+	if err != nil {
 		return plugin.Error(name, err)
 	}
 
+	if config.BindTailnet {
+		hosts, err := tailnetHosts(in.ts.client, config.timeout())
+		if err != nil {
+			return plugin.Error(name, c.Errf("failed looking up the addresses to bind to: %v", err))
+		}
+		sc.ListenHosts = hosts
+	}
+
 	// Configure the Tailscale plugin to start polling the local API for updates
 	// when the server starts...
 	c.OnStartup(func() error {
-		ts.Startup()
-		return nil
+		return in.acquire()
 	})
 
 	// ... and to stop polling when the server shuts down.
 	c.OnShutdown(func() error {
-		ts.Shutdown()
+		in.release()
 		return nil
 	})
 
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		ts.Next = next
-		return &ts
+	sc.AddPlugin(func(next plugin.Handler) plugin.Handler {
+		b := &block{Tailscale: in.ts, next: next}
+		in.serve(b)
+		return b
 	})
 	return nil
 }
 
+// tailnetHosts returns the Tailscale addresses of the node running this plugin,
+// at which its server block listens with bind-tailnet.
+func tailnetHosts(client clientish, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	status, err := client.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status.Self == nil || len(status.Self.TailscaleIPs) == 0 {
+		return nil, errors.New("no Tailscale addresses; is it logged in?")
+	}
+	var hosts []string
+	for _, addr := range status.Self.TailscaleIPs {
+		hosts = append(hosts, addr.String())
+	}
+	return hosts, nil
+}
+
+// checkBlock checks config against the server block it is given in, with keys,
+// whose addresses are set by the bind plugin if bound. It returns the zones
+// served by config which queries will never be routed to.
+func checkBlock(config *Config, keys []string, bound bool) ([]string, error) {
+	if config.BindTailnet && bound {
+		return nil, errors.New("bind-tailnet can't be used with the bind plugin")
+	}
+	// CoreDNS routes queries to server blocks by their keys, so served zones
+	// outside of them are never asked about. They can't be registered from
+	// here: dnsserver only builds a config for each key of a block before
+	// plugins are set up, and a config for any other zone would lack the
+	// block's plugins, so the keys must cover them.
+	return unrouted(config, plugin.OriginsFromArgsOrServerBlock(nil, keys)), nil
+}
+
+// unrouted returns the zones served by config which are not within any of the
+// origins of its server block.
+func unrouted(config *Config, origins []string) []string {
+	var zones []string
+	for _, zone := range config.zones() {
+		if plugin.Zones(origins).Matches(zone) == "" {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
 var defaultReloadInterval = time.Minute * 5
 
+// metricNamespace matches valid Prometheus metric namespaces.
+var metricNamespace = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// defaultTimeout bounds calls to the Tailscale Local API if no timeout is
+// configured.
+const defaultTimeout = 5 * time.Second
+
+// defaultNameTagPrefix is the prefix of ACL tags which override the host names
+// of peers, if name tags are enabled without a prefix.
+const defaultNameTagPrefix = "dns-name-"
+
+// defaultAliasTagPrefix is the prefix of ACL tags which give additional host
+// names to peers, if alias tags are enabled without a prefix.
+const defaultAliasTagPrefix = "dns-alias-"
+
 func buildFastZoneLookup(config *Config) {
 	fzl := make(map[string]bool)
 	fzl[config.DefaultZone] = true
+	for _, zn := range config.ExtraZones {
+		fzl[zn] = true
+	}
 	for _, zn := range config.Zones {
 		fzl[zn] = true
 	}
+	for _, zn := range config.Users {
+		fzl[zn] = true
+	}
+	for _, zn := range config.OSZones {
+		fzl[zn] = true
+	}
+	for _, zn := range config.Capabilities {
+		fzl[zn] = true
+	}
+	if config.FunnelZone != "" {
+		fzl[config.FunnelZone] = true
+	}
+	if config.OwnerZone != "" {
+		fzl[config.OwnerZone] = true
+	}
+	if config.SharedZone != "" {
+		fzl[config.SharedZone] = true
+	}
+	if config.PersonalZone != "" {
+		fzl[config.PersonalZone] = true
+	}
+	if config.Reverse {
+		fzl[reverseZoneV4] = true
+		fzl[reverseZoneV6] = true
+	}
 	config.fastZoneLookup = fzl
 }
 
+// parse the configuration of the plugin from c into config, reading any tailnet
+// policy file it configures, from disk or from the API holding it.
 func parse(c *caddy.Controller, config *Config) error {
+	return parseWith(c, config, readPolicy)
+}
+
+// parseWith parses the configuration of the plugin from c into config, reading
+// any tailnet policy file it configures with policy. Tag zones are not taken
+// from the policy if policy returns no document.
+func parseWith(c *caddy.Controller, config *Config, policy func(*Config) ([]byte, error)) error {
 	if !c.Next() {
 		return c.ArgErr()
 	}
@@ -86,12 +808,26 @@ func parse(c *caddy.Controller, config *Config) error {
 	}
 
 	// Second is the default zone name.
-	c.Next()
-	dz := c.Val()
-	if dz == "{" {
+	if !c.NextArg() || c.Val() == "{" {
 		return c.Err("default zone is required")
 	}
-	config.DefaultZone = c.Val()
+	dz, err := parseZoneName(c.Val())
+	if err != nil {
+		return c.Errf("invalid default zone: %v", err)
+	}
+	config.DefaultZone = dz
+
+	// Any further arguments are additional default zones.
+	for _, arg := range c.RemainingArgs() {
+		ez, err := parseZoneName(arg)
+		if err != nil {
+			return c.Errf("invalid default zone: %v", err)
+		}
+		if slices.Contains(config.defaultZones(), ez) {
+			return c.Errf("default zone %q is repeated", ez)
+		}
+		config.ExtraZones = append(config.ExtraZones, ez)
+	}
 
 	// Parse the optional settings.
 	for c.NextBlock() {
@@ -100,50 +836,1831 @@ func parse(c *caddy.Controller, config *Config) error {
 		}
 	}
 
+	// The policy is read once the whole block has been parsed, so that the API
+	// it is fetched from may be configured after it.
+	if config.PolicyHeadscaleKey != "" && config.APIURL == "" {
+		return c.Err("acl-policy headscale requires api-url")
+	}
+	if config.policySource() {
+		doc, err := policy(config)
+		if err != nil {
+			return c.Errf("failed reading acl-policy: %v", err)
+		}
+		if doc != nil {
+			if err := applyPolicy(config, doc); err != nil {
+				return c.Errf("invalid acl-policy: %v", err)
+			}
+		}
+	}
+
 	// Set default reload interval if none was provided in the Corefile.
 	if config.ReloadInterval == 0 {
 		config.ReloadInterval = defaultReloadInterval
 	}
+	if config.MaxStale != 0 && config.MaxStale <= config.ReloadInterval {
+		return c.Errf("max-stale must exceed the refresh interval of %v", config.ReloadInterval)
+	}
+
+	if config.NameTagPrefix != "" && config.NameTagPrefix == config.AliasTagPrefix {
+		return c.Err("name-tag and alias-tag prefixes must differ")
+	}
+
+	if config.NoAuthority {
+		switch {
+		case config.Authority:
+			return c.Err("authority can't be used with no-authority")
+		case config.NameserverTag != "":
+			return c.Err("nameserver can't be used with no-authority")
+		case len(config.KeyFiles) > 0:
+			return c.Err("dnssec can't be used with no-authority")
+		case len(config.Notify) > 0:
+			return c.Err("notify can't be used with no-authority")
+		case config.UpdateTag != "":
+			return c.Err("update can't be used with no-authority")
+		}
+	}
+
+	if config.NoMetrics && config.MetricsNamespace != "" {
+		return c.Err("metric-namespace can't be used with prometheus off")
+	}
+
+	if config.TSNet != nil && config.Socket != "" {
+		return c.Err("socket can't be used with tsnet")
+	}
+	if config.TSNet != nil && config.BindTailnet {
+		return c.Err("bind-tailnet can't be used with tsnet, whose listen addresses are on the tailnet already")
+	}
+
+	if config.NegativeTTL != 0 && config.SOA.Minimum != 0 {
+		return c.Err("negative-ttl and the soa minimum are the same; specify only one")
+	}
+	for zone, timers := range config.ZoneSOA {
+		if config.NegativeTTL != 0 && timers.Minimum != 0 {
+			return c.Errf("negative-ttl and the soa minimum of zone %q are the same; specify only one", zone)
+		}
+	}
 
 	// An optimization for faster determinations of zones handled by this
 	// server.
 	buildFastZoneLookup(config)
-	return nil
-}
 
-func parseBlock(c *caddy.Controller, config *Config) error {
-	switch tok := c.Val(); tok {
-	case "reload":
-		if !c.NextArg() {
-			return c.ArgErr()
+	// Served zones may be nested, with each name belonging to the most
+	// specific zone containing it. Names formed for peers must not fall into a
+	// zone nested within the one they were formed for, here or in templates.
+	for tag, label := range config.Labels {
+		for _, dz := range config.defaultZones() {
+			if zone := config.zoneOf("host." + label + "." + dz); zone != dz {
+				return c.Errf("label %q of tag %q falls within the nested zone %q", label, tag, zone)
+			}
 		}
-		if config.ReloadInterval != 0 {
-			return c.Err("reload already specified")
+	}
+
+	for zone := range config.Mailboxes {
+		if zone != "" && !config.fastZoneLookup[zone] {
+			return c.Errf("soa-mailbox zone %q is not served", zone)
 		}
-		reload, err := time.ParseDuration(c.Val())
-		if err != nil {
-			return c.Errf("invalid reload interval: %v", err)
+	}
+	for zone := range config.Families {
+		if zone != "" && !config.fastZoneLookup[zone] {
+			return c.Errf("address family zone %q is not served", zone)
 		}
-		config.ReloadInterval = reload
+	}
+	for zone := range config.NSNames {
+		if zone != "" && !config.fastZoneLookup[zone] {
+			return c.Errf("ns-name zone %q is not served", zone)
+		}
+	}
 
-	case "tag":
-		if !c.NextArg() {
-			return c.ArgErr()
+	for zone := range config.Types {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("types zone %q is not served", zone)
 		}
-		tag := c.Val()
-		if !c.NextArg() {
-			return c.ArgErr()
+	}
+	for zone := range config.ZoneAnswers {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("answer zone %q is not served", zone)
 		}
-		if config.Zones == nil {
-			config.Zones = make(map[string]string)
+	}
+	for zone := range config.ZoneSOA {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("soa zone %q is not served", zone)
 		}
-		if prev, has := config.Zones[tag]; has {
-			return c.Errf("tag %q already configured; previous value was %q", tag, prev)
+	}
+	for zone, tmpl := range config.Templates {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("template zone %q is not served", zone)
+		}
+		if nested := config.zoneOf(config.hostName("host", "tag", zone)); nested != zone {
+			return c.Errf("template for zone %q forms names within the nested zone %q", zone, nested)
+		}
+		if slices.Contains(config.defaultZones(), zone) && strings.Contains(tmpl, "{tag}") {
+			return c.Errf("template for default zone %q can't include {tag}", zone)
+		}
+		for login, uz := range config.Users {
+			if uz == zone && strings.Contains(tmpl, "{tag}") {
+				return c.Errf("template for zone %q of user %q can't include {tag}", zone, login)
+			}
 		}
-		config.Zones[tag] = c.Val()
+		for os, oz := range config.OSZones {
+			if oz == zone && strings.Contains(tmpl, "{tag}") {
+				return c.Errf("template for zone %q of os %q can't include {tag}", zone, os)
+			}
+		}
+		for cap, cz := range config.Capabilities {
+			if cz == zone && strings.Contains(tmpl, "{tag}") {
+				return c.Errf("template for zone %q of capability %q can't include {tag}", zone, cap)
+			}
+		}
+		if zone == config.SharedZone && strings.Contains(tmpl, "{tag}") {
+			return c.Errf("template for shared zone %q can't include {tag}", zone)
+		}
+		if zone == config.FunnelZone && strings.Contains(tmpl, "{tag}") {
+			return c.Errf("template for funnel zone %q can't include {tag}", zone)
+		}
+		if zone == config.PersonalZone && strings.Contains(tmpl, "{tag}") {
+			return c.Errf("template for personal zone %q can't include {tag}", zone)
+		}
+	}
 
-	default:
-		return c.Errf("unknown option %q", tok)
+	if config.ExcludeSelf && len(config.SelfZones) > 0 {
+		return c.Err("exclude-self and self-zones can't both be specified")
+	}
+	for zone := range config.SelfZones {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("self-zones zone %q is not served", zone)
+		}
+	}
+
+	for zone := range config.ZoneFiles {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("import-zonefile zone %q is not served", zone)
+		}
+	}
+
+	for zone := range config.ANAMEs {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("aname zone %q is not served", zone)
+		}
+	}
+
+	for tag, zone := range config.Apex {
+		if !config.fastZoneLookup[zone] {
+			return c.Errf("apex zone %q for tag %q is not served", zone, tag)
+		}
+	}
+
+	if err := loadKeys(config); err != nil {
+		return c.Err(err.Error())
+	}
+
+	// Static records can only be parsed once the defaults and zones are known.
+	if err := parseRecords(config); err != nil {
+		return c.Err(err.Error())
+	}
+	return nil
+}
+
+// parseRecords parses the text of static records. Names are relative to the
+// default zone, and the TTL defaults to that of other records.
+func parseRecords(config *Config) error {
+	for _, raw := range config.rawRecords {
+		zp := dns.NewZoneParser(strings.NewReader(raw), config.DefaultZone, "")
+		zp.SetDefaultTTL(config.ttl())
+		rr, ok := zp.Next()
+		if !ok {
+			if err := zp.Err(); err != nil {
+				return fmt.Errorf("invalid record %q: %v", raw, err)
+			}
+			return fmt.Errorf("invalid record %q", raw)
+		}
+		switch rt := rr.Header().Rrtype; rt {
+		case dns.TypeSOA, dns.TypeNS:
+			return fmt.Errorf("invalid record %q: %s records are synthesized", raw, dns.TypeToString[rt])
+		}
+		if config.zoneOf(rr.Header().Name) == "" {
+			return fmt.Errorf("invalid record %q: not in a served zone", raw)
+		}
+		if rr.Header().Rrtype == dns.TypeCNAME && config.fastZoneLookup[dns.CanonicalName(rr.Header().Name)] {
+			return fmt.Errorf("invalid record %q: a CNAME can't be at the apex of a served zone", raw)
+		}
+		config.Records = append(config.Records, rr)
+	}
+	config.rawRecords = nil
+	return nil
+}
+
+func parseBlock(c *caddy.Controller, config *Config) error {
+	switch tok := c.Val(); tok {
+	case "reload":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.ReloadInterval != 0 {
+			return c.Err("reload already specified")
+		}
+		reload, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid reload interval: %v", err)
+		}
+		config.ReloadInterval = reload
+
+	case "ttl":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.TTL != 0 {
+			return c.Err("ttl already specified")
+		}
+		ttl, err := time.ParseDuration(c.Val())
+		if err != nil || ttl < time.Second {
+			return c.Errf("invalid ttl %q", c.Val())
+		}
+		config.TTL = ttl
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "max-stale":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.MaxStale != 0 {
+			return c.Err("max-stale already specified")
+		}
+		ms, err := time.ParseDuration(c.Val())
+		if err != nil || ms <= 0 {
+			return c.Errf("invalid max-stale %q", c.Val())
+		}
+		config.MaxStale = ms
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "hosts":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.HostsFile != "" {
+			return c.Err("hosts already specified")
+		}
+		config.HostsFile = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "zones-from":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.ZonesFile != "" {
+			return c.Err("zones-from already specified")
+		}
+		config.ZonesFile = c.Val()
+		zf, mod, err := readZonesFrom(config.ZonesFile)
+		if err != nil {
+			return c.Errf("failed reading zones-from file %q: %v", config.ZonesFile, err)
+		}
+		if err := zf.apply(config); err != nil {
+			return c.Errf("invalid zones-from file %q: %v", config.ZonesFile, err)
+		}
+		config.zonesFromMod = mod
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "api-url":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.APIURL != "" {
+			return c.Err("api-url already specified")
+		}
+		u, err := url.Parse(c.Val())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c.Errf("invalid api-url %q", c.Val())
+		}
+		config.APIURL = strings.TrimSuffix(c.Val(), "/")
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "acl-policy":
+		args := c.RemainingArgs()
+		if config.policySource() {
+			return c.Err("acl-policy already specified")
+		}
+		switch {
+		case len(args) == 1:
+			config.PolicyFile = args[0]
+		case len(args) == 3 && args[0] == "api":
+			config.PolicyTailnet = args[1]
+			config.PolicyAPIKey = args[2]
+		case len(args) >= 4 && args[0] == "oauth":
+			config.PolicyTailnet = args[1]
+			config.PolicyOAuthClientID = args[2]
+			config.PolicyOAuthSecret = args[3]
+			if len(args) > 4 {
+				config.PolicyOAuthScopes = args[4:]
+			}
+		case len(args) == 2 && args[0] == "headscale":
+			config.PolicyHeadscaleKey = args[1]
+		default:
+			return c.ArgErr()
+		}
+
+	case "import-zonefile":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		zone, err := parseZoneName(args[0])
+		if err != nil {
+			return c.Errf("invalid import-zonefile zone: %v", err)
+		}
+		if config.ZoneFiles == nil {
+			config.ZoneFiles = make(map[string]string)
+		}
+		if prev, has := config.ZoneFiles[zone]; has {
+			return c.Errf("zone file for %q already imported; previous value was %q", zone, prev)
+		}
+		config.ZoneFiles[zone] = args[1]
+
+	case "upstream":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Upstream != "" {
+			return c.Err("upstream already specified")
+		}
+		addr, err := parseNotify(c.Val())
+		if err != nil {
+			return c.Errf("invalid upstream address: %v", err)
+		}
+		config.Upstream = addr
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "prometheus":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			config.NoMetrics = false
+		case "off":
+			config.NoMetrics = true
+		default:
+			return c.Errf("invalid prometheus setting %q; expected on or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "watch":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			config.NoWatch = false
+		case "off":
+			config.NoWatch = true
+		default:
+			return c.Errf("invalid watch setting %q; expected on or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "metric-namespace":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.MetricsNamespace != "" {
+			return c.Err("metric-namespace already specified")
+		}
+		if !metricNamespace.MatchString(c.Val()) {
+			return c.Errf("invalid metric-namespace %q", c.Val())
+		}
+		config.MetricsNamespace = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "socket":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Socket != "" {
+			return c.Err("socket already specified")
+		}
+		config.Socket = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "require-identity":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.RequireIdentity {
+			return c.Err("require-identity already specified")
+		}
+		config.RequireIdentity = true
+
+	case "bind-tailnet":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.BindTailnet {
+			return c.Err("bind-tailnet already specified")
+		}
+		config.BindTailnet = true
+
+	case "tsnet":
+		if err := parseTSNet(c, config); err != nil {
+			return err
+		}
+
+	case "ephemeral-ttl":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		if config.EphemeralTTL != 0 {
+			return c.Err("ephemeral-ttl already specified")
+		}
+		ttl, err := time.ParseDuration(args[0])
+		if err != nil || ttl < time.Second {
+			return c.Errf("invalid ephemeral-ttl %q", args[0])
+		}
+		config.EphemeralTTL = ttl
+		config.EphemeralTags = make(map[string]bool)
+		for _, tag := range args[1:] {
+			config.EphemeralTags[strings.TrimPrefix(tag, "tag:")] = true
+		}
+
+	case "timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Timeout != 0 {
+			return c.Err("timeout already specified")
+		}
+		timeout, err := time.ParseDuration(c.Val())
+		if err != nil || timeout <= 0 {
+			return c.Errf("invalid timeout %q", c.Val())
+		}
+		config.Timeout = timeout
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "soa":
+		args := c.RemainingArgs()
+		if len(args) != 4 {
+			return c.ArgErr()
+		}
+		if config.SOA != (SOATimers{}) {
+			return c.Err("soa already specified")
+		}
+		timers, err := parseSOATimers(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		config.SOA = timers
+
+	case "negative-ttl":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.NegativeTTL != 0 {
+			return c.Err("negative-ttl already specified")
+		}
+		ttl, err := time.ParseDuration(c.Val())
+		if err != nil || ttl < time.Second {
+			return c.Errf("invalid negative-ttl %q", c.Val())
+		}
+		config.NegativeTTL = ttl
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "soa-mailbox":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		mbox, err := parseMailbox(args[0])
+		if err != nil {
+			return c.Errf("invalid soa-mailbox: %v", err)
+		}
+		zones := args[1:]
+		if len(zones) == 0 {
+			zones = []string{""}
+		}
+		if config.Mailboxes == nil {
+			config.Mailboxes = make(map[string]string)
+		}
+		for _, zone := range zones {
+			zone = dns.CanonicalName(zone)
+			if zone == "." {
+				zone = ""
+			}
+			if prev, has := config.Mailboxes[zone]; has {
+				return c.Errf("soa-mailbox for %q already configured; previous value was %q", zone, prev)
+			}
+			config.Mailboxes[zone] = mbox
+		}
+
+	case "ipv4-only", "ipv6-only":
+		zones := c.RemainingArgs()
+		if len(zones) == 0 {
+			zones = []string{""}
+		}
+		if config.Families == nil {
+			config.Families = make(map[string]AddressFamily)
+		}
+		for _, zone := range zones {
+			if zone != "" {
+				zone = dns.CanonicalName(zone)
+			}
+			if prev, has := config.Families[zone]; has {
+				return c.Errf("address family for %q already configured; previous value was %q", zone, prev)
+			}
+			config.Families[zone] = AddressFamily(tok)
+		}
+
+	case "serial":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		if config.Serial != "" {
+			return c.Err("serial already specified")
+		}
+		switch mode := SerialMode(args[0]); mode {
+		case SerialHash, SerialIncrement, SerialDate, SerialUnix:
+			config.Serial = mode
+		default:
+			return c.Errf("unknown serial mode %q", mode)
+		}
+		if len(args) > 1 {
+			if config.Serial == SerialHash {
+				return c.Errf("serial mode %q can't be persisted", config.Serial)
+			}
+			config.SerialFile = args[1]
+		}
+
+	case "answer":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Answer != "" {
+			return c.Err("answer already specified")
+		}
+		switch mode := AnswerMode(c.Val()); mode {
+		case AnswerCNAME, AnswerFlatten, AnswerZone:
+			config.Answer = mode
+		default:
+			return c.Errf("unknown answer mode %q", mode)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "dns64":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		if config.DNS64.IsValid() {
+			return c.Err("dns64 already specified")
+		}
+		config.DNS64 = wellKnownPrefix
+		if len(args) > 0 {
+			prefix, err := parseDNS64(args[0])
+			if err != nil {
+				return c.Errf("invalid dns64 prefix: %v", err)
+			}
+			config.DNS64 = prefix
+		}
+
+	case "order":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Order != "" {
+			return c.Err("order already specified")
+		}
+		switch mode := OrderMode(c.Val()); mode {
+		case OrderRoundRobin, OrderSorted:
+			config.Order = mode
+		default:
+			return c.Errf("unknown order %q", mode)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "reverse":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Reverse {
+			return c.Err("reverse already specified")
+		}
+		config.Reverse = true
+
+	case "metadata":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Metadata {
+			return c.Err("metadata already specified")
+		}
+		config.Metadata = true
+
+	case "hinfo":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.HINFO {
+			return c.Err("hinfo already specified")
+		}
+		config.HINFO = true
+
+	case "posture":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Posture {
+			return c.Err("posture already specified")
+		}
+		config.Posture = true
+
+	case "vip-services":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.VIPServices {
+			return c.Err("vip-services already specified")
+		}
+		config.VIPServices = true
+
+	case "normalize":
+		args := c.RemainingArgs()
+		if config.Normalize != (Normalization{}) {
+			return c.Err("normalize already specified")
+		}
+		if len(args) == 0 {
+			args = []string{"punycode", "strip"}
+		}
+		for _, arg := range args {
+			switch arg {
+			case "punycode":
+				config.Normalize.Punycode = true
+			case "strip":
+				config.Normalize.Strip = true
+			default:
+				return c.Errf("unknown normalization %q", arg)
+			}
+		}
+
+	case "label-source":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.LabelSource != "" {
+			return c.Err("label-source already specified")
+		}
+		switch src := LabelSource(c.Val()); src {
+		case LabelDNSName, LabelHostName:
+			config.LabelSource = src
+		case "computed":
+			// The names tailscaled computes for peers with MagicDNS names, the
+			// only ones served, begin with the first labels of those names.
+			return c.Err("label-source computed is the same as dnsname; use that instead")
+		default:
+			return c.Errf("unknown label source %q", src)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "short-names":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.ShortNames {
+			return c.Err("short-names already specified")
+		}
+		config.ShortNames = true
+
+	case "exclude-self":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.ExcludeSelf {
+			return c.Err("exclude-self already specified")
+		}
+		config.ExcludeSelf = true
+
+	case "self-zones":
+		zones := c.RemainingArgs()
+		if len(zones) == 0 {
+			return c.ArgErr()
+		}
+		if len(config.SelfZones) > 0 {
+			return c.Err("self-zones already specified")
+		}
+		config.SelfZones = make(map[string]bool)
+		for _, zone := range zones {
+			config.SelfZones[dns.CanonicalName(zone)] = true
+		}
+
+	case "require-tag":
+		tags := c.RemainingArgs()
+		if len(tags) == 0 {
+			return c.ArgErr()
+		}
+		if config.RequireTags == nil {
+			config.RequireTags = make(map[string]bool)
+		}
+		for _, tag := range tags {
+			config.RequireTags[strings.TrimPrefix(tag, "tag:")] = true
+		}
+
+	case "exclude-tag":
+		tags := c.RemainingArgs()
+		if len(tags) == 0 {
+			return c.ArgErr()
+		}
+		if config.ExcludeTags == nil {
+			config.ExcludeTags = make(map[string]bool)
+		}
+		for _, tag := range tags {
+			config.ExcludeTags[strings.TrimPrefix(tag, "tag:")] = true
+		}
+
+	case "online-only":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.OnlineOnly {
+			return c.Err("online-only already specified")
+		}
+		config.OnlineOnly = true
+
+	case "exclude-expired":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.ExcludeExpired {
+			return c.Err("exclude-expired already specified")
+		}
+		config.ExcludeExpired = true
+
+	case "key-expiry-ttl":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.KeyExpiryTTL {
+			return c.Err("key-expiry-ttl already specified")
+		}
+		config.KeyExpiryTTL = true
+
+	case "shared":
+		if config.Shared != "" {
+			return c.Err("shared already specified")
+		}
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		switch mode := SharedPeers(args[0]); mode {
+		case SharedInclude, SharedExclude:
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			config.Shared = mode
+		case SharedOwnZone:
+			if len(args) != 2 {
+				return c.ArgErr()
+			}
+			zone, err := parseZoneName(args[1])
+			if err != nil {
+				return c.Errf("invalid shared zone: %v", err)
+			}
+			config.Shared, config.SharedZone = mode, zone
+		default:
+			return c.Errf("unknown shared mode %q", mode)
+		}
+
+	case "prune-after":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.PruneAfter != 0 {
+			return c.Err("prune-after already specified")
+		}
+		after, err := time.ParseDuration(c.Val())
+		if err != nil || after <= 0 {
+			return c.Errf("invalid prune-after %q", c.Val())
+		}
+		config.PruneAfter = after
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "include-os", "exclude-os":
+		set, other := &config.IncludeOS, config.ExcludeOS
+		if c.Val() == "exclude-os" {
+			set, other = &config.ExcludeOS, config.IncludeOS
+		}
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if *set == nil {
+			*set = make(map[string]bool)
+		}
+		for _, os := range args {
+			os = osName(os)
+			if other[os] {
+				return c.Errf("os %q both included and excluded", os)
+			}
+			(*set)[os] = true
+		}
+
+	case "name-tag":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		if config.NameTagPrefix != "" {
+			return c.Err("name-tag already specified")
+		}
+		config.NameTagPrefix = defaultNameTagPrefix
+		if len(args) > 0 {
+			config.NameTagPrefix = strings.TrimPrefix(args[0], "tag:")
+		}
+		if config.NameTagPrefix == "" {
+			return c.Err("name-tag prefix can't be empty")
+		}
+
+	case "alias-tag":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		if config.AliasTagPrefix != "" {
+			return c.Err("alias-tag already specified")
+		}
+		config.AliasTagPrefix = defaultAliasTagPrefix
+		if len(args) > 0 {
+			config.AliasTagPrefix = strings.TrimPrefix(args[0], "tag:")
+		}
+		if config.AliasTagPrefix == "" {
+			return c.Err("alias-tag prefix can't be empty")
+		}
+
+	case "tags-txt":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.TagsTXT {
+			return c.Err("tags-txt already specified")
+		}
+		config.TagsTXT = true
+
+	case "node-attrs":
+		attrs := c.RemainingArgs()
+		if len(attrs) == 0 {
+			return c.ArgErr()
+		}
+		if config.NodeAttrs == nil {
+			config.NodeAttrs = make(map[string]bool)
+		}
+		for _, attr := range attrs {
+			config.NodeAttrs[attr] = true
+		}
+
+	case "no-authority":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.NoAuthority {
+			return c.Err("no-authority already specified")
+		}
+		config.NoAuthority = true
+
+	case "authority":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Authority {
+			return c.Err("authority already specified")
+		}
+		config.Authority = true
+
+	case "minimal-responses":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Minimal {
+			return c.Err("minimal-responses already specified")
+		}
+		config.Minimal = true
+
+	case "authoritative":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			config.NoAuthoritative = false
+		case "off":
+			config.NoAuthoritative = true
+		default:
+			return c.Errf("invalid authoritative setting %q; expected on or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "recursion-available":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			config.RecursionAvailable = true
+		case "off":
+			config.RecursionAvailable = false
+		default:
+			return c.Errf("invalid recursion-available setting %q; expected on or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "compress":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			config.NoCompress = false
+		case "off":
+			config.NoCompress = true
+		default:
+			return c.Errf("invalid compress setting %q; expected on or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "max-udp-size":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.MaxUDPSize != 0 {
+			return c.Err("max-udp-size already specified")
+		}
+		size, err := strconv.ParseUint(c.Val(), 10, 16)
+		if err != nil || size < dns.MinMsgSize {
+			return c.Errf("invalid max-udp-size %q; expected %d to %d", c.Val(), dns.MinMsgSize, dns.MaxMsgSize)
+		}
+		config.MaxUDPSize = uint16(size)
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "identify":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.Identify {
+			return c.Err("identify already specified")
+		}
+		config.Identify = true
+
+	case "wildcard":
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+			if config.Wildcard {
+				return c.Err("wildcard already specified")
+			}
+			config.Wildcard = true
+		case 2:
+			// Names below name resolve to target, which is served as a static
+			// wildcard record.
+			name, target := args[0], args[1]
+			config.rawRecords = append(config.rawRecords, fmt.Sprintf("*.%s CNAME %s", name, target))
+		default:
+			return c.ArgErr()
+		}
+
+	case "location":
+		args := c.RemainingArgs()
+		if len(args) != 3 && len(args) != 4 {
+			return c.ArgErr()
+		}
+		tag := args[0]
+		loc, err := parseLocation(args[1:])
+		if err != nil {
+			return c.Errf("invalid location for tag %q: %v", tag, err)
+		}
+		if config.Locations == nil {
+			config.Locations = make(map[string]Location)
+		}
+		if _, has := config.Locations[tag]; has {
+			return c.Errf("location for tag %q already configured", tag)
+		}
+		config.Locations[tag] = loc
+
+	case "record":
+		args := c.RemainingArgs()
+		if len(args) < 3 {
+			return c.ArgErr()
+		}
+		for i, arg := range args {
+			// Restore quoting removed by the Corefile lexer, so that strings such
+			// as TXT data survive intact.
+			if strings.ContainsAny(arg, " \t") {
+				args[i] = strconv.Quote(arg)
+			}
+		}
+		config.rawRecords = append(config.rawRecords, strings.Join(args, " "))
+
+	case "nameserver":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.NameserverTag != "" {
+			return c.Err("nameserver already specified")
+		}
+		config.NameserverTag = strings.TrimPrefix(c.Val(), "tag:")
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "ns-name":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if _, ok := dns.IsDomainName(args[0]); !ok || args[0] == "." {
+			return c.Errf("invalid ns-name %q", args[0])
+		}
+		zones := args[1:]
+		if len(zones) == 0 {
+			zones = []string{""}
+		}
+		if config.NSNames == nil {
+			config.NSNames = make(map[string]string)
+		}
+		for _, zone := range zones {
+			zone = dns.CanonicalName(zone)
+			if zone == "." {
+				zone = ""
+			}
+			if prev, has := config.NSNames[zone]; has {
+				return c.Errf("ns-name for %q already configured; previous value was %q", zone, prev)
+			}
+			config.NSNames[zone] = args[0]
+		}
+
+	case "update":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		if config.UpdateTag != "" {
+			return c.Err("update already specified")
+		}
+		config.UpdateTag = strings.TrimPrefix(args[0], "tag:")
+		if len(args) > 1 {
+			config.UpdateFile = args[1]
+		}
+
+	case "acme":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if config.ACME {
+			return c.Err("acme already specified")
+		}
+		config.ACME = true
+
+	case "notify":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			addr, err := parseNotify(arg)
+			if err != nil {
+				return c.Errf("invalid notify address: %v", err)
+			}
+			config.Notify = append(config.Notify, addr)
+		}
+
+	case "export":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if config.ExportDir != "" {
+			return c.Err("export already specified")
+		}
+		config.ExportDir = args[0]
+		if len(args) > 1 {
+			config.ExportCommand = args[1:]
+		}
+
+	case "dnssec":
+		if len(config.KeyFiles) > 0 {
+			return c.Err("dnssec already specified")
+		}
+		if err := parseDNSSEC(c, config); err != nil {
+			return err
+		}
+
+	case "service":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		svc := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		port, err := parsePort(c.Val())
+		if err != nil {
+			return c.Errf("invalid port for service %q: %v", svc, err)
+		}
+		if c.NextArg() {
+			// Peers carrying the tag offer the service, whether or not they
+			// advertise the port.
+			tagged := TaggedService{Tag: strings.TrimPrefix(c.Val(), "tag:"), Name: svc}
+			if _, err := fmt.Sscanf(port, "%d/%s", &tagged.Port, &tagged.Proto); err != nil {
+				return c.Errf("invalid port for service %q: %v", svc, err)
+			}
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			config.TaggedServices = append(config.TaggedServices, tagged)
+			break
+		}
+		if config.Services == nil {
+			config.Services = make(map[string]string)
+		}
+		if prev, has := config.Services[port]; has {
+			return c.Errf("port %q already configured; previous value was %q", port, prev)
+		}
+		config.Services[port] = svc
+
+	case "apex":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		tag, zone := strings.TrimPrefix(args[0], "tag:"), config.DefaultZone
+		if len(args) > 1 {
+			var err error
+			if zone, err = parseZoneName(args[1]); err != nil {
+				return c.Errf("invalid apex zone: %v", err)
+			}
+		}
+		if config.Apex == nil {
+			config.Apex = make(map[string]string)
+		}
+		if prev, has := config.Apex[tag]; has {
+			return c.Errf("apex tag %q already configured; previous value was %q", tag, prev)
+		}
+		config.Apex[tag] = zone
+
+	case "aname":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		target, zone := dns.CanonicalName(args[0]), config.DefaultZone
+		if len(args) > 1 {
+			zone = dns.CanonicalName(args[1])
+		}
+		if _, ok := dns.IsDomainName(target); !ok || target == zone {
+			return c.Errf("invalid aname target %q for %q", args[0], zone)
+		}
+		if config.ANAMEs == nil {
+			config.ANAMEs = make(map[string]string)
+		}
+		if prev, has := config.ANAMEs[zone]; has {
+			return c.Errf("aname for %q already configured; previous target was %q", zone, prev)
+		}
+		config.ANAMEs[zone] = target
+
+	case "alias":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		alias, host := strings.ToLower(args[0]), strings.ToLower(args[1])
+		for _, l := range []string{alias, host} {
+			if _, ok := dns.IsDomainName(l); !ok || dns.CountLabel(dns.Fqdn(l)) != 1 || dns.IsFqdn(l) {
+				return c.Errf("invalid alias %q for %q; both must be single labels", alias, host)
+			}
+		}
+		if config.Aliases == nil {
+			config.Aliases = make(map[string]string)
+		}
+		if prev, has := config.Aliases[alias]; has {
+			return c.Errf("alias %q already configured; previous value was %q", alias, prev)
+		}
+		config.Aliases[alias] = host
+
+	case "label":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		tag, label := strings.TrimPrefix(args[0], "tag:"), strings.ToLower(args[1])
+		if _, ok := dns.IsDomainName(label); !ok || dns.IsFqdn(label) {
+			return c.Errf("invalid label %q for tag %q; must be relative to the default zone", label, tag)
+		}
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		if prev, has := config.Labels[tag]; has {
+			return c.Errf("label tag %q already configured; previous value was %q", tag, prev)
+		}
+		config.Labels[tag] = label
+
+	case "tag":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		tag := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		zone, err := parseZoneName(c.Val())
+		if err != nil {
+			return c.Errf("invalid zone for tag %q: %v", tag, err)
+		}
+		if config.Zones == nil {
+			config.Zones = make(map[string]string)
+		}
+		if prev, has := config.Zones[tag]; has {
+			return c.Errf("tag %q already configured; previous value was %q", tag, prev)
+		}
+		config.Zones[tag] = zone
+
+	case "user":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		login := strings.ToLower(args[0])
+		zone, err := parseZoneName(args[1])
+		if err != nil {
+			return c.Errf("invalid zone for user %q: %v", login, err)
+		}
+		if config.Users == nil {
+			config.Users = make(map[string]string)
+		}
+		if prev, has := config.Users[login]; has {
+			return c.Errf("user %q already configured; previous value was %q", login, prev)
+		}
+		config.Users[login] = zone
+
+	case "capability":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		cap := args[0]
+		zone, err := parseZoneName(args[1])
+		if err != nil {
+			return c.Errf("invalid zone for capability %q: %v", cap, err)
+		}
+		if config.Capabilities == nil {
+			config.Capabilities = make(map[string]string)
+		}
+		if prev, has := config.Capabilities[cap]; has {
+			return c.Errf("capability %q already configured; previous value was %q", cap, prev)
+		}
+		config.Capabilities[cap] = zone
+
+	case "record-capability":
+		if config.RecordCapability != "" {
+			return c.Err("record-capability already specified")
+		}
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		config.RecordCapability = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "funnel-zone":
+		if config.FunnelZone != "" {
+			return c.Err("funnel-zone already specified")
+		}
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		zone, err := parseZoneName(c.Val())
+		if err != nil {
+			return c.Errf("invalid funnel zone: %v", err)
+		}
+		config.FunnelZone = zone
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "personal-zone":
+		if config.PersonalZone != "" {
+			return c.Err("personal-zone already specified")
+		}
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		zone, err := parseZoneName(c.Val())
+		if err != nil {
+			return c.Errf("invalid personal zone: %v", err)
+		}
+		config.PersonalZone = zone
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "owner-zone":
+		if config.OwnerZone != "" {
+			return c.Err("owner-zone already specified")
+		}
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		zone, err := parseZoneName(c.Val())
+		if err != nil {
+			return c.Errf("invalid owner zone: %v", err)
+		}
+		config.OwnerZone = zone
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "os":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		os := osName(args[0])
+		zone, err := parseZoneName(args[1])
+		if err != nil {
+			return c.Errf("invalid zone for os %q: %v", os, err)
+		}
+		if config.OSZones == nil {
+			config.OSZones = make(map[string]string)
+		}
+		if prev, has := config.OSZones[os]; has {
+			return c.Errf("os %q already configured; previous value was %q", os, prev)
+		}
+		config.OSZones[os] = zone
+
+	case "zone":
+		if err := parseZone(c, config); err != nil {
+			return err
+		}
+
+	default:
+		return c.Errf("unknown option %q", tok)
+	}
+	return nil
+}
+
+// parseZone parses a zone sub-block, which configures the tags placing peers
+// in a zone, as an alternative to repeating the tag option, and how the zone is
+// served:
+//
+//	zone den.corp.example.com. {
+//	  tags campus-den lab-den
+//	  template {host}-{tag}
+//	  types A AAAA TXT
+//	  answer flatten
+//	  ns-name ns1.example.com.
+//	  mailbox hostmaster@example.com
+//	  soa 1h 15m 168h 30s
+//	}
+func parseZone(c *caddy.Controller, config *Config) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	zone, err := parseZoneName(c.Val())
+	if err != nil {
+		return c.Errf("invalid zone: %v", err)
+	}
+	if !c.NextArg() || c.Val() != "{" {
+		return c.Err("zone requires a block")
+	}
+	var configured bool
+	for {
+		if !c.Next() {
+			return c.EOFErr()
+		}
+		tok := c.Val()
+		if tok == "}" {
+			break
+		}
+		switch tok {
+		case "tags":
+			tags := c.RemainingArgs()
+			if len(tags) == 0 {
+				return c.ArgErr()
+			}
+			if config.Zones == nil {
+				config.Zones = make(map[string]string)
+			}
+			for _, tag := range tags {
+				tag = strings.TrimPrefix(tag, "tag:")
+				if prev, has := config.Zones[tag]; has {
+					return c.Errf("tag %q already configured; previous value was %q", tag, prev)
+				}
+				config.Zones[tag] = zone
+			}
+		case "template":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if _, has := config.Templates[zone]; has {
+				return c.Errf("template for zone %q already specified", zone)
+			}
+			if err := checkTemplate(c.Val()); err != nil {
+				return c.Errf("invalid template for zone %q: %v", zone, err)
+			}
+			if config.Templates == nil {
+				config.Templates = make(map[string]string)
+			}
+			config.Templates[zone] = strings.ToLower(c.Val())
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "types":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			if _, has := config.Types[zone]; has {
+				return c.Errf("types for zone %q already specified", zone)
+			}
+			types := make(map[uint16]bool)
+			for _, arg := range args {
+				rt, ok := dns.StringToType[strings.ToUpper(arg)]
+				if !ok {
+					return c.Errf("unknown record type %q", arg)
+				}
+				types[rt] = true
+			}
+			if config.Types == nil {
+				config.Types = make(map[string]map[uint16]bool)
+			}
+			config.Types[zone] = types
+		case "answer":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if _, has := config.ZoneAnswers[zone]; has {
+				return c.Errf("answer for zone %q already specified", zone)
+			}
+			mode := AnswerMode(c.Val())
+			switch mode {
+			case AnswerCNAME, AnswerFlatten, AnswerZone:
+			default:
+				return c.Errf("unknown answer mode %q", mode)
+			}
+			if config.ZoneAnswers == nil {
+				config.ZoneAnswers = make(map[string]AnswerMode)
+			}
+			config.ZoneAnswers[zone] = mode
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "ns-name":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if _, ok := dns.IsDomainName(c.Val()); !ok || c.Val() == "." {
+				return c.Errf("invalid ns-name %q", c.Val())
+			}
+			if prev, has := config.NSNames[zone]; has {
+				return c.Errf("ns-name for %q already configured; previous value was %q", zone, prev)
+			}
+			if config.NSNames == nil {
+				config.NSNames = make(map[string]string)
+			}
+			config.NSNames[zone] = c.Val()
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "mailbox":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			mbox, err := parseMailbox(c.Val())
+			if err != nil {
+				return c.Errf("invalid mailbox: %v", err)
+			}
+			if prev, has := config.Mailboxes[zone]; has {
+				return c.Errf("soa-mailbox for %q already configured; previous value was %q", zone, prev)
+			}
+			if config.Mailboxes == nil {
+				config.Mailboxes = make(map[string]string)
+			}
+			config.Mailboxes[zone] = mbox
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "soa":
+			args := c.RemainingArgs()
+			if len(args) != 4 {
+				return c.ArgErr()
+			}
+			if _, has := config.ZoneSOA[zone]; has {
+				return c.Errf("soa for zone %q already specified", zone)
+			}
+			timers, err := parseSOATimers(args)
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if config.ZoneSOA == nil {
+				config.ZoneSOA = make(map[string]SOATimers)
+			}
+			config.ZoneSOA[zone] = timers
+		default:
+			return c.Errf("unknown zone option %q", tok)
+		}
+		configured = true
+	}
+	if !configured {
+		return c.Errf("zone %q requires at least one option", zone)
+	}
+	return nil
+}
+
+// parseTSNet parses the configuration of an embedded node, with an optional
+// host name and sub-block:
+//
+//	tsnet coredns {
+//	  state-dir /var/lib/coredns/tsnet
+//	  auth-key-file /run/secrets/ts-authkey
+//	  ephemeral
+//	  control-url https://headscale.example.com
+//	  listen :53
+//	}
+func parseTSNet(c *caddy.Controller, config *Config) error {
+	if config.TSNet != nil {
+		return c.Err("tsnet already specified")
+	}
+	config.TSNet = &TSNet{Hostname: defaultTSNetHostname}
+	args := c.RemainingArgs()
+	if len(args) > 1 {
+		return c.ArgErr()
+	}
+	if len(args) == 1 {
+		config.TSNet.Hostname = args[0]
+	}
+	if !c.NextArg() {
+		return nil // without a block.
+	}
+	for {
+		if !c.Next() {
+			return c.EOFErr()
+		}
+		tok := c.Val()
+		if tok == "}" {
+			return nil
+		}
+		switch tok {
+		case "state-dir":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if config.TSNet.StateDir != "" {
+				return c.Err("state-dir already specified")
+			}
+			config.TSNet.StateDir = c.Val()
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "auth-key-file":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if config.TSNet.AuthKeyFile != "" {
+				return c.Err("auth-key-file already specified")
+			}
+			config.TSNet.AuthKeyFile = c.Val()
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "ephemeral":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			config.TSNet.Ephemeral = true
+		case "control-url":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if config.TSNet.ControlURL != "" {
+				return c.Err("control-url already specified")
+			}
+			u, err := url.Parse(c.Val())
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return c.Errf("invalid control-url %q", c.Val())
+			}
+			config.TSNet.ControlURL = c.Val()
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		case "listen":
+			addrs := c.RemainingArgs()
+			if len(addrs) == 0 {
+				return c.ArgErr()
+			}
+			for _, addr := range addrs {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil || port == "" {
+					return c.Errf("invalid tsnet listen address %q", addr)
+				}
+				if host != "" {
+					if _, err := netip.ParseAddr(host); err != nil {
+						return c.Errf("invalid tsnet listen address %q: host must be empty or an IP address", addr)
+					}
+				}
+			}
+			config.TSNet.Listen = append(config.TSNet.Listen, addrs...)
+		default:
+			return c.Errf("unknown tsnet option %q", tok)
+		}
+	}
+}
+
+// parseSOATimers parses the refresh, retry, expire and minimum timers of an SOA
+// record, in that order.
+func parseSOATimers(args []string) (SOATimers, error) {
+	var timers SOATimers
+	fields := []*time.Duration{&timers.Refresh, &timers.Retry, &timers.Expire, &timers.Minimum}
+	for i, arg := range args {
+		d, err := time.ParseDuration(arg)
+		if err != nil || d < time.Second {
+			return SOATimers{}, fmt.Errorf("invalid soa timer %q", arg)
+		}
+		*fields[i] = d
+	}
+	return timers, nil
+}
+
+// checkTemplate checks that a template for the names of peers includes their
+// host name, and forms relative names.
+func checkTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, "{host}") {
+		return errors.New("must include {host}")
+	}
+	name := strings.NewReplacer("{host}", "host", "{tag}", "tag").Replace(tmpl)
+	if _, ok := dns.IsDomainName(name); !ok || dns.IsFqdn(name) || strings.ContainsAny(name, "{}") {
+		return errors.New("must form a name relative to the zone")
+	}
+	return nil
+}
+
+// parseDNSSEC parses the dnssec sub-block, which lists the keys with which
+// answers are signed:
+//
+//	dnssec {
+//	  key file Kcorp.example.com.+013+12345
+//	}
+func parseDNSSEC(c *caddy.Controller, config *Config) error {
+	if !c.NextArg() || c.Val() != "{" {
+		return c.Err("dnssec requires a block")
+	}
+	for {
+		if !c.Next() {
+			return c.EOFErr()
+		}
+		tok := c.Val()
+		if tok == "}" {
+			break
+		}
+		switch tok {
+		case "key":
+			args := c.RemainingArgs()
+			if len(args) < 2 || args[0] != "file" {
+				return c.ArgErr()
+			}
+			config.KeyFiles = append(config.KeyFiles, args[1:]...)
+		default:
+			return c.Errf("unknown dnssec option %q", tok)
+		}
+	}
+	if len(config.KeyFiles) == 0 {
+		return c.Err("dnssec requires at least one key")
 	}
 	return nil
 }
+
+// parseZoneName validates the name of a zone to be served, and returns it in
+// canonical form. The root can't be served, since queries for names outside
+// of the served zones are passed on.
+func parseZoneName(s string) (string, error) {
+	if s == "" {
+		// Most likely an environment variable which is not set.
+		return "", errors.New("empty zone name")
+	}
+	zone := dns.CanonicalName(s)
+	if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+		return "", fmt.Errorf("bad zone name %q", s)
+	}
+	for _, r := range zone {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return "", fmt.Errorf("bad zone name %q: invalid character %q", s, r)
+		}
+	}
+	return zone, nil
+}
+
+// parsePort parses a port specification of the form "80/tcp", with the
+// protocol defaulting to tcp if omitted, and returns it in canonical form.
+func parsePort(spec string) (string, error) {
+	ps, proto, _ := strings.Cut(spec, "/")
+	if proto == "" {
+		proto = "tcp"
+	}
+	if proto != "tcp" && proto != "udp" {
+		return "", fmt.Errorf("unsupported protocol %q", proto)
+	}
+	port, err := strconv.ParseUint(ps, 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("bad port %q", ps)
+	}
+	return fmt.Sprintf("%d/%s", port, proto), nil
+}
+
+// parseDNS64 parses an IPv6 prefix with one of the lengths permitted by RFC
+// 6052 section 2.2.
+func parseDNS64(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return prefix, err
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return prefix, fmt.Errorf("%v is not an IPv6 prefix", prefix)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return prefix, fmt.Errorf("unsupported prefix length %d", prefix.Bits())
+	}
+	return prefix.Masked(), nil
+}
+
+// parseMailbox parses a mailbox, given either as an email address or in domain
+// name form, and returns it in domain name form. Dots in the local part of an
+// email address are escaped, per RFC 1035 section 8.
+func parseMailbox(s string) (string, error) {
+	if local, domain, found := strings.Cut(s, "@"); found {
+		if local == "" || domain == "" {
+			return "", fmt.Errorf("bad email address %q", s)
+		}
+		s = strings.ReplaceAll(local, ".", "\\.") + "." + domain
+	}
+	mbox := dns.CanonicalName(s)
+	if _, ok := dns.IsDomainName(mbox); !ok || mbox == "." {
+		return "", fmt.Errorf("bad mailbox %q", s)
+	}
+	return mbox, nil
+}
+
+// parseLocation parses a latitude and longitude in decimal degrees, followed
+// by an optional altitude in meters.
+func parseLocation(args []string) (Location, error) {
+	var loc Location
+	var err error
+	if loc.Latitude, err = strconv.ParseFloat(args[0], 64); err != nil || loc.Latitude < -90 || loc.Latitude > 90 {
+		return loc, fmt.Errorf("bad latitude %q", args[0])
+	}
+	if loc.Longitude, err = strconv.ParseFloat(args[1], 64); err != nil || loc.Longitude < -180 || loc.Longitude > 180 {
+		return loc, fmt.Errorf("bad longitude %q", args[1])
+	}
+	if len(args) > 2 {
+		if loc.Altitude, err = strconv.ParseFloat(strings.TrimSuffix(args[2], "m"), 64); err != nil {
+			return loc, fmt.Errorf("bad altitude %q", args[2])
+		}
+	}
+	return loc, nil
+}
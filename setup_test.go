@@ -1,11 +1,17 @@
 package corednstailscale
 
 import (
+	"errors"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
 	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -32,39 +38,2101 @@ func TestParseConfig(t *testing.T) {
 			}`,
 			wantErr: true,
 		},
+		"repeated reverse": {
+			input: `tailscale corp.example.com. {
+				reverse
+				reverse
+			}`,
+			wantErr: true,
+		},
+		"reverse with argument": {
+			input: `tailscale corp.example.com. {
+				reverse yes
+			}`,
+			wantErr: true,
+		},
+		"repeated metadata": {
+			input: `tailscale corp.example.com. {
+				metadata
+				metadata
+			}`,
+			wantErr: true,
+		},
+		"repeated authority": {
+			input: `tailscale corp.example.com. {
+				authority
+				authority
+			}`,
+			wantErr: true,
+		},
+		"repeated hinfo": {
+			input: `tailscale corp.example.com. {
+				hinfo
+				hinfo
+			}`,
+			wantErr: true,
+		},
+		"invalid ttl": {
+			input: `tailscale corp.example.com. {
+				ttl 10ms
+			}`,
+			wantErr: true,
+		},
+		"zone without tags": {
+			input: `tailscale corp.example.com. {
+				zone den.corp.example.com. {
+				}
+			}`,
+			wantErr: true,
+		},
+		"zone with repeated tag": {
+			input: `tailscale corp.example.com. {
+				tag campus-den den.corp.example.com.
+				zone lab.corp.example.com. {
+					tags lab-den campus-den
+				}
+			}`,
+			wantErr: true,
+		},
+		"zone with unknown option": {
+			input: `tailscale corp.example.com. {
+				zone den.corp.example.com. {
+					tags campus-den
+					reload 10s
+				}
+			}`,
+			wantErr: true,
+		},
+		"template without host": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					tags prod
+					template web-{tag}
+				}
+			}`,
+			wantErr: true,
+		},
+		"fully qualified template": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					tags prod
+					template {host}.example.com.
+				}
+			}`,
+			wantErr: true,
+		},
+		"template with tag in default zone": {
+			input: `tailscale corp.example.com. {
+				zone corp.example.com. {
+					template {host}-{tag}
+				}
+			}`,
+			wantErr: true,
+		},
+		"template for unserved zone": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					template {host}-prod
+				}
+			}`,
+			wantErr: true,
+		},
+		"repeated name-tag": {
+			input: `tailscale corp.example.com. {
+				name-tag
+				name-tag host-
+			}`,
+			wantErr: true,
+		},
+		"repeated exclude-self": {
+			input: `tailscale corp.example.com. {
+				exclude-self
+				exclude-self
+			}`,
+			wantErr: true,
+		},
+		"exclude-self and self-zones": {
+			input: `tailscale corp.example.com. {
+				exclude-self
+				self-zones corp.example.com.
+			}`,
+			wantErr: true,
+		},
+		"self-zones with unserved zone": {
+			input: `tailscale corp.example.com. {
+				self-zones example.com.
+			}`,
+			wantErr: true,
+		},
+		"exclude-tag without tags": {
+			input: `tailscale corp.example.com. {
+				exclude-tag
+			}`,
+			wantErr: true,
+		},
+		"same name-tag and alias-tag": {
+			input: `tailscale corp.example.com. {
+				name-tag dns-
+				alias-tag dns-
+			}`,
+			wantErr: true,
+		},
+		"conflicting address families": {
+			input: `tailscale corp.example.com. {
+				ipv4-only corp.example.com.
+				ipv6-only corp.example.com.
+			}`,
+			wantErr: true,
+		},
+		"unknown type": {
+			input: `tailscale corp.example.com. {
+				zone corp.example.com. {
+					types A BOGUS
+				}
+			}`,
+			wantErr: true,
+		},
+		"unknown normalization": {
+			input: `tailscale corp.example.com. {
+				normalize uppercase
+			}`,
+			wantErr: true,
+		},
+		"bind-tailnet with tsnet": {
+			input: `tailscale corp.example.com. {
+				bind-tailnet
+				tsnet
+			}`,
+			wantErr: true,
+		},
+		"tsnet with socket": {
+			input: `tailscale corp.example.com. {
+				socket /var/run/tailscale/tailscaled.sock
+				tsnet
+			}`,
+			wantErr: true,
+		},
+		"tsnet with invalid listen address": {
+			input: `tailscale corp.example.com. {
+				tsnet {
+					listen dns.example.com:53
+				}
+			}`,
+			wantErr: true,
+		},
+		"tsnet with unknown option": {
+			input: `tailscale corp.example.com. {
+				tsnet {
+					login-server https://headscale.example.com
+				}
+			}`,
+			wantErr: true,
+		},
+		"invalid watch setting": {
+			input: `tailscale corp.example.com. {
+				watch sometimes
+			}`,
+			wantErr: true,
+		},
+		"unknown label source": {
+			input: `tailscale corp.example.com. {
+				label-source fqdn
+			}`,
+			wantErr: true,
+		},
+		"computed label source": {
+			input: `tailscale corp.example.com. {
+				label-source computed
+			}`,
+			wantErr: true,
+		},
+		"empty label in default zone": {
+			input:   `tailscale corp..example.com.`,
+			wantErr: true,
+		},
+		"root default zone": {
+			input:   `tailscale .`,
+			wantErr: true,
+		},
+		"invalid character in tag zone": {
+			input: `tailscale corp.example.com. {
+				tag prod example/com.
+			}`,
+			wantErr: true,
+		},
+		"repeated tags-txt": {
+			input: `tailscale corp.example.com. {
+				tags-txt
+				tags-txt
+			}`,
+			wantErr: true,
+		},
+		"repeated location": {
+			input: `tailscale corp.example.com. {
+				location campus-den 39.7392 -104.9903
+				location campus-den 39.7392 -104.9903 1609
+			}`,
+			wantErr: true,
+		},
+		"location with bad latitude": {
+			input: `tailscale corp.example.com. {
+				location campus-den 91 -104.9903
+			}`,
+			wantErr: true,
+		},
+		"location without longitude": {
+			input: `tailscale corp.example.com. {
+				location campus-den 39.7392
+			}`,
+			wantErr: true,
+		},
+		"repeated service port": {
+			input: `tailscale corp.example.com. {
+				service http 80
+				service www 80/tcp
+			}`,
+			wantErr: true,
+		},
+		"service with bad port": {
+			input: `tailscale corp.example.com. {
+				service http eighty
+			}`,
+			wantErr: true,
+		},
+		"service with bad protocol": {
+			input: `tailscale corp.example.com. {
+				service http 80/sctp
+			}`,
+			wantErr: true,
+		},
+		"tagged service with extra argument": {
+			input: `tailscale corp.example.com. {
+				service ldap 389 dc extra
+			}`,
+			wantErr: true,
+		},
+		"dns64 with bad prefix length": {
+			input: `tailscale corp.example.com. {
+				dns64 2001:db8::/36
+			}`,
+			wantErr: true,
+		},
+		"dns64 with IPv4 prefix": {
+			input: `tailscale corp.example.com. {
+				dns64 100.64.0.0/10
+			}`,
+			wantErr: true,
+		},
+		"soa with missing timer": {
+			input: `tailscale corp.example.com. {
+				soa 1h 15m 168h
+			}`,
+			wantErr: true,
+		},
+		"soa with bad timer": {
+			input: `tailscale corp.example.com. {
+				soa 1h 15m forever 30s
+			}`,
+			wantErr: true,
+		},
+		"zone soa for unserved zone": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					soa 2h 1h 336h 1h
+				}
+			}`,
+			wantErr: true,
+		},
+		"zone soa with negative-ttl": {
+			input: `tailscale corp.example.com. {
+				negative-ttl 10s
+				zone corp.example.com. {
+					soa 2h 1h 336h 1h
+				}
+			}`,
+			wantErr: true,
+		},
+		"zone ns-name conflicting with ns-name": {
+			input: `tailscale corp.example.com. {
+				ns-name dns1 example.com.
+				zone example.com. {
+					tags prod
+					ns-name ns1.example.net.
+				}
+			}`,
+			wantErr: true,
+		},
+		"soa-mailbox for unserved zone": {
+			input: `tailscale corp.example.com. {
+				soa-mailbox hostmaster@example.com example.net.
+			}`,
+			wantErr: true,
+		},
+		"repeated soa-mailbox": {
+			input: `tailscale corp.example.com. {
+				soa-mailbox hostmaster@example.com
+				soa-mailbox hostmaster.example.net.
+			}`,
+			wantErr: true,
+		},
+		"ns-name for unserved zone": {
+			input: `tailscale corp.example.com. {
+				ns-name dns1 example.net.
+			}`,
+			wantErr: true,
+		},
+		"unknown serial mode": {
+			input: `tailscale corp.example.com. {
+				serial random
+			}`,
+			wantErr: true,
+		},
+		"persisted hash serial": {
+			input: `tailscale corp.example.com. {
+				serial hash /var/lib/coredns/tailscale-serials
+			}`,
+			wantErr: true,
+		},
+		"negative-ttl with soa minimum": {
+			input: `tailscale corp.example.com. {
+				soa 1h 15m 168h 30s
+				negative-ttl 10s
+			}`,
+			wantErr: true,
+		},
+		"sorted order": {
+			input: `tailscale corp.example.com. {
+				order sorted
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Order:          OrderSorted,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"unknown order": {
+			input: `tailscale corp.example.com. {
+				order random
+			}`,
+			wantErr: true,
+		},
+		"aname for unserved zone": {
+			input: `tailscale corp.example.com. {
+				aname lb.example.net example.com.
+			}`,
+			wantErr: true,
+		},
+		"aname at itself": {
+			input: `tailscale corp.example.com. {
+				aname corp.example.com.
+			}`,
+			wantErr: true,
+		},
+		"fully qualified label": {
+			input: `tailscale corp.example.com. {
+				label campus-iad iad.corp.example.com.
+			}`,
+			wantErr: true,
+		},
+		"service without port": {
+			input: `tailscale corp.example.com. {
+				service http
+			}`,
+			wantErr: true,
+		},
+		"record outside served zones": {
+			input: `tailscale corp.example.com. {
+				record www.example.net. A 192.0.2.1
+			}`,
+			wantErr: true,
+		},
+		"record of synthesized type": {
+			input: `tailscale corp.example.com. {
+				record @ SOA ns root 1 2 3 4 5
+			}`,
+			wantErr: true,
+		},
+		"record with bad data": {
+			input: `tailscale corp.example.com. {
+				record www A 192.0.2
+			}`,
+			wantErr: true,
+		},
+		"record without data": {
+			input: `tailscale corp.example.com. {
+				record www A
+			}`,
+			wantErr: true,
+		},
+		"repeated update": {
+			input: `tailscale corp.example.com. {
+				update dns-updater
+				update dns-admin
+			}`,
+			wantErr: true,
+		},
+		"bad notify": {
+			input: `tailscale corp.example.com. {
+				notify ns2.example.com.
+			}`,
+			wantErr: true,
+		},
+		"notify without address": {
+			input: `tailscale corp.example.com. {
+				notify
+			}`,
+			wantErr: true,
+		},
+		"dnssec without block": {
+			input: `tailscale corp.example.com. {
+				dnssec
+			}`,
+			wantErr: true,
+		},
+		"dnssec without keys": {
+			input: `tailscale corp.example.com. {
+				dnssec {
+				}
+			}`,
+			wantErr: true,
+		},
+		"dnssec bad option": {
+			input: `tailscale corp.example.com. {
+				dnssec {
+					key Kcorp.example.com.+013+12345
+				}
+			}`,
+			wantErr: true,
+		},
+		"dnssec missing key": {
+			input: `tailscale corp.example.com. {
+				dnssec {
+					key file /nonexistent/Kcorp.example.com.+013+12345
+				}
+			}`,
+			wantErr: true,
+		},
+		"repeated export": {
+			input: `tailscale corp.example.com. {
+				export /var/lib/coredns
+				export /tmp
+			}`,
+			wantErr: true,
+		},
+		"export without directory": {
+			input: `tailscale corp.example.com. {
+				export
+			}`,
+			wantErr: true,
+		},
+		"repeated wildcard": {
+			input: `tailscale corp.example.com. {
+				wildcard
+				wildcard
+			}`,
+			wantErr: true,
+		},
+		"wildcard without target": {
+			input: `tailscale corp.example.com. {
+				wildcard apps
+			}`,
+			wantErr: true,
+		},
+		"repeated apex": {
+			input: `tailscale corp.example.com. {
+				apex www
+				apex www corp.example.com.
+			}`,
+			wantErr: true,
+		},
+		"apex of unserved zone": {
+			input: `tailscale corp.example.com. {
+				apex www example.com.
+			}`,
+			wantErr: true,
+		},
+		"repeated answer": {
+			input: `tailscale corp.example.com. {
+				answer flatten
+				answer cname
+			}`,
+			wantErr: true,
+		},
+		"bad answer": {
+			input: `tailscale corp.example.com. {
+				answer alias
+			}`,
+			wantErr: true,
+		},
+		"update without tag": {
+			input: `tailscale corp.example.com. {
+				update
+			}`,
+			wantErr: true,
+		},
 		"unknown option": {
 			input: `tailscale corp.example.com. {
-				foo bar
+				foo bar
+			}`,
+			wantErr: true,
+		},
+		"full block but no default zone": {
+			input: `tailscale {
+				reload 300s
+				tag campus-den den.corp.example.com.
+				tag campus-rdu rdu.corp.example.com.
+				tag prod example.com.
+			}`,
+			wantErr: true,
+		},
+
+		// Sane cases
+		"default zone only": {
+			input: "tailscale corp.example.com.",
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"empty block": {
+			input: `tailscale corp.example.com. {
+				}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"static records": {
+			input: `tailscale corp.example.com. {
+				record mail MX 10 mx.example.net.
+				record @ TXT "v=spf1 -all"
+				record www.corp.example.com. 60 IN A 192.0.2.1
+				reload 30s
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: 30 * time.Second,
+				Records: []dns.RR{
+					rr(t, "mail.corp.example.com. 30 IN MX 10 mx.example.net."),
+					rr(t, `corp.example.com. 30 IN TXT "v=spf1 -all"`),
+					rr(t, "www.corp.example.com. 60 IN A 192.0.2.1"),
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"dynamic updates": {
+			input: `tailscale corp.example.com. {
+				update tag:dns-updater /var/lib/coredns/updates.db
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				UpdateTag:      "dns-updater",
+				UpdateFile:     "/var/lib/coredns/updates.db",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"notify": {
+			input: `tailscale corp.example.com. {
+				notify 10.240.0.1 [fd00::1]:5353
+				notify 10.240.0.2:53
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Notify:         []string{"10.240.0.1:53", "[fd00::1]:5353", "10.240.0.2:53"},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"export": {
+			input: `tailscale corp.example.com. {
+				export /var/lib/coredns /usr/local/bin/sign-zone --quiet
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				ExportDir:      "/var/lib/coredns",
+				ExportCommand:  []string{"/usr/local/bin/sign-zone", "--quiet"},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"wildcards": {
+			input: `tailscale corp.example.com. {
+				wildcard
+				wildcard apps ingress
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Wildcard:       true,
+				Records: []dns.RR{
+					&dns.CNAME{
+						Hdr:    dns.RR_Header{Name: "*.apps.corp.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+						Target: "ingress.corp.example.com.",
+					},
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"apex": {
+			input: `tailscale corp.example.com. {
+				apex www
+				apex tag:prod-www example.com.
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone: "corp.example.com.",
+				Zones: map[string]string{
+					"prod": "example.com.",
+				},
+				Apex: map[string]string{
+					"www":      "corp.example.com.",
+					"prod-www": "example.com.",
+				},
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"tagged service": {
+			input: `tailscale corp.example.com. {
+				service ldap 389 tag:dc
+				service kerberos 88/udp dc
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				TaggedServices: []TaggedService{
+					{Tag: "dc", Name: "ldap", Proto: "tcp", Port: 389},
+					{Tag: "dc", Name: "kerberos", Proto: "udp", Port: 88},
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"nameserver": {
+			input: `tailscale corp.example.com. {
+				nameserver tag:dns-ns
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NameserverTag:  "dns-ns",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"dns64": {
+			input: `tailscale corp.example.com. {
+				dns64
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				DNS64:          netip.MustParsePrefix("64:ff9b::/96"),
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"dns64 prefix": {
+			input: `tailscale corp.example.com. {
+				dns64 2001:db8:122:344::/64
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				DNS64:          netip.MustParsePrefix("2001:db8:122:344::/64"),
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"soa": {
+			input: `tailscale corp.example.com. {
+				soa 1h 15m 168h 30s
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				SOA: SOATimers{
+					Refresh: time.Hour,
+					Retry:   15 * time.Minute,
+					Expire:  168 * time.Hour,
+					Minimum: 30 * time.Second,
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"zone soa": {
+			input: `tailscale corp.example.com. {
+				soa 1h 15m 168h 30s
+				zone example.com. {
+					tags prod
+					ns-name ns1.example.net.
+					mailbox hostmaster@example.com
+					soa 2h 1h 336h 1h
+				}
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones: map[string]string{
+					"prod": "example.com.",
+				},
+				NSNames: map[string]string{
+					"example.com.": "ns1.example.net.",
+				},
+				Mailboxes: map[string]string{
+					"example.com.": "hostmaster.example.com.",
+				},
+				SOA: SOATimers{
+					Refresh: time.Hour,
+					Retry:   15 * time.Minute,
+					Expire:  168 * time.Hour,
+					Minimum: 30 * time.Second,
+				},
+				ZoneSOA: map[string]SOATimers{
+					"example.com.": {
+						Refresh: 2 * time.Hour,
+						Retry:   time.Hour,
+						Expire:  336 * time.Hour,
+						Minimum: time.Hour,
+					},
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"soa-mailbox": {
+			input: `tailscale corp.example.com. {
+				soa-mailbox hostmaster@example.com
+				soa-mailbox first.last@example.com example.com.
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones: map[string]string{
+					"prod": "example.com.",
+				},
+				Mailboxes: map[string]string{
+					"":             "hostmaster.example.com.",
+					"example.com.": `first\.last.example.com.`,
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"ns-name": {
+			input: `tailscale corp.example.com. {
+				ns-name dns1
+				ns-name ns1.example.net. example.com.
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones: map[string]string{
+					"prod": "example.com.",
+				},
+				NSNames: map[string]string{
+					"":             "dns1",
+					"example.com.": "ns1.example.net.",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"serial": {
+			input: `tailscale corp.example.com. {
+				serial increment /var/lib/coredns/tailscale-serials
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Serial:         SerialIncrement,
+				SerialFile:     "/var/lib/coredns/tailscale-serials",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"date serial": {
+			input: `tailscale corp.example.com. {
+				serial date /var/lib/coredns/tailscale-serials
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Serial:         SerialDate,
+				SerialFile:     "/var/lib/coredns/tailscale-serials",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"unix serial": {
+			input: `tailscale corp.example.com. {
+				serial unix
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Serial:         SerialUnix,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"ttl": {
+			input: `tailscale corp.example.com. {
+				reload 1h
+				ttl 30s
+				record www CNAME self
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: time.Hour,
+				TTL:            30 * time.Second,
+				Records:        []dns.RR{rr(t, "www.corp.example.com. 30 IN CNAME self.corp.example.com.")},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"negative-ttl": {
+			input: `tailscale corp.example.com. {
+				negative-ttl 10s
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NegativeTTL:    10 * time.Second,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"order": {
+			input: `tailscale corp.example.com. {
+				order round-robin
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Order:          OrderRoundRobin,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"minimal-responses": {
+			input: `tailscale corp.example.com. {
+				minimal-responses
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Minimal:        true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"identify": {
+			input: `tailscale corp.example.com. {
+				identify
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Identify:       true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"acme": {
+			input: `tailscale corp.example.com. {
+				acme
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				ACME:           true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"authority": {
+			input: `tailscale corp.example.com. {
+				authority
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Authority:      true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"label": {
+			input: `tailscale corp.example.com. {
+				label campus-iad iad
+				label tag:campus-fra fra.eu
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Labels: map[string]string{
+					"campus-iad": "iad",
+					"campus-fra": "fra.eu",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"aname": {
+			input: `tailscale corp.example.com. {
+				aname www.corp.example.com.
+				aname lb.example.net example.com.
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				ANAMEs: map[string]string{
+					"corp.example.com.": "www.corp.example.com.",
+					"example.com.":      "lb.example.net.",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"zone": {
+			input: `tailscale corp.example.com. {
+				zone den.corp.example.com. {
+					tags campus-den tag:lab-den
+				}
+				zone Example.COM {
+					tags prod
+				}
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones: map[string]string{
+					"campus-den": "den.corp.example.com.",
+					"lab-den":    "den.corp.example.com.",
+					"prod":       "example.com.",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":     true,
+					"den.corp.example.com.": true,
+					"example.com.":          true,
+				},
+			},
+		},
+		"template": {
+			input: `tailscale corp.example.com. {
+				zone corp.example.com. {
+					template {host}.hosts
+				}
+				zone example.com. {
+					tags prod
+					template {host}-{tag}
+				}
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				Templates: map[string]string{
+					"corp.example.com.": "{host}.hosts",
+					"example.com.":      "{host}-{tag}",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"name-tag": {
+			input: `tailscale corp.example.com. {
+				name-tag
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NameTagPrefix:  "dns-name-",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"name-tag with prefix": {
+			input: `tailscale corp.example.com. {
+				name-tag tag:host-
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NameTagPrefix:  "host-",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"single-label zone": {
+			input: `tailscale ts. {
+				short-names
+			}`,
+			want: Config{
+				DefaultZone:    "ts.",
+				ReloadInterval: defaultReloadInterval,
+				ShortNames:     true,
+				fastZoneLookup: map[string]bool{
+					"ts.": true,
+				},
+			},
+		},
+		"normalize": {
+			input: `tailscale corp.example.com. {
+				normalize
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Normalize:      Normalization{Punycode: true, Strip: true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"normalize strip": {
+			input: `tailscale corp.example.com. {
+				normalize strip
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Normalize:      Normalization{Strip: true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"tsnet": {
+			input: `tailscale corp.example.com. {
+				tsnet dns {
+					state-dir /var/lib/coredns/tsnet
+					auth-key-file /run/secrets/ts-authkey
+					ephemeral
+					control-url https://headscale.example.com
+					listen :53
+					listen 100.101.102.103:5353
+				}
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				TSNet: &TSNet{
+					Hostname:    "dns",
+					StateDir:    "/var/lib/coredns/tsnet",
+					AuthKeyFile: "/run/secrets/ts-authkey",
+					Ephemeral:   true,
+					ControlURL:  "https://headscale.example.com",
+					Listen:      []string{":53", "100.101.102.103:5353"},
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"bind-tailnet": {
+			input: `tailscale corp.example.com. {
+				bind-tailnet
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				BindTailnet:    true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"capability": {
+			input: `tailscale corp.example.com. {
+				capability example.com/cap/dns-prod prod.corp.example.com
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Capabilities: map[string]string{
+					"example.com/cap/dns-prod": "prod.corp.example.com.",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":      true,
+					"prod.corp.example.com.": true,
+				},
+			},
+		},
+		"capability twice": {
+			input: `tailscale corp.example.com. {
+				capability example.com/cap/dns-prod prod.corp.example.com
+				capability example.com/cap/dns-prod example.com
+			}`,
+			wantErr: true,
+		},
+		"record-capability": {
+			input: `tailscale corp.example.com. {
+				record-capability example.com/cap/dns
+			}`,
+			want: Config{
+				DefaultZone:      "corp.example.com.",
+				ReloadInterval:   defaultReloadInterval,
+				RecordCapability: "example.com/cap/dns",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"record-capability twice": {
+			input: `tailscale corp.example.com. {
+				record-capability example.com/cap/dns
+				record-capability example.com/cap/dns2
+			}`,
+			wantErr: true,
+		},
+		"funnel-zone": {
+			input: `tailscale corp.example.com. {
+				funnel-zone public.example.com
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				FunnelZone:     "public.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":   true,
+					"public.example.com.": true,
+				},
+			},
+		},
+		"node-attrs": {
+			input: `tailscale corp.example.com. {
+				node-attrs funnel
+				node-attrs https://tailscale.com/cap/is-admin https://tailscale.com/cap/ssh
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NodeAttrs: map[string]bool{
+					"funnel":                             true,
+					"https://tailscale.com/cap/is-admin": true,
+					"https://tailscale.com/cap/ssh":      true,
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"node-attrs without attributes": {
+			input: `tailscale corp.example.com. {
+				node-attrs
+			}`,
+			wantErr: true,
+		},
+		"posture": {
+			input: `tailscale corp.example.com. {
+				posture
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Posture:        true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"posture twice": {
+			input: `tailscale corp.example.com. {
+				posture
+				posture
+			}`,
+			wantErr: true,
+		},
+		"vip-services": {
+			input: `tailscale corp.example.com. {
+				vip-services
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				VIPServices:    true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"vip-services with argument": {
+			input: `tailscale corp.example.com. {
+				vip-services yes
+			}`,
+			wantErr: true,
+		},
+		"vip-services twice": {
+			input: `tailscale corp.example.com. {
+				vip-services
+				vip-services
+			}`,
+			wantErr: true,
+		},
+		"key-expiry-ttl": {
+			input: `tailscale corp.example.com. {
+				key-expiry-ttl
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				KeyExpiryTTL:   true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"owner-zone": {
+			input: `tailscale corp.example.com. {
+				owner-zone users.corp.example.com
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				OwnerZone:      "users.corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":       true,
+					"users.corp.example.com.": true,
+				},
+			},
+		},
+		"shared zone": {
+			input: `tailscale corp.example.com. {
+				shared zone shared.corp.example.com
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Shared:         SharedOwnZone,
+				SharedZone:     "shared.corp.example.com.",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":        true,
+					"shared.corp.example.com.": true,
+				},
+			},
+		},
+		"shared exclude": {
+			input: `tailscale corp.example.com. {
+				shared exclude
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Shared:         SharedExclude,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"shared zone without zone": {
+			input: `tailscale corp.example.com. {
+				shared zone
+			}`,
+			wantErr: true,
+		},
+		"shared unknown": {
+			input: `tailscale corp.example.com. {
+				shared sometimes
+			}`,
+			wantErr: true,
+		},
+		"prune-after": {
+			input: `tailscale corp.example.com. {
+				prune-after 720h
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				PruneAfter:     720 * time.Hour,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"prune-after invalid": {
+			input: `tailscale corp.example.com. {
+				prune-after soon
+			}`,
+			wantErr: true,
+		},
+		"personal-zone": {
+			input: `tailscale corp.example.com. {
+				personal-zone me.corp.example.com
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				PersonalZone:   "me.corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":    true,
+					"me.corp.example.com.": true,
+				},
+			},
+		},
+		"personal-zone twice": {
+			input: `tailscale corp.example.com. {
+				personal-zone me.corp.example.com
+				personal-zone you.corp.example.com
+			}`,
+			wantErr: true,
+		},
+		"require-identity": {
+			input: `tailscale corp.example.com. {
+				require-identity
+			}`,
+			want: Config{
+				DefaultZone:     "corp.example.com.",
+				ReloadInterval:  defaultReloadInterval,
+				RequireIdentity: true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"tsnet without block": {
+			input: `tailscale corp.example.com. {
+				tsnet
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				TSNet:          &TSNet{Hostname: defaultTSNetHostname},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"watch off": {
+			input: `tailscale corp.example.com. {
+				watch off
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NoWatch:        true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"label-source": {
+			input: `tailscale corp.example.com. {
+				label-source hostname
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				LabelSource:    LabelHostName,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"no-authority": {
+			input: `tailscale corp.example.com. {
+				no-authority
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NoAuthority:    true,
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"no-authority with authority": {
+			input: `tailscale corp.example.com. {
+				no-authority
+				authority
+			}`,
+			wantErr: true,
+		},
+		"no-authority with nameserver": {
+			input: `tailscale corp.example.com. {
+				no-authority
+				nameserver dns-ns
+			}`,
+			wantErr: true,
+		},
+		"max-stale": {
+			input: `tailscale corp.example.com. {
+				max-stale 1h
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				MaxStale:       time.Hour,
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"max-stale within refresh": {
+			input: `tailscale corp.example.com. {
+				refresh 10m
+				max-stale 10m
+			}`,
+			wantErr: true,
+		},
+		"hosts": {
+			input: `tailscale corp.example.com. {
+				hosts /etc/coredns/extra-hosts
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				HostsFile:      "/etc/coredns/extra-hosts",
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"repeated hosts": {
+			input: `tailscale corp.example.com. {
+				hosts /etc/coredns/extra-hosts
+				hosts /etc/hosts
+			}`,
+			wantErr: true,
+		},
+		"import-zonefile": {
+			input: `tailscale corp.example.com. {
+				tag prod example.com.
+				import-zonefile example.com. /etc/coredns/db.example.com
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				ZoneFiles:      map[string]string{"example.com.": "/etc/coredns/db.example.com"},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"import-zonefile for unserved zone": {
+			input: `tailscale corp.example.com. {
+				import-zonefile example.com. /etc/coredns/db.example.com
+			}`,
+			wantErr: true,
+		},
+		"upstream": {
+			input: `tailscale corp.example.com. {
+				upstream 100.100.100.100
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Upstream:       "100.100.100.100:53",
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"invalid upstream": {
+			input: `tailscale corp.example.com. {
+				upstream resolver.example.net
+			}`,
+			wantErr: true,
+		},
+		"prometheus off": {
+			input: `tailscale corp.example.com. {
+				prometheus off
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NoMetrics:      true,
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"metric-namespace": {
+			input: `tailscale corp.example.com. {
+				metric-namespace tailnet_dns
+			}`,
+			want: Config{
+				DefaultZone:      "corp.example.com.",
+				ReloadInterval:   defaultReloadInterval,
+				MetricsNamespace: "tailnet_dns",
+				fastZoneLookup:   map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"invalid metric-namespace": {
+			input: `tailscale corp.example.com. {
+				metric-namespace tailnet-dns
+			}`,
+			wantErr: true,
+		},
+		"metric-namespace with prometheus off": {
+			input: `tailscale corp.example.com. {
+				prometheus off
+				metric-namespace tailnet_dns
+			}`,
+			wantErr: true,
+		},
+		"header flags": {
+			input: `tailscale corp.example.com. {
+				authoritative off
+				recursion-available on
+			}`,
+			want: Config{
+				DefaultZone:        "corp.example.com.",
+				ReloadInterval:     defaultReloadInterval,
+				NoAuthoritative:    true,
+				RecursionAvailable: true,
+				fastZoneLookup:     map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"invalid authoritative": {
+			input: `tailscale corp.example.com. {
+				authoritative yes
+			}`,
+			wantErr: true,
+		},
+		"recursion-available without setting": {
+			input: `tailscale corp.example.com. {
+				recursion-available
+			}`,
+			wantErr: true,
+		},
+		"compression and udp size": {
+			input: `tailscale corp.example.com. {
+				compress off
+				max-udp-size 1232
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				NoCompress:     true,
+				MaxUDPSize:     1232,
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"invalid compress": {
+			input: `tailscale corp.example.com. {
+				compress maybe
+			}`,
+			wantErr: true,
+		},
+		"max-udp-size too small": {
+			input: `tailscale corp.example.com. {
+				max-udp-size 511
+			}`,
+			wantErr: true,
+		},
+		"max-udp-size too large": {
+			input: `tailscale corp.example.com. {
+				max-udp-size 65536
+			}`,
+			wantErr: true,
+		},
+		"aliases": {
+			input: `tailscale corp.example.com. {
+				alias wiki foo
+				alias Git bar
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Aliases:        map[string]string{"wiki": "foo", "git": "bar"},
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"alias with dots": {
+			input: `tailscale corp.example.com. {
+				alias wiki.corp foo
+			}`,
+			wantErr: true,
+		},
+		"repeated alias": {
+			input: `tailscale corp.example.com. {
+				alias wiki foo
+				alias wiki bar
+			}`,
+			wantErr: true,
+		},
+		"socket": {
+			input: `tailscale corp.example.com. {
+				socket /var/run/tailscale/tailscaled.sock
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Socket:         "/var/run/tailscale/tailscaled.sock",
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"repeated socket": {
+			input: `tailscale corp.example.com. {
+				socket /var/run/tailscale/tailscaled.sock
+				socket /run/tailscaled.sock
+			}`,
+			wantErr: true,
+		},
+		"timeout": {
+			input: `tailscale corp.example.com. {
+				timeout 2s
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Timeout:        2 * time.Second,
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+		},
+		"invalid timeout": {
+			input: `tailscale corp.example.com. {
+				timeout 0s
+			}`,
+			wantErr: true,
+		},
+		"repeated timeout": {
+			input: `tailscale corp.example.com. {
+				timeout 2s
+				timeout 3s
+			}`,
+			wantErr: true,
+		},
+		"users": {
+			input: `tailscale corp.example.com. {
+				user Alice@example.com alice.corp.example.com.
+				user bob@example.com bob.corp.example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Users: map[string]string{
+					"alice@example.com": "alice.corp.example.com.",
+					"bob@example.com":   "bob.corp.example.com.",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":       true,
+					"alice.corp.example.com.": true,
+					"bob.corp.example.com.":   true,
+				},
+			},
+		},
+		"repeated user": {
+			input: `tailscale corp.example.com. {
+				user alice@example.com alice.corp.example.com.
+				user alice@example.com alice.example.com.
+			}`,
+			wantErr: true,
+		},
+		"tag template in user zone": {
+			input: `tailscale corp.example.com. {
+				user alice@example.com alice.corp.example.com.
+				zone alice.corp.example.com. {
+					template {host}-{tag}
+				}
+			}`,
+			wantErr: true,
+		},
+		"user without zone": {
+			input: `tailscale corp.example.com. {
+				user alice@example.com
+			}`,
+			wantErr: true,
+		},
+		"os zones": {
+			input: `tailscale corp.example.com. {
+				os linux servers.corp.example.com.
+				os darwin macs.corp.example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				OSZones: map[string]string{
+					"linux": "servers.corp.example.com.",
+					"macos": "macs.corp.example.com.",
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":         true,
+					"servers.corp.example.com.": true,
+					"macs.corp.example.com.":    true,
+				},
+			},
+		},
+		"repeated os": {
+			input: `tailscale corp.example.com. {
+				os macOS macs.corp.example.com.
+				os darwin apple.corp.example.com.
+			}`,
+			wantErr: true,
+		},
+		"extra zones": {
+			input: `tailscale corp.example.com. internal.example.net. {
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ExtraZones:     []string{"internal.example.net."},
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":     true,
+					"internal.example.net.": true,
+					"example.com.":          true,
+				},
+			},
+		},
+		"extra zones without block": {
+			input: `tailscale corp.example.com. internal.example.net.`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ExtraZones:     []string{"internal.example.net."},
+				ReloadInterval: defaultReloadInterval,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":     true,
+					"internal.example.net.": true,
+				},
+			},
+		},
+		"repeated default zone": {
+			input:   `tailscale corp.example.com. Corp.Example.com`,
+			wantErr: true,
+		},
+		"tag template in extra zone": {
+			input: `tailscale corp.example.com. internal.example.net. {
+				zone internal.example.net. {
+					template {host}-{tag}
+				}
 			}`,
 			wantErr: true,
 		},
-		"full block but no default zone": {
-			input: `tailscale {
-				reload 300s
+		"label within nested zone": {
+			input: `tailscale corp.example.com. {
 				tag campus-den den.corp.example.com.
-				tag campus-rdu rdu.corp.example.com.
+				label servers den
+			}`,
+			wantErr: true,
+		},
+		"template within nested zone": {
+			input: `tailscale example.com. {
+				tag campus-den den.example.com.
+				zone example.com. {
+					template {host}.den
+				}
+			}`,
+			wantErr: true,
+		},
+		"CNAME at nested zone apex": {
+			input: `tailscale corp.example.com. {
 				tag prod example.com.
+				record example.com. CNAME www.example.net.
 			}`,
 			wantErr: true,
 		},
-
-		// Sane cases
-		"default zone only": {
-			input: "tailscale corp.example.com.",
+		"canonical zones": {
+			input: `tailscale Corp.Example.com {
+				tag campus-den DEN.corp.example.com
+				apex www Example.com
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones: map[string]string{
+					"campus-den": "den.corp.example.com.",
+					"prod":       "example.com.",
+				},
+				Apex: map[string]string{"www": "example.com."},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.":     true,
+					"den.corp.example.com.": true,
+					"example.com.":          true,
+				},
+			},
+		},
+		"exclude-self": {
+			input: `tailscale corp.example.com. {
+				exclude-self
+			}`,
 			want: Config{
 				DefaultZone:    "corp.example.com.",
 				ReloadInterval: defaultReloadInterval,
+				ExcludeSelf:    true,
 				fastZoneLookup: map[string]bool{
 					"corp.example.com.": true,
 				},
 			},
 		},
-		"empty block": {
+		"self-zones": {
 			input: `tailscale corp.example.com. {
-				}`,
+				self-zones example.com
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				SelfZones:      map[string]bool{"example.com.": true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"require-tag": {
+			input: `tailscale corp.example.com. {
+				require-tag corp tag:server
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				RequireTags:    map[string]bool{"corp": true, "server": true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"exclude-tag": {
+			input: `tailscale corp.example.com. {
+				exclude-tag ci-runner tag:relay
+				exclude-tag ephemeral
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				ExcludeTags:    map[string]bool{"ci-runner": true, "relay": true, "ephemeral": true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"online-only": {
+			input: `tailscale corp.example.com. {
+				online-only
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				OnlineOnly:     true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"online-only with argument": {
+			input: `tailscale corp.example.com. {
+				online-only yes
+			}`,
+			wantErr: true,
+		},
+		"ephemeral-ttl": {
+			input: `tailscale corp.example.com. {
+				ephemeral-ttl 30s ci-runner tag:preview
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				EphemeralTTL:   30 * time.Second,
+				EphemeralTags:  map[string]bool{"ci-runner": true, "preview": true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"ephemeral-ttl without tags": {
+			input: `tailscale corp.example.com. {
+				ephemeral-ttl 30s
+			}`,
+			wantErr: true,
+		},
+		"invalid ephemeral-ttl": {
+			input: `tailscale corp.example.com. {
+				ephemeral-ttl 10ms ci-runner
+			}`,
+			wantErr: true,
+		},
+		"exclude-expired": {
+			input: `tailscale corp.example.com. {
+				exclude-expired
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				ExcludeExpired: true,
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"include-os and exclude-os": {
+			input: `tailscale corp.example.com. {
+				include-os linux Windows
+				exclude-os darwin
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				IncludeOS:      map[string]bool{"linux": true, "windows": true},
+				ExcludeOS:      map[string]bool{"macos": true},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"include-os without os": {
+			input: `tailscale corp.example.com. {
+				include-os
+			}`,
+			wantErr: true,
+		},
+		"os both included and excluded": {
+			input: `tailscale corp.example.com. {
+				include-os linux macos
+				exclude-os darwin
+			}`,
+			wantErr: true,
+		},
+		"alias-tag": {
+			input: `tailscale corp.example.com. {
+				alias-tag
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				AliasTagPrefix: "dns-alias-",
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+				},
+			},
+		},
+		"address families": {
+			input: `tailscale corp.example.com. {
+				ipv4-only
+				ipv6-only example.com
+				tag prod example.com.
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				Families: map[string]AddressFamily{
+					"":             FamilyIPv4Only,
+					"example.com.": FamilyIPv6Only,
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"types": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					tags prod
+					types a AAAA
+				}
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				Types: map[string]map[uint16]bool{
+					"example.com.": {dns.TypeA: true, dns.TypeAAAA: true},
+				},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"zone answer": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					tags prod
+					answer flatten
+				}
+			}`,
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				ZoneAnswers:    map[string]AnswerMode{"example.com.": AnswerFlatten},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"unknown zone answer": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					tags prod
+					answer alias
+				}
+			}`,
+			wantErr: true,
+		},
+		"zone answer not served": {
+			input: `tailscale corp.example.com. {
+				zone example.com. {
+					answer flatten
+				}
+			}`,
+			wantErr: true,
+		},
+		"answer": {
+			input: `tailscale corp.example.com. {
+				answer flatten
+			}`,
 			want: Config{
 				DefaultZone:    "corp.example.com.",
 				ReloadInterval: defaultReloadInterval,
+				Answer:         AnswerFlatten,
 				fastZoneLookup: map[string]bool{
 					"corp.example.com.": true,
 				},
@@ -73,6 +2141,14 @@ func TestParseConfig(t *testing.T) {
 		"full example": {
 			input: `tailscale corp.example.com. {
 				reload 300s
+				reverse
+				metadata
+				tags-txt
+				hinfo
+				location campus-den 39.7392 -104.9903 1609m
+				location campus-rdu 35.7796 -78.6382
+				service http 80
+				service dns 53/udp
 				tag campus-den den.corp.example.com.
 				tag campus-rdu rdu.corp.example.com.
 				tag prod example.com.
@@ -80,16 +2156,30 @@ func TestParseConfig(t *testing.T) {
 			want: Config{
 				DefaultZone:    "corp.example.com.",
 				ReloadInterval: 300 * time.Second,
+				Reverse:        true,
+				Metadata:       true,
+				TagsTXT:        true,
+				HINFO:          true,
+				Locations: map[string]Location{
+					"campus-den": {Latitude: 39.7392, Longitude: -104.9903, Altitude: 1609},
+					"campus-rdu": {Latitude: 35.7796, Longitude: -78.6382},
+				},
+				Services: map[string]string{
+					"80/tcp": "http",
+					"53/udp": "dns",
+				},
 				Zones: map[string]string{
 					"campus-den": "den.corp.example.com.",
 					"campus-rdu": "rdu.corp.example.com.",
 					"prod":       "example.com.",
 				},
 				fastZoneLookup: map[string]bool{
-					"corp.example.com.":     true,
-					"den.corp.example.com.": true,
-					"rdu.corp.example.com.": true,
-					"example.com.":          true,
+					"corp.example.com.":                 true,
+					"den.corp.example.com.":             true,
+					"rdu.corp.example.com.":             true,
+					"example.com.":                      true,
+					"100.in-addr.arpa.":                 true,
+					"0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": true,
 				},
 			},
 		},
@@ -109,3 +2199,126 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+// TestParseConfigEnv checks that environment variables are expanded, which the
+// Corefile parser does before the plugin sees the block.
+func TestParseConfigEnv(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		env     map[string]string
+		want    Config
+		wantErr bool
+	}{
+		"set": {
+			env: map[string]string{
+				"TS_ZONE":      "corp.example.com",
+				"TS_PROD_ZONE": "example.com.",
+			},
+			want: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: defaultReloadInterval,
+				Zones:          map[string]string{"prod": "example.com."},
+				fastZoneLookup: map[string]bool{
+					"corp.example.com.": true,
+					"example.com.":      true,
+				},
+			},
+		},
+		"unset": {
+			env:     map[string]string{"TS_PROD_ZONE": "example.com."},
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			t.Setenv("TS_ZONE", "")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			blocks, err := caddyfile.Parse("Corefile", strings.NewReader(`. {
+				tailscale {$TS_ZONE} {
+					tag prod {$TS_PROD_ZONE}
+				}
+			}`), nil)
+			if err != nil {
+				t.Fatalf("failed parsing Corefile: %v", err)
+			}
+			c := caddy.NewTestController("dns", "")
+			c.Dispenser = caddyfile.NewDispenserTokens("Corefile", blocks[0].Tokens["tailscale"])
+			var got Config
+			if err := parse(c, &got); (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error value: %v", err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestUnrouted(t *testing.T) {
+	config := fullTestConfig
+	config.Reverse = true
+	config.fastZoneLookup = map[string]bool{
+		"corp.example.com.":                 true,
+		"example.com.":                      true,
+		"100.in-addr.arpa.":                 true,
+		"0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": true,
+	}
+	for tn, tc := range map[string]struct {
+		origins []string
+		want    []string
+	}{
+		"root": {
+			origins: []string{"."},
+		},
+		"default zone only": {
+			origins: []string{"corp.example.com."},
+			want:    []string{"0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", "100.in-addr.arpa.", "example.com."},
+		},
+		"all": {
+			origins: []string{"example.com.", "in-addr.arpa.", "ip6.arpa."},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := unrouted(&config, tc.origins)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailnetHosts(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		client  *fakeLocalClient
+		want    []string
+		wantErr bool
+	}{
+		"addresses": {
+			client: &fakeLocalClient{status: ipnstate.Status{Self: &ipnstate.PeerStatus{
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.111.112.113"), netip.MustParseAddr("fd7a::dead:beef")},
+			}}},
+			want: []string{"100.111.112.113", "fd7a::dead:beef"},
+		},
+		"logged out": {
+			client:  &fakeLocalClient{status: ipnstate.Status{Self: &ipnstate.PeerStatus{}}},
+			wantErr: true,
+		},
+		"tailscaled down": {
+			client:  &fakeLocalClient{err: errors.New("connection refused")},
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got, err := tailnetHosts(tc.client, time.Second)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error value: %v", err)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
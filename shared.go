@@ -0,0 +1,123 @@
+package corednstailscale
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// instance of the plugin shared by every server block with the same Config.
+type instance struct {
+	config Config // as parsed, before any defaults are applied by Startup.
+	ts     *Tailscale
+	refs   int // number of started server blocks using ts.
+
+	// handler serving queries arriving over an embedded node: the chain of
+	// the first server block using ts.
+	handler plugin.Handler
+}
+
+// instances of the plugin, so that server blocks with identical configuration
+// share one poller and one set of records.
+var instances struct {
+	sync.Mutex
+	all []*instance
+}
+
+// share returns the instance for config, creating one with newTailscale if no
+// server block has configured the plugin identically.
+func share(config *Config, newTailscale func() (*Tailscale, error)) (*instance, error) {
+	instances.Lock()
+	defer instances.Unlock()
+	for _, in := range instances.all {
+		if reflect.DeepEqual(&in.config, config) {
+			return in, nil
+		}
+	}
+	ts, err := newTailscale()
+	if err != nil {
+		return nil, err
+	}
+	in := &instance{config: *config, ts: ts}
+	instances.all = append(instances.all, in)
+	return in, nil
+}
+
+// serve queries arriving over the embedded node with h, unless a server block
+// already does.
+func (in *instance) serve(h plugin.Handler) {
+	instances.Lock()
+	defer instances.Unlock()
+	if in.handler == nil {
+		in.handler = h
+	}
+}
+
+// acquire the instance for a server block, starting it for the first. An
+// embedded node is started along with it.
+func (in *instance) acquire() error {
+	instances.Lock()
+	defer instances.Unlock()
+	in.refs++
+	if in.refs > 1 {
+		return nil
+	}
+	if in.ts.node != nil {
+		if err := in.ts.node.start(in.handler); err != nil {
+			in.refs--
+			return err
+		}
+	}
+	in.ts.Startup()
+	return nil
+}
+
+// release the instance for a server block, shutting it down after the last.
+// An instance which is shut down is no longer shared with new server blocks.
+func (in *instance) release() {
+	instances.Lock()
+	defer instances.Unlock()
+	in.refs--
+	if in.refs > 0 {
+		return
+	}
+	in.ts.Shutdown()
+	if in.ts.node != nil {
+		if err := in.ts.node.Close(); err != nil {
+			log.Warningf("Failed closing the embedded node: %v", err)
+		}
+	}
+	for i, other := range instances.all {
+		if other == in {
+			instances.all = append(instances.all[:i], instances.all[i+1:]...)
+			break
+		}
+	}
+}
+
+// block is the handler of a single server block. Blocks sharing a Tailscale
+// each have their own next handler.
+type block struct {
+	*Tailscale
+	next plugin.Handler
+}
+
+// nextKey is the context key of the next handler of the serving block.
+type nextKey struct{}
+
+// ServeDNS passes the next handler of the block to the shared Tailscale.
+func (b *block) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+	return b.Tailscale.ServeDNS(context.WithValue(ctx, nextKey{}, b.next), w, req)
+}
+
+// next handler in the chain of the block serving ctx, or Next if not served by
+// a block.
+func (ts *Tailscale) next(ctx context.Context) plugin.Handler {
+	if next, ok := ctx.Value(nextKey{}).(plugin.Handler); ok {
+		return next
+	}
+	return ts.Next
+}
@@ -0,0 +1,92 @@
+package corednstailscale
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestShare(t *testing.T) {
+	newTailscale := func() (*Tailscale, error) {
+		return &Tailscale{Config: fullTestConfig, client: &fakeLocalClient{}}, nil
+	}
+	same := fullTestConfig
+	other := fullTestConfig
+	other.DefaultZone = "other.example.com."
+
+	a, err := share(&fullTestConfig, newTailscale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := share(&same, newTailscale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := share(&other, newTailscale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("identical configs not shared")
+	}
+	if a == c {
+		t.Errorf("different configs shared")
+	}
+
+	a.acquire()
+	b.acquire()
+	if !a.ts.Ready() {
+		t.Errorf("should be ready once acquired")
+	}
+	a.release()
+	if !b.ts.Ready() {
+		t.Errorf("should be ready until released by every block")
+	}
+	b.release()
+	if b.ts.Ready() {
+		t.Errorf("should not be ready once released by every block")
+	}
+
+	// Once shut down, the instance is no longer shared.
+	d, err := share(&same, newTailscale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == a {
+		t.Errorf("instance shared after being shut down")
+	}
+	instances.all = nil
+}
+
+func TestBlock_ServeDNS(t *testing.T) {
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	refused := &block{Tailscale: ts, next: test.NextHandler(dns.RcodeRefused, nil)}
+	notImp := &block{Tailscale: ts, next: test.NextHandler(dns.RcodeNotImplemented, nil)}
+	for tn, tc := range map[string]struct {
+		b         *block
+		qn        string
+		wantRcode int
+	}{
+		"served refused":     {b: refused, qn: "foo.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"served notimp":      {b: notImp, qn: "foo.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"not served refused": {b: refused, qn: "foo.example.net.", wantRcode: dns.RcodeRefused},
+		"not served notimp":  {b: notImp, qn: "foo.example.net.", wantRcode: dns.RcodeNotImplemented},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qn, dns.TypeA)
+			rcode, _ := tc.b.ServeDNS(context.Background(), &recorder{}, req)
+			if rcode != tc.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tc.wantRcode])
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package corednstailscale
+
+import (
+	"slices"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Sizes above which CoreDNS compresses answers sent over UDP, to avoid
+// fragmentation, whether or not they were meant to be compressed.
+const (
+	scrubSizeIPv4 = 1480
+	scrubSizeIPv6 = 1220
+)
+
+// sizingWriter applies the compression and UDP size settings to the answers
+// written through it.
+type sizingWriter struct {
+	dns.ResponseWriter
+	ts  *Tailscale
+	req *dns.Msg
+}
+
+func (w *sizingWriter) WriteMsg(m *dns.Msg) error {
+	m.Compress = !w.ts.NoCompress
+	state := request.Request{W: w.ResponseWriter, Req: w.req}
+	if state.Proto() != "udp" {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	size := state.Size()
+	if w.ts.MaxUDPSize != 0 {
+		size = min(size, int(w.ts.MaxUDPSize))
+	}
+	if !w.ts.NoCompress {
+		m.Truncate(size)
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	// Answers are kept small enough that CoreDNS won't compress them.
+	if state.Family() == 1 {
+		size = min(size, scrubSizeIPv4)
+	} else {
+		size = min(size, scrubSizeIPv6)
+	}
+	truncateUncompressed(m, size)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// truncateUncompressed drops records from the end of m until it fits in size
+// without compression, which dns.Msg.Truncate would enable. Additional records
+// are dropped first, and m is marked truncated if any others are.
+func truncateUncompressed(m *dns.Msg, size int) {
+	if m.Len() <= size {
+		return
+	}
+	// The OPT record must be kept, at the end of the additional section.
+	var opt dns.RR
+	if o := m.IsEdns0(); o != nil {
+		opt = o
+		m.Extra = slices.DeleteFunc(m.Extra, func(rr dns.RR) bool { return rr == opt })
+		size -= dns.Len(opt)
+	}
+	for len(m.Extra) > 0 && m.Len() > size {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+	for len(m.Ns) > 0 && m.Len() > size {
+		m.Ns = m.Ns[:len(m.Ns)-1]
+		m.Truncated = true
+	}
+	for len(m.Answer) > 0 && m.Len() > size {
+		m.Answer = m.Answer[:len(m.Answer)-1]
+		m.Truncated = true
+	}
+	if opt != nil {
+		m.Extra = append(m.Extra, opt)
+	}
+}
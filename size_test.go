@@ -0,0 +1,76 @@
+package corednstailscale
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestTailscale_ServeDNS_size(t *testing.T) {
+	big := &record{}
+	for i := 0; i < 100; i++ {
+		big.rrs = append(big.rrs, rr(t, fmt.Sprintf("big.corp.example.com. 300 IN A 100.101.102.%d", i)))
+	}
+	for tn, tc := range map[string]struct {
+		noCompress    bool
+		maxUDPSize    uint16
+		tcp           bool
+		wantCompress  bool
+		wantTruncated bool
+		wantMaxLen    int
+	}{
+		"defaults": {
+			wantCompress: true,
+			wantMaxLen:   dns.MaxMsgSize,
+		},
+		"compression off": {
+			noCompress:    true,
+			wantTruncated: true,
+			wantMaxLen:    512, // advertised by the client.
+		},
+		"max udp size": {
+			maxUDPSize:    512,
+			wantCompress:  true,
+			wantTruncated: true,
+			wantMaxLen:    512,
+		},
+		"max udp size over tcp": {
+			maxUDPSize:   512,
+			tcp:          true,
+			wantCompress: true,
+			wantMaxLen:   dns.MaxMsgSize,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			config := fullTestConfig
+			config.NoCompress = tc.noCompress
+			config.MaxUDPSize = tc.maxUDPSize
+			ts := &Tailscale{
+				Config: config,
+				serial: 8675309,
+				hosts:  records{"big.corp.example.com.": big},
+				Next:   test.NextHandler(dns.RcodeRefused, nil),
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("big.corp.example.com.", dns.TypeA)
+			w := &recorder{ResponseWriter: test.ResponseWriter{TCP: tc.tcp}}
+			if _, err := ts.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatal(err)
+			}
+			if w.got.Compress != tc.wantCompress {
+				t.Errorf("Compress = %v, want %v", w.got.Compress, tc.wantCompress)
+			}
+			if tc.noCompress || tc.maxUDPSize != 0 {
+				if w.got.Truncated != tc.wantTruncated {
+					t.Errorf("Truncated = %v, want %v", w.got.Truncated, tc.wantTruncated)
+				}
+			}
+			if l := w.got.Len(); l > tc.wantMaxLen {
+				t.Errorf("Len() = %d, want at most %d", l, tc.wantMaxLen)
+			}
+		})
+	}
+}
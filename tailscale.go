@@ -3,37 +3,134 @@
 package corednstailscale
 
 import (
+	"cmp"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"net"
 	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// reverseZoneV4 is the reverse zone covering the CGNAT range from which
+	// Tailscale assigns IPv4 addresses.
+	reverseZoneV4 = "100.in-addr.arpa."
+
+	// reverseZoneV6 is the reverse zone covering the ULA range from which
+	// Tailscale assigns IPv6 addresses.
+	reverseZoneV6 = "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa."
+)
+
+var (
+	// cgnatPrefix from which Tailscale assigns IPv4 addresses.
+	cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+	// ulaPrefix from which Tailscale assigns IPv6 addresses.
+	ulaPrefix = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+
+	// wellKnownPrefix is the default DNS64 prefix, per RFC 6052.
+	wellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
 )
 
 type record struct {
 	name   string
 	v4, v6 []netip.Addr
+
+	// host is the peer's host name if it is overridden by a name tag, rather
+	// than taken from its MagicDNS name.
+	host string
+
+	// rrs are any additional records owned by the name, such as PTR records
+	// in the reverse zones.
+	rrs []dns.RR
+
+	// ttl, if not zero, overrides the TTL of the peer's address and CNAME
+	// records, as for ephemeral peers.
+	ttl uint32
+
+	// owner, if not zero, is the user owning the untagged peer, who alone can
+	// see the record in the personal zone.
+	owner tailcfg.UserID
+
+	// keyExpiry, if not zero, is when the peer's key expires, past which the
+	// TTLs of its address and CNAME records don't reach.
+	keyExpiry time.Time
 }
 
 func (r *record) String() string {
 	if r == nil {
 		return "<nil>"
 	}
+	if len(r.rrs) > 0 {
+		return fmt.Sprintf("A: %v AAAA: %v CNAME: %v RRs: %v", r.v4, r.v6, r.name, r.rrs)
+	}
 	return fmt.Sprintf("A: %v AAAA: %v CNAME: %v", r.v4, r.v6, r.name)
 }
 
+// hostName returns the host name of the peer with the record.
+func (r *record) hostName() string {
+	if r.host != "" {
+		return r.host
+	}
+	return peerDNSHostname(r.name)
+}
+
+// typed returns the additional records of type qt owned by the record. All
+// additional records are returned for ANY.
+func (r *record) typed(qt uint16) []dns.RR {
+	if r == nil {
+		return nil
+	}
+	if qt == dns.TypeANY {
+		return r.rrs
+	}
+	var ret []dns.RR
+	for _, rr := range r.rrs {
+		if rr.Header().Rrtype == qt {
+			ret = append(ret, rr)
+		}
+	}
+	return ret
+}
+
 type records map[string]*record
 
+// in returns the records whose names belong to zone, rather than to a more
+// specific zone.
+func (r records) in(c *Config, zone string) records {
+	ret := make(records)
+	for name, rec := range r {
+		if c.zoneOf(name) == zone {
+			ret[name] = rec
+		}
+	}
+	return ret
+}
+
 func (r records) String() string {
 	if len(r) == 0 {
 		return "records: [ ]"
@@ -48,53 +145,441 @@ func (r records) String() string {
 	return "records: [\n" + strings.Join(rs, "\n") + "\n]"
 }
 
-func answer(req *dns.Msg) *dns.Msg {
+// answer returns a reply to req, with the header flags configured by config.
+func answer(config *Config, req *dns.Msg) *dns.Msg {
 	ans := &dns.Msg{}
 	ans.SetReply(req)
-	ans.Authoritative = true
-	ans.RecursionAvailable = false
+	ans.Authoritative = !config.NoAuthoritative
+	ans.RecursionAvailable = config.RecursionAvailable
 	ans.Compress = true
 	return ans
 }
 
-func assemblePeer(config *Config, peer *ipnstate.PeerStatus, r records) *record {
+// rank of a name claimed by a peer. Peers claiming the same name are served
+// under it in order of rank, lowest first.
+type rank int
+
+const (
+	rankHost    rank = iota // the host name taken from the peer's MagicDNS name.
+	rankNameTag             // a host name given by a name tag.
+	rankAlias               // an alias tag, or a name declared by a capability.
+)
+
+// claim of a peer on a name, whose records are written into r by write.
+type claim struct {
+	name  string
+	rank  rank
+	peer  *ipnstate.PeerStatus
+	write func(r records)
+}
+
+// settle writes the records of the claims which win their names into r. Of the
+// peers claiming a name, the one claiming it with the lowest rank wins, and
+// then the one with the lowest stable node ID, so that the outcome doesn't
+// depend on the order in which peers are assembled. The names each peer wins
+// are written in the order it claimed them, so the first written is its first
+// name.
+func settle(claims []claim, r records) {
+	byPeer := func(a, b claim) int {
+		if c := cmp.Compare(a.peer.ID, b.peer.ID); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.peer.DNSName, b.peer.DNSName)
+	}
+	order := make([]int, len(claims))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		a, b := claims[i], claims[j]
+		if c := cmp.Compare(a.name, b.name); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.rank, b.rank); c != 0 {
+			return c
+		}
+		return byPeer(a, b)
+	})
+	var won []int
+	for _, i := range order {
+		if n := len(won); n > 0 && claims[won[n-1]].name == claims[i].name {
+			if w := claims[won[n-1]]; claims[i].peer != w.peer {
+				log.Warningf("Name %s of %s conflicts with %s; skipping", w.name, claims[i].peer.DNSName, w.peer.DNSName)
+			}
+			continue
+		}
+		won = append(won, i)
+	}
+	slices.Sort(won)
+	slices.SortStableFunc(won, func(i, j int) int {
+		return byPeer(claims[i], claims[j])
+	})
+	for _, i := range won {
+		claims[i].write(r)
+	}
+}
+
+// assemblePeer assembles the records of peer, returning its host record and
+// its claims on the names it is served under, which are only written once
+// settled against those of other peers. Records which aren't claimed, such as
+// the addresses of apex peers, are added to r directly.
+func assemblePeer(config *Config, peer *ipnstate.PeerStatus, hi tailcfg.HostinfoView, caps tailcfg.PeerCapMap, login, owner string, r records) (*record, []claim) {
 	if peer == nil || peer.DNSName == "" {
 		// Peer is nil, or does not have a DNSName. Either case will make serving
 		// CNAMEs problematic. Better to skip adding it to the hosts map, so we
 		// don't serve anything about it (or worse).
-		return nil
+		return nil, nil
 	}
 
 	tsdns := dns.CanonicalName(peer.DNSName)
-	phn := peerDNSHostname(tsdns)
+	phn := peerHostname(config, peer)
 	if phn == "" {
 		// Could not extract the host name from the peer's DNS name. Log it, and
 		// then skip it, as well.
 		log.Warningf("Failed to extract a hostname from peer %q", tsdns)
-		return nil
+		return nil, nil
 	}
 
 	host := &record{name: tsdns}
+	if phn != peerDNSHostname(tsdns) {
+		host.host = phn
+	}
 	host.v4, host.v6 = bucketAddrs(peer.TailscaleIPs)
+	if ephemeral(config, peer) {
+		host.ttl = uint32(config.EphemeralTTL.Seconds())
+	}
+	if config.KeyExpiryTTL && peer.KeyExpiry != nil {
+		host.keyExpiry = *peer.KeyExpiry
+	}
+	if config.DNS64.IsValid() && len(host.v6) == 0 {
+		for _, addr := range host.v4 {
+			host.v6 = append(host.v6, synthesize(config.DNS64, addr))
+		}
+	}
+	if config.Metadata {
+		if txt := metadata(config, tsdns, peer, hi); txt != nil {
+			host.rrs = append(host.rrs, txt)
+		}
+	}
+	if config.TagsTXT {
+		if txt := tagList(config, tsdns, peer); txt != nil {
+			host.rrs = append(host.rrs, txt)
+		}
+	}
+	if len(config.NodeAttrs) > 0 {
+		if txt := nodeAttrs(config, tsdns, peer); txt != nil {
+			host.rrs = append(host.rrs, txt)
+		}
+	}
+	if config.HINFO {
+		if hinfo := hostInfo(config, tsdns, peer, hi); hinfo != nil {
+			host.rrs = append(host.rrs, hinfo)
+		}
+	}
+	decl := declared(config, tsdns, caps)
+	if len(decl.TXT) > 0 {
+		host.rrs = append(host.rrs, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   tsdns,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    config.ttl(),
+			},
+			Txt: decl.TXT,
+		})
+	}
+
+	// The peer is also served under any aliases it is tagged with or declares,
+	// wherever it is served under its host name.
+	hostNames := []string{phn}
+	for _, alias := range append(tagNames(peer, config.AliasTagPrefix), decl.Names...) {
+		if !slices.Contains(hostNames, alias) {
+			hostNames = append(hostNames, alias)
+		}
+	}
+	rankOf := func(hn string) rank {
+		switch {
+		case hn != phn:
+			return rankAlias
+		case host.host != "":
+			return rankNameTag
+		}
+		return rankHost
+	}
+
+	// Assemble the default zone records, unless the peer lacks a required
+	// tag. Names in the DefaultZone come first.
+	var names []claim
+	add := func(hn, name string) {
+		names = append(names, claim{name: name, rank: rankOf(hn), peer: peer})
+	}
+	if required(config, peer) {
+		for _, zone := range config.defaultZones() {
+			for _, hn := range hostNames {
+				add(hn, config.hostName(hn, "", zone))
+			}
+		}
+	}
+
+	// Assemble the zone records of the peer's owner, if the user has one.
+	if zone := config.Users[strings.ToLower(login)]; zone != "" {
+		for _, hn := range hostNames {
+			add(hn, config.hostName(hn, "", zone))
+		}
+	}
 
-	// Assemble the default zone record.
-	r[dns.CanonicalName(fmt.Sprintf("%s.%s", phn, config.DefaultZone))] = host
+	// Assemble the records of the peer beneath its owner's label in the owner
+	// zone, unless it is tagged, and so owned by no one.
+	if zone := config.OwnerZone; zone != "" && owner != "" && (peer.Tags == nil || peer.Tags.Len() == 0) {
+		for _, hn := range hostNames {
+			add(hn, dns.CanonicalName(fmt.Sprintf("%s.%s.%s", hn, owner, zone)))
+		}
+	}
+
+	// Assemble the zone records of the peer's operating system, if it has one.
+	if zone := config.OSZones[osName(peer.OS)]; zone != "" {
+		for _, hn := range hostNames {
+			add(hn, config.hostName(hn, "", zone))
+		}
+	}
+
+	// Assemble the zone records of the capabilities granted to the peer.
+	for _, zone := range config.capabilityZones(caps) {
+		for _, hn := range hostNames {
+			add(hn, config.hostName(hn, "", zone))
+		}
+	}
+
+	// Assemble the personal zone records. Those of untagged peers are only
+	// visible to their owners, so they are kept apart from the others.
+	var owned *record
+	if zone := config.PersonalZone; zone != "" {
+		for _, hn := range hostNames {
+			add(hn, config.hostName(hn, "", zone))
+		}
+		if peer.Tags == nil || peer.Tags.Len() == 0 {
+			o := *host
+			o.owner = peer.UserID
+			owned = &o
+		}
+	}
 
 	// Assemble any additional zone records based on tags.
 	if peer.Tags == nil {
 		log.Debugf("Peer %s has no Tags", tsdns)
-		return host
+	} else {
+		var located bool
+		for _, tag := range peer.Tags.AsSlice() {
+			tag = strings.TrimPrefix(tag, "tag:")
+			for _, hn := range hostNames {
+				if zone := config.Zones[tag]; zone != "" {
+					add(hn, config.hostName(hn, tag, zone))
+				}
+				if label := config.Labels[tag]; label != "" {
+					for _, zone := range config.defaultZones() {
+						add(hn, dns.CanonicalName(fmt.Sprintf("%s.%s.%s", hn, label, zone)))
+					}
+				}
+			}
+			if zone := config.Apex[tag]; zone != "" {
+				merge(r, addresses(config, zone, append(host.v4[:len(host.v4):len(host.v4)], host.v6...)))
+			}
+			// A peer can only be in one place, so the first location wins.
+			if loc, has := config.Locations[tag]; has && !located {
+				host.rrs = append(host.rrs, location(config, tsdns, loc))
+				located = true
+			}
+		}
 	}
-	for _, tag := range peer.Tags.AsSlice() {
+
+	var services []tailcfg.Service
+	if hi.Valid() {
+		services = hi.Services().AsSlice()
+	}
+	var facts []string
+	if config.Posture {
+		facts = posture(peer, hi)
+	}
+	// The reverse records point at the first name the peer wins: its default
+	// zone name, or else the first other it isn't beaten to.
+	var reversed bool
+	for i := range names {
+		name := names[i].name
+		names[i].write = func(r records) {
+			if config.Reverse && !reversed {
+				assembleReverse(config, name, peer.TailscaleIPs, r)
+				reversed = true
+			}
+			rec := host
+			if owned != nil && config.zoneOf(name) == config.PersonalZone {
+				rec = owned
+			}
+			r[name] = rec
+			if config.Wildcard {
+				r["*."+name] = rec
+			}
+			assembleServices(config, name, tsdns, services, r)
+			assembleDeclaredServices(config, name, tsdns, decl, r)
+			if config.Posture {
+				assemblePosture(config, name, facts, r)
+			}
+			if peer.Tags != nil {
+				assembleTaggedServices(config, config.zoneOf(name), tsdns, peer.Tags.AsSlice(), r)
+			}
+		}
+	}
+
+	// Assemble the funnel zone records of a peer with Funnel enabled. They
+	// alias its MagicDNS name, whatever the answer mode, since its addresses
+	// on the tailnet are of no use from the internet.
+	if zone := config.FunnelZone; zone != "" && hi.Valid() && hi.TailscaleFunnelEnabled() {
+		for _, hn := range hostNames {
+			name := config.hostName(hn, "", zone)
+			names = append(names, claim{name: name, rank: rankOf(hn), peer: peer, write: func(r records) {
+				r[name] = &record{
+					rrs: []dns.RR{
+						&dns.CNAME{
+							Hdr: dns.RR_Header{
+								Name:   name,
+								Rrtype: dns.TypeCNAME,
+								Class:  dns.ClassINET,
+								Ttl:    config.ttl(),
+							},
+							Target: tsdns,
+						},
+					},
+				}
+			}})
+		}
+	}
+	return host, names
+}
+
+// assembleTaggedServices assembles SRV records for the tagged services offered
+// by a peer carrying tags, in zone. The SRV records of all peers offering a
+// service are merged.
+func assembleTaggedServices(config *Config, zone, target string, tags []string, r records) {
+	for _, tag := range tags {
 		tag = strings.TrimPrefix(tag, "tag:")
-		if zone := config.Zones[tag]; zone != "" {
-			r[dns.CanonicalName(fmt.Sprintf("%s.%s", phn, zone))] = host
+		for _, svc := range config.TaggedServices {
+			if svc.Tag != tag {
+				continue
+			}
+			owner := dns.CanonicalName(fmt.Sprintf("_%s._%s.%s", svc.Name, svc.Proto, zone))
+			srv := &dns.SRV{
+				Hdr: dns.RR_Header{
+					Name:   owner,
+					Rrtype: dns.TypeSRV,
+					Class:  dns.ClassINET,
+					Ttl:    config.ttl(),
+				},
+				Port:   svc.Port,
+				Target: target,
+			}
+			// A peer with several names in the zone advertises it only once.
+			var dup bool
+			if rec := r[owner]; rec != nil {
+				for _, rr := range rec.rrs {
+					dup = dup || dns.IsDuplicate(rr, srv)
+				}
+			}
+			if !dup {
+				merge(r, []dns.RR{srv})
+			}
+		}
+	}
+}
+
+// assembleServices assembles SRV records for the configured services which the
+// peer advertises, under the peer's name. The SRV records target the peer's
+// MagicDNS name, since the name itself is a CNAME.
+func assembleServices(config *Config, name, target string, services []tailcfg.Service, r records) {
+	seen := make(map[string]bool)
+	for _, svc := range services {
+		port := fmt.Sprintf("%d/%s", svc.Port, svc.Proto)
+		sn := config.Services[port]
+		if sn == "" || seen[port] {
+			continue
+		}
+		seen[port] = true
+		owner := dns.CanonicalName(fmt.Sprintf("_%s._%s.%s", sn, svc.Proto, name))
+		r[owner] = &record{
+			rrs: []dns.RR{
+				&dns.SRV{
+					Hdr: dns.RR_Header{
+						Name:   owner,
+						Rrtype: dns.TypeSRV,
+						Class:  dns.ClassINET,
+						Ttl:    config.ttl(),
+					},
+					Port:   svc.Port,
+					Target: target,
+				},
+			},
+		}
+	}
+}
+
+func assembleReverse(config *Config, target string, addrs []netip.Addr, r records) {
+	for _, addr := range addrs {
+		rn := reverseName(addr)
+		if rn == "" {
+			continue
+		}
+		r[rn] = &record{
+			rrs: []dns.RR{
+				&dns.PTR{
+					Hdr: dns.RR_Header{
+						Name:   rn,
+						Rrtype: dns.TypePTR,
+						Class:  dns.ClassINET,
+						Ttl:    config.ttl(),
+					},
+					Ptr: target,
+				},
+			},
 		}
 	}
-	return host
 }
 
-func assemble(config *Config, self *ipnstate.PeerStatus, peers []*ipnstate.PeerStatus) records {
+// merge records into the assembled records. Records for peers are shared
+// between names, so existing records are copied rather than modified.
+func merge(r records, rrs []dns.RR) {
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		nr := &record{}
+		if prev := r[name]; prev != nil {
+			*nr = *prev
+			nr.rrs = append(nr.rrs[:len(nr.rrs):len(nr.rrs)], rr)
+		} else {
+			nr.rrs = []dns.RR{rr}
+		}
+		r[name] = nr
+	}
+}
+
+// assembleAliases adds the configured aliases of peers to r. In each zone in
+// which a peer is served by its host name, the alias is served as the same
+// peer, so it follows the peer as its addresses change. Names of peers take
+// precedence over aliases.
+func assembleAliases(config *Config, r records) {
+	for alias, host := range config.Aliases {
+		for zone := range config.fastZoneLookup {
+			hr := r[dns.CanonicalName(host+"."+zone)]
+			if hr == nil || hr.name == "" {
+				continue
+			}
+			name := dns.CanonicalName(alias + "." + zone)
+			if prev := r[name]; prev != nil {
+				log.Warningf("Alias %q conflicts with existing records; skipping", name)
+				continue
+			}
+			r[name] = hr
+		}
+	}
+}
+
+func assemble(config *Config, self *ipnstate.PeerStatus, peers []*ipnstate.PeerStatus, hostinfo map[tailcfg.StableNodeID]tailcfg.HostinfoView, caps map[tailcfg.StableNodeID]tailcfg.PeerCapMap, users map[tailcfg.UserID]tailcfg.UserProfile) records {
 	if config.DefaultZone == "" {
 		// If no default zone is configured, nothing will work anyway. This
 		// should not have been permitted by the config parser.
@@ -102,25 +587,511 @@ func assemble(config *Config, self *ipnstate.PeerStatus, peers []*ipnstate.PeerS
 		return nil
 	}
 	r := make(records)
+	var claims []claim
+	sharedConfig := config.sharedConfig()
+	owners := ownerLabels(config, users)
 	for _, peer := range peers {
-		_ = assemblePeer(config, peer, r)
+		if peer == nil || excluded(config, peer) {
+			continue
+		}
+		pc := config
+		if shared(self, peer) {
+			switch config.Shared {
+			case SharedExclude:
+				continue
+			case SharedOwnZone:
+				pc = sharedConfig
+			}
+		}
+		login := users[peer.UserID].LoginName
+		hr, names := assemblePeer(pc, peer, hostinfo[peer.ID], caps[peer.ID], login, owners[login], r)
+		claims = append(claims, names...)
+		if label := nameserverLabel(pc, peer); hr != nil && label != "" {
+			for zone := range config.fastZoneLookup {
+				r[dns.CanonicalName(fmt.Sprintf("%s.ns.%s", label, zone))] = hr
+			}
+		}
 	}
 	// Insert all records for self as a peer so that queries for the NS from
-	// other hosts will succeed.
-	sr := assemblePeer(config, self, r)
+	// other hosts will succeed. If self is excluded as a host, its records are
+	// only used for the nameserver names. If it is limited to some zones, only
+	// its claims and records in those are kept. Its claims are settled along
+	// with those of the peers.
+	var selfHostinfo tailcfg.HostinfoView
+	var selfCaps tailcfg.PeerCapMap
+	var selfLogin string
+	if self != nil {
+		selfHostinfo = hostinfo[self.ID]
+		selfCaps = caps[self.ID]
+		selfLogin = users[self.UserID].LoginName
+	}
+	into := r
+	if config.ExcludeSelf || len(config.SelfZones) > 0 {
+		into = make(records)
+	}
+	sr, names := assemblePeer(config, self, selfHostinfo, selfCaps, selfLogin, owners[selfLogin], into)
+	if !config.ExcludeSelf {
+		for _, c := range names {
+			if len(config.SelfZones) == 0 || config.SelfZones[config.zoneOf(c.name)] {
+				claims = append(claims, c)
+			}
+		}
+	}
+	settle(claims, r)
+	if !config.ExcludeSelf && len(config.SelfZones) > 0 {
+		for name, rec := range into {
+			if config.SelfZones[config.zoneOf(name)] {
+				merge(r, rec.rrs)
+			}
+		}
+	}
+	assembleAliases(config, r)
+	merge(r, config.Records)
 	if sr == nil {
 		log.Errorf("Assembled Self record is nil; it is likely that invalid data will be served!")
 		return r
 	}
 
 	// Generate ns hosts for each zone covered, and set to self. This is used in
-	// serving SOA.
+	// serving SOA. Names overridden to hosts outside of the served zones are
+	// someone else's business, as are all of them without authority.
+	if config.NoAuthority {
+		return r
+	}
 	for zone := range config.fastZoneLookup {
-		r[dns.CanonicalName(fmt.Sprintf("ns.%s", zone))] = sr
+		if ns := config.nsName(zone); config.zoneOf(ns) != "" {
+			r[ns] = sr
+		}
 	}
 	return r
 }
 
+// nonTerminals adds empty records for the empty non-terminals in r, which are
+// names owning no records but with names below them. Such names exist, so
+// queries for them are answered with NODATA rather than NXDOMAIN, per RFC 8020.
+func nonTerminals(config *Config, r records) {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		zone := config.zoneOf(name)
+		if zone == "" {
+			continue
+		}
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			parent := name[off:]
+			if len(parent) <= len(zone) {
+				break
+			}
+			if _, exists := r[parent]; !exists {
+				r[parent] = &record{}
+			}
+		}
+	}
+}
+
+// required returns true if peer carries any of the tags required of peers in
+// the default zone, or if none are required.
+func required(config *Config, peer *ipnstate.PeerStatus) bool {
+	if len(config.RequireTags) == 0 {
+		return true
+	}
+	if peer.Tags == nil {
+		return false
+	}
+	for _, tag := range peer.Tags.AsSlice() {
+		if config.RequireTags[strings.TrimPrefix(tag, "tag:")] {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded returns true if peer carries any of the excluded tags, doesn't run
+// an included operating system, or is offline, long gone or expired when such
+// peers are omitted, and so is omitted from all zones.
+func excluded(config *Config, peer *ipnstate.PeerStatus) bool {
+	if config.OnlineOnly && !peer.Online {
+		return true
+	}
+	if config.PruneAfter != 0 && stale(peer, config.PruneAfter) {
+		return true
+	}
+	if (config.ExcludeExpired || config.KeyExpiryTTL) && expired(peer) {
+		return true
+	}
+	if os := osName(peer.OS); config.ExcludeOS[os] || len(config.IncludeOS) > 0 && !config.IncludeOS[os] {
+		return true
+	}
+	if len(config.ExcludeTags) == 0 || peer.Tags == nil {
+		return false
+	}
+	for _, tag := range peer.Tags.AsSlice() {
+		if config.ExcludeTags[strings.TrimPrefix(tag, "tag:")] {
+			return true
+		}
+	}
+	return false
+}
+
+// ephemeral returns true if peer carries any of the tags of ephemeral peers.
+func ephemeral(config *Config, peer *ipnstate.PeerStatus) bool {
+	if len(config.EphemeralTags) == 0 || peer.Tags == nil {
+		return false
+	}
+	for _, tag := range peer.Tags.AsSlice() {
+		if config.EphemeralTags[strings.TrimPrefix(tag, "tag:")] {
+			return true
+		}
+	}
+	return false
+}
+
+// expired returns true if the node key of peer has expired.
+func expired(peer *ipnstate.PeerStatus) bool {
+	return peer.Expired || peer.KeyExpiry != nil && peer.KeyExpiry.Before(time.Now())
+}
+
+// ownerLabel returns the label under which the peers of the user with the
+// login name are grouped, formed from the part of it before any @, or an
+// empty string if no valid label can be formed.
+func ownerLabel(config *Config, login string) string {
+	name, _, _ := strings.Cut(login, "@")
+	return dnsname.SanitizeLabel(normalize(config.Normalize, name))
+}
+
+// loginLabel returns a label formed from the whole login name, domain and all,
+// as alice-example-com.
+func loginLabel(config *Config, login string) string {
+	return dnsname.SanitizeLabel(normalize(config.Normalize, strings.NewReplacer("@", "-", ".", "-").Replace(login)))
+}
+
+// ownerLabels returns the labels under which the peers of users are grouped in
+// the owner zone, by login name. Users whose logins differ only after the @,
+// such as those from other domains whose nodes are shared in, are told apart by
+// labels formed from their whole logins. Any whose labels still collide with
+// another's are left out, so that no one's peers are served as another's.
+func ownerLabels(config *Config, users map[tailcfg.UserID]tailcfg.UserProfile) map[string]string {
+	if config.OwnerZone == "" {
+		return nil
+	}
+	logins := make(map[string][]string) // by label.
+	for _, user := range users {
+		label := ownerLabel(config, user.LoginName)
+		if label != "" && !slices.Contains(logins[label], user.LoginName) {
+			logins[label] = append(logins[label], user.LoginName)
+		}
+	}
+	labels := make(map[string]string)
+	for label, ls := range logins {
+		if len(ls) == 1 {
+			labels[ls[0]] = label
+			continue
+		}
+		for _, login := range ls {
+			if l := loginLabel(config, login); l != "" {
+				labels[login] = l
+			}
+		}
+	}
+	owners := make(map[string][]string) // by label.
+	for login, label := range labels {
+		owners[label] = append(owners[label], login)
+	}
+	for label, ls := range owners {
+		if len(ls) == 1 {
+			continue
+		}
+		slices.Sort(ls)
+		log.Warningf("Owner label %q of %s conflicts; skipping", label, strings.Join(ls, ", "))
+		for _, login := range ls {
+			delete(labels, login)
+		}
+	}
+	return labels
+}
+
+// shared returns true if peer belongs to another tailnet than self, either
+// shared into it or owned by a user it is shared with. Peers shared in keep
+// their MagicDNS names in their own tailnet's domain.
+func shared(self, peer *ipnstate.PeerStatus) bool {
+	if peer.ShareeNode {
+		return true
+	}
+	if self == nil {
+		return false
+	}
+	_, domain, _ := strings.Cut(dns.CanonicalName(self.DNSName), ".")
+	return domain != "" && !dns.IsSubDomain(domain, dns.CanonicalName(peer.DNSName))
+}
+
+// sharedConfig returns the configuration under which peers of other tailnets
+// are assembled when they are served in a zone of their own. They are served
+// there under their host names alone, since the tags and users of another
+// tailnet mean nothing in this one, so only the options shaping the records of
+// a peer are carried over; any others are left unset, including those added
+// later. Nil is returned for other modes.
+func (c *Config) sharedConfig() *Config {
+	if c.Shared != SharedOwnZone {
+		return nil
+	}
+	return &Config{
+		DefaultZone:    c.SharedZone,
+		ReloadInterval: c.ReloadInterval,
+		TTL:            c.TTL,
+		Templates:      c.Templates,
+		LabelSource:    c.LabelSource,
+		Normalize:      c.Normalize,
+		Reverse:        c.Reverse,
+		Wildcard:       c.Wildcard,
+		Metadata:       c.Metadata,
+		TagsTXT:        c.TagsTXT,
+		HINFO:          c.HINFO,
+		NodeAttrs:      c.NodeAttrs,
+		Services:       c.Services,
+		Posture:        c.Posture,
+		DNS64:          c.DNS64,
+		KeyExpiryTTL:   c.KeyExpiryTTL,
+		fastZoneLookup: c.fastZoneLookup,
+	}
+}
+
+// stale returns true if peer is offline, and was last seen longer ago than
+// after. Peers never seen are kept, since nothing is known of them, as are
+// online peers, whose LastSeen isn't kept up to date.
+func stale(peer *ipnstate.PeerStatus, after time.Duration) bool {
+	return !peer.Online && !peer.LastSeen.IsZero() && time.Since(peer.LastSeen) > after
+}
+
+// nameserverLabel returns the host name of peer if it is tagged as a
+// nameserver, or an empty string otherwise.
+func nameserverLabel(config *Config, peer *ipnstate.PeerStatus) string {
+	if config.NameserverTag == "" || peer == nil || peer.Tags == nil {
+		return ""
+	}
+	for _, tag := range peer.Tags.AsSlice() {
+		if strings.TrimPrefix(tag, "tag:") == config.NameserverTag {
+			return peerHostname(config, peer)
+		}
+	}
+	return ""
+}
+
+// nameserverLabels returns the sorted host names of peers tagged as
+// nameservers. Self is excluded, since it is always ns.<zone>.
+func nameserverLabels(config *Config, peers []*ipnstate.PeerStatus) []string {
+	var labels []string
+	for _, peer := range peers {
+		if peer == nil || excluded(config, peer) {
+			continue
+		}
+		if label := nameserverLabel(config, peer); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// metadata assembles a TXT record describing the peer, or returns nil if
+// there is nothing to describe. The record is owned by the peer's MagicDNS
+// name, and renamed when served. The Tailscale version is taken from the
+// peer's Hostinfo, which is only known from the network map.
+func metadata(config *Config, tsdns string, peer *ipnstate.PeerStatus, hi tailcfg.HostinfoView) dns.RR {
+	var txt []string
+	if peer.ID != "" {
+		txt = append(txt, fmt.Sprintf("id=%s", peer.ID))
+	}
+	if peer.OS != "" {
+		txt = append(txt, fmt.Sprintf("os=%s", peer.OS))
+	}
+	if hi.Valid() && hi.IPNVersion() != "" {
+		txt = append(txt, fmt.Sprintf("version=%s", hi.IPNVersion()))
+	}
+	if !peer.Created.IsZero() {
+		txt = append(txt, fmt.Sprintf("created=%s", peer.Created.UTC().Format(time.RFC3339)))
+	}
+	if len(txt) == 0 {
+		return nil
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   tsdns,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    config.ttl(),
+		},
+		Txt: txt,
+	}
+}
+
+// tagList assembles a TXT record listing the ACL tags of the peer, without
+// their "tag:" prefix, or returns nil if it has none. The record is owned by
+// the peer's MagicDNS name, and renamed when served.
+func tagList(config *Config, tsdns string, peer *ipnstate.PeerStatus) dns.RR {
+	if peer.Tags == nil || peer.Tags.Len() == 0 {
+		return nil
+	}
+	tags := make([]string, peer.Tags.Len())
+	for i, tag := range peer.Tags.AsSlice() {
+		tags[i] = strings.TrimPrefix(tag, "tag:")
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   tsdns,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    config.ttl(),
+		},
+		Txt: []string{"tags=" + strings.Join(tags, ",")},
+	}
+}
+
+// nodeAttrs assembles a TXT record listing the allowed node attributes of the
+// peer, or returns nil if it has none. The record is owned by the peer's
+// MagicDNS name, and renamed when served.
+func nodeAttrs(config *Config, tsdns string, peer *ipnstate.PeerStatus) dns.RR {
+	var txt []string
+	for _, attr := range peer.Capabilities {
+		name, _, _ := strings.Cut(attr, "?")
+		if !config.NodeAttrs[name] {
+			continue
+		}
+		if s := "attr=" + attr; len(s) <= 255 {
+			txt = append(txt, s)
+		}
+	}
+	if len(txt) == 0 {
+		return nil
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   tsdns,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    config.ttl(),
+		},
+		Txt: txt,
+	}
+}
+
+// posture returns key=value strings of facts about the peer's posture: the
+// version of Tailscale it runs, if known, when its key expires, and whether it
+// has already expired. Whether an update is available isn't among them: at this
+// version of Tailscale, tailscaled only hears of updates for its own node, and
+// then only as they are announced on the IPN bus, so it is never known for
+// peers.
+func posture(peer *ipnstate.PeerStatus, hi tailcfg.HostinfoView) []string {
+	var txt []string
+	if hi.Valid() && hi.IPNVersion() != "" {
+		txt = append(txt, "version="+hi.IPNVersion())
+	}
+	if peer.KeyExpiry != nil {
+		txt = append(txt, "key-expiry="+peer.KeyExpiry.UTC().Format(time.RFC3339))
+	} else {
+		txt = append(txt, "key-expiry=never")
+	}
+	if peer.Expired {
+		txt = append(txt, "expired=true")
+	}
+	return txt
+}
+
+// assemblePosture assembles a TXT record of the peer's posture facts at
+// _posture beneath its name.
+func assemblePosture(config *Config, name string, txt []string, r records) {
+	owner := "_posture." + name
+	r[owner] = &record{
+		rrs: []dns.RR{
+			&dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   owner,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    config.ttl(),
+				},
+				Txt: txt,
+			},
+		},
+	}
+}
+
+// hostInfo assembles a HINFO record describing the peer's platform, or returns
+// nil if nothing is known about it. The record is owned by the peer's MagicDNS
+// name, and renamed when served.
+func hostInfo(config *Config, tsdns string, peer *ipnstate.PeerStatus, hi tailcfg.HostinfoView) dns.RR {
+	var cpu string
+	os := peer.OS
+	if hi.Valid() {
+		cpu = hi.Machine()
+		if cpu == "" {
+			cpu = hi.GoArch()
+		}
+		if os == "" {
+			os = hi.OS()
+		}
+		if v := hi.OSVersion(); v != "" {
+			os = fmt.Sprintf("%s %s", os, v)
+		}
+	}
+	if cpu == "" && os == "" {
+		return nil
+	}
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   tsdns,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    config.ttl(),
+		},
+		Cpu: cpu,
+		Os:  os,
+	}
+}
+
+// location assembles a LOC record for a peer. The record is owned by the peer's
+// MagicDNS name, and renamed when served.
+func location(config *Config, tsdns string, loc Location) dns.RR {
+	return &dns.LOC{
+		Hdr: dns.RR_Header{
+			Name:   tsdns,
+			Rrtype: dns.TypeLOC,
+			Class:  dns.ClassINET,
+			Ttl:    config.ttl(),
+		},
+		// Default size and precisions from RFC 1876.
+		Size:      0x12,
+		HorizPre:  0x16,
+		VertPre:   0x13,
+		Latitude:  uint32(int64(dns.LOC_EQUATOR) + int64(math.Round(loc.Latitude*dns.LOC_DEGREES))),
+		Longitude: uint32(int64(dns.LOC_PRIMEMERIDIAN) + int64(math.Round(loc.Longitude*dns.LOC_DEGREES))),
+		Altitude:  uint32(math.Round((loc.Altitude + dns.LOC_ALTITUDEBASE) * 100)),
+	}
+}
+
+// addresses assembles A and AAAA records owned by name for the valid addresses
+// in addrs.
+func addresses(config *Config, name string, addrs []netip.Addr) []dns.RR {
+	ttl := config.ttl()
+	var rrs []dns.RR
+	for _, addr := range addrs {
+		switch {
+		case addr.Is4():
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   addr.AsSlice(),
+			})
+		case addr.Is6():
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: addr.AsSlice(),
+			})
+		}
+	}
+	return rrs
+}
+
 func bucketAddrs(addrs []netip.Addr) (v4, v6 []netip.Addr) {
 	for i := range addrs {
 		if !addrs[i].IsValid() {
@@ -131,12 +1102,93 @@ func bucketAddrs(addrs []netip.Addr) (v4, v6 []netip.Addr) {
 			v4 = append(v4, addrs[i])
 			continue
 		}
-		if addrs[i].Is6() {
-			v6 = append(v6, addrs[i])
+		if addrs[i].Is6() {
+			v6 = append(v6, addrs[i])
+			continue
+		}
+	}
+	return
+}
+
+// synthesize returns the IPv6 address with the IPv4 address addr embedded in
+// prefix, as described by RFC 6052 section 2.2. Bits 64 to 71 of the address
+// are reserved, and skipped.
+func synthesize(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	b := prefix.Addr().As16()
+	i := prefix.Bits() / 8
+	for _, octet := range addr.As4() {
+		if i == 8 {
+			i++
+		}
+		b[i] = octet
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// peerHostname returns the host name under which peer is served. It is taken
+// from the peer's MagicDNS name, or its OS host name per the label source,
+// unless name tags are enabled and the peer carries one, such as
+// tag:dns-name-mail for the host name mail.
+func peerHostname(config *Config, peer *ipnstate.PeerStatus) string {
+	if names := tagNames(peer, config.NameTagPrefix); len(names) > 0 {
+		return names[0]
+	}
+	if config.LabelSource == LabelHostName {
+		// Sanitized as tailscaled does, after normalization, so that Unicode
+		// host names can still be converted to punycode.
+		label := dnsname.FirstLabel(dnsname.TrimCommonSuffixes(peer.HostName))
+		return dnsname.SanitizeLabel(normalize(config.Normalize, label))
+	}
+	return normalize(config.Normalize, peerDNSHostname(dns.CanonicalName(peer.DNSName)))
+}
+
+// normalize applies the configured normalization to a host name label. When
+// converting to punycode, Unicode characters are kept for it rather than
+// stripped, and invalid characters are stripped first so that they don't end
+// up encoded.
+func normalize(n Normalization, label string) string {
+	if n.Strip {
+		label = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+				return r
+			}
+			if n.Punycode && r > unicode.MaxASCII && unicode.In(r, unicode.L, unicode.N) {
+				return r
+			}
+			return -1
+		}, label)
+		label = strings.Trim(label, "-")
+	}
+	if n.Punycode {
+		if ascii, err := idna.Punycode.ToASCII(label); err == nil {
+			label = ascii
+		}
+	}
+	return label
+}
+
+// tagNames returns the host names given by the ACL tags of peer with prefix,
+// such as grafana for tag:dns-alias-grafana. Tags which don't give a valid host
+// name are ignored, as are all tags if prefix is empty.
+func tagNames(peer *ipnstate.PeerStatus, prefix string) []string {
+	if prefix == "" || peer.Tags == nil {
+		return nil
+	}
+	var names []string
+	for _, tag := range peer.Tags.AsSlice() {
+		name, found := strings.CutPrefix(strings.TrimPrefix(tag, "tag:"), prefix)
+		if !found {
+			continue
+		}
+		name = strings.ToLower(name)
+		if _, ok := dns.IsDomainName(name); !ok || name == "" || strings.Contains(name, ".") {
+			log.Warningf("Ignoring invalid name tag %q of peer %q", tag, peer.DNSName)
 			continue
 		}
+		names = append(names, name)
 	}
-	return
+	return names
 }
 
 func peerDNSHostname(pdns string) string {
@@ -147,6 +1199,19 @@ func peerDNSHostname(pdns string) string {
 	return splits[0]
 }
 
+// reverseName returns the name in the reverse zones for a Tailscale address,
+// or an empty string if the address is not in a range served by this plugin.
+func reverseName(addr netip.Addr) string {
+	if !cgnatPrefix.Contains(addr) && !ulaPrefix.Contains(addr) {
+		return ""
+	}
+	rn, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return ""
+	}
+	return rn
+}
+
 func serial(when time.Time) uint32 {
 	h := fnv.New32()
 	d := make([]byte, 8)
@@ -155,18 +1220,177 @@ func serial(when time.Time) uint32 {
 	return h.Sum32()
 }
 
-func zoneFromQN(qn string) string {
-	splits := strings.SplitN(qn, ".", 2)
-	if len(splits) != 2 {
-		return ""
+// nsName returns the name of self as the nameserver of zone, which is
+// ns.<zone> unless overridden. Names which are not fully qualified are relative
+// to zone.
+func (c *Config) nsName(zone string) string {
+	name, has := c.NSNames[zone]
+	if !has {
+		name, has = c.NSNames[""]
+	}
+	if !has {
+		name = "ns"
+	}
+	if dns.IsFqdn(name) {
+		return dns.CanonicalName(name)
+	}
+	return dns.CanonicalName(fmt.Sprintf("%s.%s", name, zone))
+}
+
+// zoneOf returns the most specific zone handled by this plugin which contains
+// qn, or an empty string if there is none. Served zones may be nested, and
+// each name belongs to the most specific of them only.
+func (c *Config) zoneOf(qn string) string {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(qn, off) {
+		if zone := qn[off:]; c.fastZoneLookup[zone] {
+			return zone
+		}
+	}
+	return ""
+}
+
+// osName returns the operating system name os in canonical form, which is
+// lower case and uses the names Tailscale reports rather than Go's, such as
+// macos for darwin.
+func osName(os string) string {
+	os = strings.ToLower(os)
+	if os == "darwin" {
+		return "macos"
+	}
+	return os
+}
+
+// delegations returns the served zones which are nested directly within zone,
+// sorted, to which zone delegates.
+func (c *Config) delegations(zone string) []string {
+	var ret []string
+	for _, z := range c.zones() {
+		if z == zone {
+			continue
+		}
+		if off, end := dns.NextLabel(z, 0); !end && c.zoneOf(z[off:]) == zone {
+			ret = append(ret, z)
+		}
+	}
+	return ret
+}
+
+// defaultZones returns the zones in which all peers appear, the DefaultZone
+// first.
+func (c *Config) defaultZones() []string {
+	return append([]string{c.DefaultZone}, c.ExtraZones...)
+}
+
+// hostName returns the name in zone of the peer with host name phn, formed
+// from the zone's template if it has one. Tag is the one which placed the peer
+// in the zone, if any.
+func (c *Config) hostName(phn, tag, zone string) string {
+	label := phn
+	if tmpl := c.Templates[zone]; tmpl != "" {
+		label = strings.NewReplacer("{host}", phn, "{tag}", tag).Replace(tmpl)
 	}
-	return dns.CanonicalName(splits[1])
+	return dns.CanonicalName(fmt.Sprintf("%s.%s", label, zone))
+}
+
+// suppressed returns true if records of type rt are suppressed in zone, by its
+// record types or address family. The SOA and NS records are always served.
+func (c *Config) suppressed(zone string, rt uint16) bool {
+	if types := c.Types[zone]; len(types) > 0 && !types[rt] && rt != dns.TypeSOA && rt != dns.TypeNS {
+		return true
+	}
+	family, has := c.Families[zone]
+	if !has {
+		family = c.Families[""]
+	}
+	switch family {
+	case FamilyIPv4Only:
+		return rt == dns.TypeAAAA
+	case FamilyIPv6Only:
+		return rt == dns.TypeA
+	}
+	return false
+}
+
+// served returns rrs without the records suppressed in zone.
+func (c *Config) served(zone string, rrs []dns.RR) []dns.RR {
+	if len(c.Families) == 0 && len(c.Types) == 0 {
+		return rrs
+	}
+	return filter(rrs, func(rr dns.RR) bool {
+		return c.suppressed(zone, rr.Header().Rrtype)
+	})
+}
+
+// ttl returns the TTL of records in responses, in seconds.
+func (c *Config) ttl() uint32 {
+	if c.TTL != 0 {
+		return uint32(c.TTL.Seconds())
+	}
+	return uint32(c.ReloadInterval.Seconds())
+}
+
+// answer returns the mode in which queries for peers' addresses in zone are
+// answered.
+func (c *Config) answer(zone string) AnswerMode {
+	if mode, has := c.ZoneAnswers[zone]; has {
+		return mode
+	}
+	return c.Answer
+}
+
+// peerTTL returns the TTL of the address and CNAME records of the peer with
+// host record hr. It is cut short as the peer's key expiry approaches, if it
+// is tracked, so that they aren't cached past it.
+func (c *Config) peerTTL(hr *record) uint32 {
+	ttl := c.ttl()
+	if hr.ttl != 0 {
+		ttl = hr.ttl
+	}
+	if !hr.keyExpiry.IsZero() {
+		left := uint32(max(time.Until(hr.keyExpiry)/time.Second, 1))
+		ttl = min(ttl, left)
+	}
+	return ttl
+}
+
+// timeout returns the bound on each call to the Tailscale Local API.
+func (c *Config) timeout() time.Duration {
+	if c.Timeout != 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
 }
 
 // clientish describes the subset of the Tailscale LocalClient used in this
 // package.
 type clientish interface {
 	Status(context.Context) (*ipnstate.Status, error)
+	NetMap(context.Context) (*netmap.NetworkMap, error)
+	WhoIs(context.Context, string) (*apitype.WhoIsResponse, error)
+	WatchNetMap(context.Context, func()) error
+}
+
+// localClient adapts the Tailscale LocalClient to the clientish interface.
+type localClient struct {
+	tailscale.LocalClient
+}
+
+// NetMap fetches the current network map from the IPN bus.
+func (lc *localClient) NetMap(ctx context.Context) (*netmap.NetworkMap, error) {
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return nil, err
+		}
+		if n.NetMap != nil {
+			return n.NetMap, nil
+		}
+	}
 }
 
 // Tailscale plugin for coredns, which serves records for peer hosts in
@@ -180,20 +1404,61 @@ type Tailscale struct {
 	client clientish
 	done   chan any
 
+	// node is the embedded node which client speaks to, if any.
+	node node
+
+	// netmapChanged signals changes to the network map seen on the IPN bus, and
+	// stopWatching stops watching for them.
+	netmapChanged chan struct{}
+	stopWatching  context.CancelFunc
+
 	sync.RWMutex // protects the following.
 	hosts        records
-	serial       uint32 // 32-bit FNV hash of the time of last reload.
+	serial       uint32            // 32-bit FNV hash of the time of last change.
+	serials      map[string]uint32 // serial of each zone, keyed by zone.
+
+	reloaded  time.Time              // time of the last successful reload.
+	state     string                 // backend state of tailscaled at the last reload.
+	mods      map[string]time.Time   // modification times of the files read.
+	assembled records                // hosts as assembled at the last reload.
+	updates   []dns.RR               // records added by dynamic updates.
+	signed    map[string]*signedZone // signed zones exported by this plugin.
+
+	// resolver resolves ANAME targets outside of the served zones. The
+	// default resolver is used if nil.
+	resolver resolver
+
+	// metrics of this plugin, or nil if they are disabled.
+	metrics *metrics
+
+	// upstream queries the Upstream for the addresses of CNAME targets. A
+	// dns.Client is used if nil.
+	upstream exchanger
+
+	// self is the MagicDNS name of the node on which this plugin runs.
+	self string
+
+	// nameserverLabels are the host names of peers tagged as nameservers,
+	// which serve each zone as <label>.ns.<zone> alongside self.
+	nameserverLabels []string
+
+	exporting sync.Mutex // serializes exports.
+
+	// identities of query sources, when queries require them.
+	identities identities
+
+	rotation atomic.Uint32 // counts answers, to rotate address records.
 }
 
-func (ts *Tailscale) A(hr *record) []dns.RR {
+func (ts *Tailscale) A(zone string, hr *record) []dns.RR {
 	ans := make([]dns.RR, len(hr.v4))
 	for i, addr := range hr.v4 {
 		ans[i] = &dns.A{
 			Hdr: dns.RR_Header{
-				Name:   hr.name,
+				Name:   ts.target(zone, hr),
 				Rrtype: dns.TypeA,
 				Class:  dns.ClassINET,
-				Ttl:    uint32(ts.ReloadInterval.Seconds()),
+				Ttl:    ts.peerTTL(hr),
 			},
 			A: net.IP(addr.AsSlice()),
 		}
@@ -201,15 +1466,15 @@ func (ts *Tailscale) A(hr *record) []dns.RR {
 	return ans
 }
 
-func (ts *Tailscale) AAAA(hr *record) []dns.RR {
+func (ts *Tailscale) AAAA(zone string, hr *record) []dns.RR {
 	ans := make([]dns.RR, len(hr.v6))
 	for i, addr := range hr.v6 {
 		ans[i] = &dns.AAAA{
 			Hdr: dns.RR_Header{
-				Name:   hr.name,
+				Name:   ts.target(zone, hr),
 				Rrtype: dns.TypeAAAA,
 				Class:  dns.ClassINET,
-				Ttl:    uint32(ts.ReloadInterval.Seconds()),
+				Ttl:    ts.peerTTL(hr),
 			},
 			AAAA: net.IP(addr.AsSlice()),
 		}
@@ -219,30 +1484,99 @@ func (ts *Tailscale) AAAA(hr *record) []dns.RR {
 
 func (ts *Tailscale) authority(zone string, serial uint32) *dns.SOA {
 	ri := uint32(ts.ReloadInterval.Seconds())
-	return &dns.SOA{
+	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   zone,
 			Rrtype: dns.TypeSOA,
 			Class:  dns.ClassINET,
-			Ttl:    ri,
+			Ttl:    ts.ttl(),
 		},
-		Ns:      fmt.Sprintf("ns.%s", zone),
-		Mbox:    fmt.Sprintf("root.ns.%s", zone), // TODO: Stop lying.
+		Ns:      ts.nsName(zone),
+		Mbox:    ts.mailbox(zone),
 		Serial:  serial,
 		Refresh: ri,
 		Retry:   (ri / 2),
 		Expire:  (ri * 2),
 		Minttl:  (ri / 2),
 	}
+	// Timers which are configured, for the zone or all of them, override those
+	// derived from the ReloadInterval.
+	timers := ts.SOA
+	if zt, has := ts.ZoneSOA[zone]; has {
+		timers = zt
+	}
+	if timers.Refresh != 0 {
+		soa.Refresh = uint32(timers.Refresh.Seconds())
+	}
+	if timers.Retry != 0 {
+		soa.Retry = uint32(timers.Retry.Seconds())
+	}
+	if timers.Expire != 0 {
+		soa.Expire = uint32(timers.Expire.Seconds())
+	}
+	if timers.Minimum != 0 {
+		soa.Minttl = uint32(timers.Minimum.Seconds())
+	}
+	if ts.NegativeTTL != 0 {
+		soa.Minttl = uint32(ts.NegativeTTL.Seconds())
+	}
+	return soa
+}
+
+// negative returns the SOA record of zone for the authority section of negative
+// answers. If a NegativeTTL is configured, the record's TTL is limited to it,
+// since resolvers cache negative answers for the lesser of the two, per RFC
+// 2308 section 5.
+func (ts *Tailscale) negative(zone string, serial uint32) *dns.SOA {
+	soa := ts.authority(zone, serial)
+	if ts.NegativeTTL != 0 && soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// mailbox returns the mailbox of the person responsible for zone, as published
+// in its SOA record.
+func (ts *Tailscale) mailbox(zone string) string {
+	if mbox, has := ts.Mailboxes[zone]; has {
+		return mbox
+	}
+	if mbox, has := ts.Mailboxes[""]; has {
+		return mbox
+	}
+	return fmt.Sprintf("root.ns.%s", zone)
 }
 
 func (ts *Tailscale) poll(t *time.Ticker) {
 	log.Debug("Polling started")
 	defer log.Debug("Polling stoped")
+	var files <-chan time.Time // nil, and never ready, without any files.
+	if len(ts.files()) > 0 || ts.ZonesFile != "" {
+		ft := time.NewTicker(fileCheckInterval)
+		defer ft.Stop()
+		files = ft.C
+	}
+	var hup chan os.Signal // likewise, without a zones-from file.
+	if ts.ZonesFile != "" {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
 	for {
 		select {
 		case <-t.C:
 			ts.reload()
+		case <-files:
+			if ts.ZonesFile != "" && ts.zonesFromChanged() {
+				ts.restart()
+			}
+			if ts.filesChanged() {
+				ts.reload()
+			}
+		case <-hup:
+			ts.restart()
+		case <-ts.netmapChanged:
+			ts.reload()
 		case <-ts.done:
 			t.Stop()
 			return
@@ -250,13 +1584,59 @@ func (ts *Tailscale) poll(t *time.Ticker) {
 	}
 }
 
+// fileCheckInterval is how often the files from which records are read are
+// checked for changes, which are served without waiting for the next reload.
+const fileCheckInterval = 5 * time.Second
+
+// files returns the paths of the files from which records are read.
+func (ts *Tailscale) files() []string {
+	var files []string
+	if ts.HostsFile != "" {
+		files = append(files, ts.HostsFile)
+	}
+	for _, path := range ts.ZoneFiles {
+		files = append(files, path)
+	}
+	return files
+}
+
+// filesChanged returns true if any of the files from which records are read
+// has been modified since it was last read.
+func (ts *Tailscale) filesChanged() bool {
+	ts.RLock()
+	defer ts.RUnlock()
+	for _, path := range ts.files() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(ts.mods[path]) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ts *Tailscale) reload() {
 	log.Debug("Beginning assembly of records for Tailnet peers")
 	defer log.Debug("Assembly of records for Tailnet peers complete")
-	sn := serial(time.Now())
-	status, err := ts.client.Status(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), ts.timeout())
+	status, err := ts.client.Status(ctx)
+	cancel()
 	if err != nil {
 		log.Errorf("Failed fetching status from Tailscale Local API: %v", err)
+		ts.metrics.reloaded(ts.DefaultZone, 0, err)
+		return
+	}
+	if inactive(status.BackendState) {
+		// The peers in the status are those of the previous login, if any,
+		// which mustn't be served on behalf of whoever logs in next.
+		log.Warningf("Not serving peers while Tailscale is in state %s", status.BackendState)
+		ts.metrics.reloaded(ts.DefaultZone, 0, fmt.Errorf("tailscale in state %s", status.BackendState))
+		ts.Lock()
+		ts.hosts, ts.assembled, ts.self = nil, nil, ""
+		ts.state = status.BackendState
+		ts.Unlock()
 		return
 	}
 
@@ -266,54 +1646,302 @@ func (ts *Tailscale) reload() {
 		peers[i] = peer
 		i++
 	}
-	hosts := assemble(&ts.Config, status.Self, peers)
+	var nm *netmap.NetworkMap
+	if len(ts.Services) > 0 || ts.HINFO || ts.Metadata || ts.Posture || ts.VIPServices || ts.FunnelZone != "" || len(ts.Capabilities) > 0 || ts.RecordCapability != "" {
+		if nm, err = ts.netMap(); err != nil {
+			// Serving the remaining records is still useful, so carry on.
+			log.Warningf("Failed fetching network map from Tailscale Local API: %v", err)
+		}
+	}
+	hosts := assemble(&ts.Config, status.Self, peers, hostinfo(nm), grants(&ts.Config, nm), status.User)
+	if ts.VIPServices {
+		assembleVIPServices(&ts.Config, vipServices(nm), hosts)
+	}
 	log.Infof("Assembled %d custom DNS entries for Tailnet peers", len(hosts))
-	log.Debugf("Assembled records with serial %d:\n%s", sn, hosts)
+	mods := make(map[string]time.Time)
+	if ts.HostsFile != "" {
+		rrs, mod, err := readHosts(&ts.Config, ts.HostsFile)
+		if err != nil {
+			// The remaining records are still useful, so carry on.
+			log.Warningf("Failed reading hosts file %q: %v", ts.HostsFile, err)
+		}
+		merge(hosts, rrs)
+		mods[ts.HostsFile] = mod
+	}
+	for zone, path := range ts.ZoneFiles {
+		rrs, mod, err := readZoneFile(&ts.Config, zone, path)
+		if err != nil {
+			log.Warningf("Failed reading zone file %q of %s: %v", path, zone, err)
+		}
+		merge(hosts, rrs)
+		mods[path] = mod
+	}
+	anames(&ts.Config, hosts, ts.anameResolver())
+	nonTerminals(&ts.Config, hosts)
+	labels := nameserverLabels(&ts.Config, peers)
+
+	ts.metrics.reloaded(ts.DefaultZone, len(hosts), nil)
 
 	ts.Lock()
-	defer ts.Unlock()
-	ts.hosts = hosts
-	ts.serial = sn
+	ts.reloaded = time.Now()
+	ts.mods = mods
+	ts.nameserverLabels = labels
+	ts.state = status.BackendState
+	if status.Self != nil {
+		self := dns.CanonicalName(status.Self.DNSName)
+		if ts.self != "" && self != ts.self {
+			log.Infof("Tailscale login changed from %q to %q", ts.self, self)
+		}
+		ts.self = self
+	}
+	prev := ts.hosts
+	ts.assembled = hosts
+	ts.hosts = ts.withUpdates(hosts)
+	changed := ts.changedZones(prev)
+	if len(changed) > 0 {
+		// The serial of a zone only changes along with its records, so that
+		// secondaries don't transfer zones needlessly.
+		ts.bumpSerials(changed, time.Now())
+	}
+	log.Debugf("Assembled records with serial %d:\n%s", ts.serial, ts.hosts)
+	ts.Unlock()
+
+	if len(changed) > 0 {
+		go ts.changed(changed)
+	} else {
+		// Signed zones may be written at any time after an export.
+		ts.loadSigned()
+	}
+}
+
+// inactive returns true if tailscaled in state isn't logged in to a tailnet,
+// or isn't connected to it.
+func inactive(state string) bool {
+	switch state {
+	case ipn.NoState.String(), ipn.NeedsLogin.String(), ipn.NeedsMachineAuth.String(), ipn.Stopped.String():
+		return true
+	}
+	return false
+}
+
+// changedZones returns the sorted zones whose records differ between prev and
+// the current records. All zones have changed if there were no records before.
+// Must be called with the lock held.
+func (ts *Tailscale) changedZones(prev records) []string {
+	var changed []string
+	for _, zone := range ts.zones() {
+		if prev == nil || prev.in(&ts.Config, zone).String() != ts.hosts.in(&ts.Config, zone).String() {
+			changed = append(changed, zone)
+		}
+	}
+	return changed
+}
+
+// changed propagates a change of the records in zones to those outside of this
+// plugin which depend on them.
+func (ts *Tailscale) changed(zones []string) {
+	ts.export(zones)
+	ts.notify(zones)
 }
 
-func (ts *Tailscale) serveCNAME(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, hr *record) (int, error) {
-	ans := answer(req)
-	ans.Answer = append(ans.Answer,
-		&dns.CNAME{
+// netMap fetches the current network map, which holds details of the nodes in
+// the tailnet missing from their status.
+func (ts *Tailscale) netMap() (*netmap.NetworkMap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ts.timeout())
+	defer cancel()
+	return ts.client.NetMap(ctx)
+}
+
+// nodes returns the nodes in the network map nm, including self.
+func nodes(nm *netmap.NetworkMap) []*tailcfg.Node {
+	if nm == nil {
+		return nil
+	}
+	nodes := nm.Peers
+	if nm.SelfNode != nil {
+		nodes = append(nodes[:len(nodes):len(nodes)], nm.SelfNode)
+	}
+	return nodes
+}
+
+// hostinfo returns the Hostinfo of each node in the network map nm.
+func hostinfo(nm *netmap.NetworkMap) map[tailcfg.StableNodeID]tailcfg.HostinfoView {
+	hostinfo := make(map[tailcfg.StableNodeID]tailcfg.HostinfoView)
+	for _, node := range nodes(nm) {
+		if node == nil || !node.Hostinfo.Valid() {
+			continue
+		}
+		hostinfo[node.StableID] = node.Hostinfo
+	}
+	return hostinfo
+}
+
+func (ts *Tailscale) cname(qn, zone string, hr *record) dns.RR {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   qn,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    ts.peerTTL(hr),
+		},
+		Target: ts.target(zone, hr),
+	}
+}
+
+// flattened returns true if the addresses of the peer with host record hr are
+// served directly at qn in zone, rather than behind a CNAME. That's the case
+// when answers in zone are flattened, when zone doesn't serve CNAMEs, and at
+// the target itself, which can't be aliased.
+func (ts *Tailscale) flattened(qn, zone string, hr *record) bool {
+	return ts.answer(zone) == AnswerFlatten || ts.suppressed(zone, dns.TypeCNAME) || qn == ts.target(zone, hr)
+}
+
+// target returns the name to which queries in zone for the peer with host
+// record hr are aliased, which owns its addresses in answers.
+func (ts *Tailscale) target(zone string, hr *record) string {
+	if ts.answer(zone) == AnswerZone {
+		return ts.hostName(hr.hostName(), "", ts.DefaultZone)
+	}
+	return hr.name
+}
+
+// nameservers returns the NS RRset of zone. Self is always the first
+// nameserver, followed by any peers tagged as nameservers. Must be called with
+// the read lock held.
+func (ts *Tailscale) nameservers(zone string) []dns.RR {
+	targets := []string{ts.nsName(zone)}
+	for _, label := range ts.nameserverLabels {
+		targets = append(targets, fmt.Sprintf("%s.ns.%s", label, zone))
+	}
+	rrs := make([]dns.RR, len(targets))
+	for i, target := range targets {
+		rrs[i] = &dns.NS{
 			Hdr: dns.RR_Header{
-				Name:   qn,
-				Rrtype: dns.TypeCNAME,
+				Name:   zone,
+				Rrtype: dns.TypeNS,
 				Class:  dns.ClassINET,
-				Ttl:    uint32(ts.ReloadInterval.Seconds()),
+				Ttl:    ts.ttl(),
 			},
-			Target: hr.name,
-		})
-	ans.Answer = append(ans.Answer, ts.A(hr)...)
-	ans.Answer = append(ans.Answer, ts.AAAA(hr)...)
+			Ns: target,
+		}
+	}
+	return rrs
+}
+
+// serveCNAME answers with a CNAME to the peer's MagicDNS name, followed by the
+// peer's addresses of the queried type. If configured, the NS RRset of zone is
+// attached to the authority section.
+func (ts *Tailscale) serveCNAME(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn, zone string, qt uint16, hr *record) (int, error) {
+	ans := answer(&ts.Config, req)
+	ans.Answer = append(ans.Answer, ts.cname(qn, zone, hr))
+	ans.Answer = append(ans.Answer, ts.targetAddrs(ctx, qt, zone, hr)...)
+	ans.Answer = ts.served(zone, ans.Answer)
+	ts.reorder(ans.Answer)
+	if ts.Authority && !ts.Minimal {
+		ts.RLock()
+		ans.Ns = append(ans.Ns, ts.nameservers(zone)...)
+		ts.RUnlock()
+	}
 	if err := w.WriteMsg(ans); err != nil {
 		return dns.RcodeServerFailure, err
 	}
 	return dns.RcodeSuccess, nil
 }
 
-func (ts *Tailscale) serveNoData(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, zone bool, serial uint32) (int, error) {
-	ans := answer(req)
-	if !zone {
-		qn = zoneFromQN(qn)
+// reorder the address records in rrs per the configured Order. Records are
+// only reordered among those of the same type, so other records stay put.
+func (ts *Tailscale) reorder(rrs []dns.RR) {
+	if ts.Order == "" {
+		return
+	}
+	n := ts.rotation.Add(1)
+	for _, rt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var idx []int
+		for i, rr := range rrs {
+			if rr.Header().Rrtype == rt {
+				idx = append(idx, i)
+			}
+		}
+		if len(idx) < 2 {
+			continue
+		}
+		rrset := make([]dns.RR, len(idx))
+		for j, i := range idx {
+			rrset[j] = rrs[i]
+		}
+		switch ts.Order {
+		case OrderRoundRobin:
+			k := int(n % uint32(len(rrset)))
+			rrset = append(rrset[k:], rrset[:k]...)
+		case OrderSorted:
+			sort.SliceStable(rrset, func(i, j int) bool {
+				return addrOf(rrset[i]).Less(addrOf(rrset[j]))
+			})
+		}
+		for j, i := range idx {
+			rrs[i] = rrset[j]
+		}
+	}
+}
+
+// addrOf returns the address of an A or AAAA record.
+func addrOf(rr dns.RR) netip.Addr {
+	var addr netip.Addr
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, _ = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		addr, _ = netip.AddrFromSlice(rr.AAAA.To16())
+	}
+	return addr
+}
+
+// flat returns the records of type qt owned by qn for the peer with host
+// record hr, with its addresses owned by qn rather than its MagicDNS name.
+func (ts *Tailscale) flat(qn string, qt uint16, hr *record) []dns.RR {
+	var addrs []netip.Addr
+	switch qt {
+	case dns.TypeA:
+		addrs = hr.v4
+	case dns.TypeAAAA:
+		addrs = hr.v6
+	case dns.TypeANY:
+		addrs = append(hr.v4[:len(hr.v4):len(hr.v4)], hr.v6...)
+	}
+	rrs := addresses(&ts.Config, qn, addrs)
+	for _, rr := range rrs {
+		rr.Header().Ttl = ts.peerTTL(hr)
+	}
+	return append(rrs, hr.typed(qt)...)
+}
+
+func (ts *Tailscale) serveFlat(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn, zone string, serial uint32, hr *record) (int, error) {
+	rrs := ts.served(zone, ts.flat(qn, req.Question[0].Qtype, hr))
+	if len(rrs) == 0 {
+		return ts.serveNoData(ctx, w, req, zone, serial)
+	}
+	return ts.serveRRs(ctx, w, req, qn, rrs)
+}
+
+func (ts *Tailscale) serveNoData(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, zone string, serial uint32) (int, error) {
+	if ts.NoAuthority {
+		// Without authority, the name may well exist elsewhere.
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
 	}
-	ans.Ns = append(ans.Ns, ts.authority(qn, serial))
+	ans := answer(&ts.Config, req)
+	ans.Ns = append(ans.Ns, ts.negative(zone, serial))
 	if err := w.WriteMsg(ans); err != nil {
 		return dns.RcodeServerFailure, err
 	}
 	return dns.RcodeSuccess, nil
 }
 
-func (ts *Tailscale) serveNXDOMAIN(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, zone bool, serial uint32) (int, error) {
-	ans := answer(req)
-	if !zone {
-		qn = zoneFromQN(qn)
+func (ts *Tailscale) serveNXDOMAIN(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, zone string, serial uint32) (int, error) {
+	if ts.NoAuthority {
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
 	}
-	ans.Ns = append(ans.Ns, ts.authority(qn, serial))
+	ans := answer(&ts.Config, req)
+	ans.Ns = append(ans.Ns, ts.negative(zone, serial))
 	ans.Rcode = dns.RcodeNameError
 	if err := w.WriteMsg(ans); err != nil {
 		return dns.RcodeServerFailure, err
@@ -321,9 +1949,30 @@ func (ts *Tailscale) serveNXDOMAIN(ctx context.Context, w dns.ResponseWriter, re
 	return dns.RcodeNameError, nil
 }
 
+func (ts *Tailscale) serveRRs(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, rrs []dns.RR) (int, error) {
+	ans := answer(&ts.Config, req)
+	for _, rr := range rrs {
+		// Records may be shared between several names, so serve a copy owned by
+		// the qname.
+		rr = dns.Copy(rr)
+		rr.Header().Name = qn
+		ans.Answer = append(ans.Answer, rr)
+	}
+	ts.reorder(ans.Answer)
+	if err := w.WriteMsg(ans); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
 func (ts *Tailscale) serveSOA(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, serial uint32) (int, error) {
-	ans := answer(req)
+	ans := answer(&ts.Config, req)
 	ans.Answer = append(ans.Answer, ts.authority(qn, serial))
+	if !ts.Minimal {
+		ts.RLock()
+		ans.Ns = append(ans.Ns, ts.nameservers(qn)...)
+		ts.RUnlock()
+	}
 	if err := w.WriteMsg(ans); err != nil {
 		return dns.RcodeServerFailure, err
 	}
@@ -331,23 +1980,32 @@ func (ts *Tailscale) serveSOA(ctx context.Context, w dns.ResponseWriter, req *dn
 }
 
 func (ts *Tailscale) serveNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string) (int, error) {
-	ans := answer(req)
-	ans.Answer = append(ans.Answer,
-		&dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   qn,
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(ts.ReloadInterval.Seconds()),
-			},
-			Ns: fmt.Sprintf("ns.%s", qn),
-		})
+	ans := answer(&ts.Config, req)
+	ts.RLock()
+	nss := ts.nameservers(qn)
+	ts.RUnlock()
+	ans.Answer = append(ans.Answer, nss...)
+	if !ts.Minimal {
+		for _, ns := range nss {
+			ans.Extra = append(ans.Extra, ts.glue(ns.(*dns.NS).Ns, qn)...)
+		}
+	}
 	if err := w.WriteMsg(ans); err != nil {
 		return dns.RcodeServerFailure, err
 	}
 	return dns.RcodeSuccess, nil
 }
 
+// glue returns the addresses of the nameserver ns of zone, for the additional
+// section of answers naming it. This saves resolvers a round trip.
+func (ts *Tailscale) glue(ns, zone string) []dns.RR {
+	hr, _ := ts.lookup(ns, zone)
+	if hr == nil {
+		return nil
+	}
+	return ts.served(zone, addresses(&ts.Config, ns, append(hr.v4[:len(hr.v4):len(hr.v4)], hr.v6...)))
+}
+
 // Name of this plugin.
 func (*Tailscale) Name() string {
 	return name
@@ -358,13 +2016,36 @@ func (ts *Tailscale) Ready() bool {
 	ts.RLock()
 	defer ts.RUnlock()
 
-	// Ready when the hosts have been populated at least once.
-	return ts.hosts != nil && ts.serial > 0
+	// Ready when the hosts have been populated at least once, and not since
+	// gone stale.
+	return ts.hosts != nil && ts.serial > 0 && !ts.staleLocked()
+}
+
+// stale returns true if the records have not been reloaded for longer than
+// they may be served.
+func (ts *Tailscale) stale() bool {
+	ts.RLock()
+	defer ts.RUnlock()
+	return ts.staleLocked()
+}
+
+// unavailable returns true if the records are stale, or have been cleared
+// because tailscaled isn't logged in or running.
+func (ts *Tailscale) unavailable() bool {
+	ts.RLock()
+	defer ts.RUnlock()
+	return ts.staleLocked() || inactive(ts.state)
+}
+
+// staleLocked is stale, but must be called with the lock held.
+func (ts *Tailscale) staleLocked() bool {
+	return ts.MaxStale != 0 && !ts.reloaded.IsZero() && time.Since(ts.reloaded) > ts.MaxStale
 }
 
-// lookup a record by name. Returns the record if any, and the serial for which
-// the lookup result is valid. Acquires a read lock.
-func (ts *Tailscale) lookup(qn string) (*record, uint32) {
+// lookup a record by name in zone, falling back to a matching wildcard record.
+// Returns the record if any, and the serial for which the lookup result is
+// valid. Acquires a read lock.
+func (ts *Tailscale) lookup(qn, zone string) (*record, uint32) {
 	ts.RLock()
 	defer ts.RUnlock()
 	defer func() {
@@ -372,48 +2053,130 @@ func (ts *Tailscale) lookup(qn string) (*record, uint32) {
 			log.Errorf("recovered from panic while looking up %q: %v", qn, r)
 		}
 	}()
-	return ts.hosts[qn], ts.serial
+	if hr := ts.hosts[qn]; hr != nil {
+		return hr, ts.serialOf(zone)
+	}
+	return ts.wildcard(qn, zone), ts.serialOf(zone)
+}
+
+// wildcard returns the wildcard record which matches qn, if any. As in RFC
+// 4592, only the wildcard at the closest existing ancestor of qn matches. Must
+// be called with the read lock held.
+func (ts *Tailscale) wildcard(qn, zone string) *record {
+	name := qn
+	for name != zone {
+		off, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[off:]
+		if hr := ts.hosts["*."+name]; hr != nil {
+			return hr
+		}
+		if _, exists := ts.hosts[name]; exists {
+			return nil
+		}
+	}
+	return nil
+}
+
+// answers returns true if a request for qn of class qc with opcode is one this
+// plugin may answer itself, rather than hand to the rest of the chain: an
+// update, a CHAOS query, or a query in its zones or for a short name.
+func (ts *Tailscale) answers(qn string, qc uint16, opcode int) bool {
+	if opcode == dns.OpcodeUpdate || qc == dns.ClassCHAOS {
+		return true
+	}
+	return ts.zoneOf(qn) != "" || ts.ShortNames && dns.CountLabel(qn) == 1
 }
 
 // ServeDNS queries about Tailscale peers with custom domains. Satisfies the
 // coredns handler interface.
 func (ts *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
 	if ts == nil || !ts.Ready() {
-		return plugin.NextOrFailure(ts.Name(), ts.Next, ctx, w, req)
+		if ts != nil && ts.unavailable() && len(req.Question) > 0 && ts.zoneOf(dns.CanonicalName(req.Question[0].Name)) != "" {
+			// Stale records are worse than none at all.
+			return dns.RcodeServerFailure, nil
+		}
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
 	}
 
 	state := request.Request{W: w, Req: req}
-	if qc := state.QClass(); qc != dns.ClassINET && qc != dns.ClassANY {
-		return plugin.NextOrFailure(ts.Name(), ts.Next, ctx, w, req)
-	}
 	qn, qt := state.QName(), state.QType()
+	qc := state.QClass()
+	// Sources are identified before anything is answered, updates and the
+	// server's identity included.
+	if ts.RequireIdentity && ts.answers(qn, qc, req.Opcode) && ts.identify(ctx, w.RemoteAddr()) == nil {
+		return ts.serveRcode(w, req, dns.RcodeRefused)
+	}
+
+	if req.Opcode == dns.OpcodeUpdate {
+		return ts.serveUpdate(ctx, w, req)
+	}
+	if qc == dns.ClassCHAOS {
+		if rcode, ok, err := ts.serveChaos(ctx, w, req, qn, qt); ok {
+			return rcode, err
+		}
+	}
+	if qc != dns.ClassINET && qc != dns.ClassANY {
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
+	}
 
 	// If the zone is not covered by this plugin, hand the request off to the
 	// CoreDNS chain before wasting lock cycles doing a lookup.
-	if !(ts.fastZoneLookup[qn] || ts.fastZoneLookup[zoneFromQN(qn)]) {
-		return plugin.NextOrFailure(ts.Name(), ts.Next, ctx, w, req)
+	zone := ts.zoneOf(qn)
+	shortName := zone == "" && ts.ShortNames && dns.CountLabel(qn) == 1
+	if zone == "" && !shortName {
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
+	}
+	if shortName {
+		return ts.serveShortName(ctx, w, req, qn, qt)
+	}
+
+	if ts.NoCompress || ts.MaxUDPSize != 0 {
+		w = &sizingWriter{ResponseWriter: w, ts: ts, req: req}
+	}
+	if rcode, ok, err := ts.serveSigned(ctx, w, req, zone); ok {
+		return rcode, err
+	}
+	if len(ts.keys[zone]) > 0 && state.Do() {
+		w = &signingWriter{ResponseWriter: w, ts: ts}
 	}
 
-	hr, serial := ts.lookup(qn) // Do the actual lookup; takes read lock.
+	hr, serial := ts.lookup(qn, zone) // Do the actual lookup; takes read lock.
+	if !ts.visible(ctx, w.RemoteAddr(), qn, zone) {
+		return ts.serveNXDOMAIN(ctx, w, req, zone, serial)
+	}
 
-	// If the qname is the name of a zone handled by this plugin, don't bother
-	// inspecting the returned host record; it will always be nil. We respond
-	// anyway for the record types which make sense in this case.
-	if ts.fastZoneLookup[qn] {
+	// If the qname is the name of a zone handled by this plugin, the record
+	// types which make sense in this case are synthesized. The host record only
+	// holds additional records at the apex, such as the addresses of apex
+	// peers.
+	if qn == zone {
+		switch qt {
+		case dns.TypeNS, dns.TypeSOA:
+			if ts.NoAuthority {
+				return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
+			}
+		}
 		switch qt {
 		case dns.TypeNS:
 			return ts.serveNS(ctx, w, req, qn)
 		case dns.TypeSOA:
 			return ts.serveSOA(ctx, w, req, qn, serial)
-		default:
-			return ts.serveNoData(ctx, w, req, qn, true, serial)
+		case dns.TypeDNSKEY:
+			return ts.serveDNSKEY(ctx, w, req, zone, serial)
 		}
+		if rrs := ts.served(zone, hr.typed(qt)); len(rrs) > 0 {
+			return ts.serveRRs(ctx, w, req, qn, rrs)
+		}
+		return ts.serveNoData(ctx, w, req, zone, serial)
 	}
 
 	// If the qname was not a zone and no peer host record was found, return
 	// NXDOMAIN.
 	if hr == nil {
-		return ts.serveNXDOMAIN(ctx, w, req, qn, false, serial)
+		return ts.serveNXDOMAIN(ctx, w, req, zone, serial)
 	}
 
 	// Serve the response for supported record types, or respond with the No
@@ -421,10 +2184,45 @@ func (ts *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dn
 	// no record of the requested type.
 	switch qt {
 	case dns.TypeA, dns.TypeAAAA, dns.TypeANY, dns.TypeCNAME:
-		return ts.serveCNAME(ctx, w, req, qn, hr)
-	default:
-		return ts.serveNoData(ctx, w, req, qn, false, serial)
+		if hr.name == "" {
+			break
+		}
+		if !ts.flattened(qn, zone, hr) {
+			return ts.serveCNAME(ctx, w, req, qn, zone, qt, hr)
+		}
+		if qt != dns.TypeCNAME {
+			return ts.serveFlat(ctx, w, req, qn, zone, serial, hr)
+		}
+	}
+	if rrs := ts.served(zone, hr.typed(qt)); len(rrs) > 0 {
+		return ts.serveRRs(ctx, w, req, qn, rrs)
+	}
+	// Static CNAMEs answer queries of any type.
+	if rrs := ts.served(zone, hr.typed(dns.TypeCNAME)); len(rrs) > 0 {
+		return ts.serveRRs(ctx, w, req, qn, rrs)
+	}
+	return ts.serveNoData(ctx, w, req, zone, serial)
+}
+
+// serveShortName answers queries for the addresses of a peer by its host name
+// alone, as for its name in the default zone. Anything else is left to the
+// next plugin, since this plugin is not authoritative for single-label names.
+func (ts *Tailscale) serveShortName(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, qn string, qt uint16) (int, error) {
+	zone := ts.DefaultZone
+	hr, _ := ts.lookup(qn+zone, zone)
+	if hr == nil || hr.name == "" || !ts.visible(ctx, w.RemoteAddr(), qn+zone, zone) {
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
+	}
+	switch qt {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeANY, dns.TypeCNAME:
+		if !ts.flattened(qn, zone, hr) {
+			return ts.serveCNAME(ctx, w, req, qn, zone, qt, hr)
+		}
+		if rrs := ts.served(zone, ts.flat(qn, qt, hr)); len(rrs) > 0 {
+			return ts.serveRRs(ctx, w, req, qn, rrs)
+		}
 	}
+	return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
 }
 
 // Shutdown the Tailscale plugin.
@@ -433,6 +2231,10 @@ func (ts *Tailscale) Shutdown() {
 	ts.Lock()
 	defer ts.Unlock()
 	ts.hosts = nil
+	ts.assembled = nil
+	if ts.stopWatching != nil {
+		ts.stopWatching()
+	}
 	ts.done <- true
 }
 
@@ -446,7 +2248,19 @@ func (ts *Tailscale) Startup() {
 	if ts.ReloadInterval == 0 {
 		ts.ReloadInterval = defaultReloadInterval
 	}
+	if err := ts.loadUpdates(); err != nil {
+		log.Errorf("Failed loading dynamic updates from %q: %v", ts.UpdateFile, err)
+	}
+	if err := ts.loadSerials(); err != nil {
+		log.Errorf("Failed loading serials from %q: %v", ts.SerialFile, err)
+	}
 	// Always reload on startup.
 	ts.reload()
+	if !ts.NoWatch {
+		ts.netmapChanged = make(chan struct{}, 1)
+		var ctx context.Context
+		ctx, ts.stopWatching = context.WithCancel(context.Background())
+		go ts.watch(ctx)
+	}
 	go ts.poll(time.NewTicker(ts.ReloadInterval))
 }
@@ -4,10 +4,14 @@ import (
 	"context"
 	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/coredns/coredns/plugin/test"
 	"github.com/google/go-cmp/cmp"
 	"github.com/miekg/dns"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 func TestAssemble(t *testing.T) {
@@ -16,9 +20,365 @@ func TestAssemble(t *testing.T) {
 		TailscaleIPs: []netip.Addr{ip(t, "100.111.112.113"), ip(t, "fd7a::dead:beef")},
 	}
 
+	denFoo := &record{
+		name: "foo.magic-dns.ts.net.",
+		v4:   ips(t, "100.101.102.103"),
+		v6:   ips(t, "fd7a::abcd"),
+		rrs: []dns.RR{
+			rr(t, "foo.magic-dns.ts.net. 300 IN LOC 39 44 21.120 N 104 59 25.080 W 1609m"),
+		},
+	}
+
+	staticConfig := fullTestConfig
+	staticConfig.Records = []dns.RR{
+		rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net."),
+		rr(t, `self.corp.example.com. 300 IN TXT "static"`),
+	}
+
+	reverseConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Reverse:        true,
+		fastZoneLookup: map[string]bool{
+			"corp.example.com.":                 true,
+			"100.in-addr.arpa.":                 true,
+			"0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": true,
+		},
+	}
+
+	metadataConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Metadata:       true,
+		HINFO:          true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	servicesConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		Services:       map[string]string{"80/tcp": "http"},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	locationConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"campus-den": "den.corp.example.com."},
+		ReloadInterval: time.Second * 300,
+		Locations: map[string]Location{
+			"campus-den": {Latitude: 39.7392, Longitude: -104.9903, Altitude: 1609},
+		},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "den.corp.example.com.": true},
+	}
+
+	wildcardConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Wildcard:       true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	apexConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Apex:           map[string]string{"www": "corp.example.com."},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	taggedServiceConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		TaggedServices: []TaggedService{{Tag: "dc", Name: "ldap", Proto: "tcp", Port: 389}},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	dns64Config := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		DNS64:          netip.MustParsePrefix("64:ff9b::/96"),
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	labelConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Labels:         map[string]string{"campus-iad": "iad"},
+		TaggedServices: []TaggedService{{Tag: "campus-iad", Name: "ldap", Proto: "tcp", Port: 389}},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	tagsTXTConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		TagsTXT:        true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	nodeAttrsConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		NodeAttrs:      map[string]bool{"funnel": true, "https://tailscale.com/cap/funnel-ports": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	keyExpiry := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	postureConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Posture:        true,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	funnelConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		FunnelZone:     "public.example.com.",
+		ReloadInterval: time.Second * 300,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "public.example.com.": true},
+	}
+
+	templateConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com.", "canary": "example.com."},
+		Templates:      map[string]string{"corp.example.com.": "{host}.hosts", "example.com.": "{host}-{tag}"},
+		ReloadInterval: time.Second * 300,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	nameTagConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		NameTagPrefix:  "dns-name-",
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	nameTagReverseConfig := nameTagConfig
+	nameTagReverseConfig.Reverse = true
+	nameTagReverseConfig.fastZoneLookup = map[string]bool{
+		"corp.example.com.": true,
+		"example.com.":      true,
+		"100.in-addr.arpa.": true,
+	}
+
+	aliasTagConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		AliasTagPrefix: "dns-alias-",
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	excludeConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		Reverse:        true,
+		ExcludeTags:    map[string]bool{"ci-runner": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	includeOSConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		IncludeOS:      map[string]bool{"linux": true, "windows": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	onlineOnlyConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		OnlineOnly:     true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	excludeExpiredConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		ExcludeExpired: true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	ownerZoneConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		OwnerZone:      "users.corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "users.corp.example.com.": true},
+	}
+
+	sharedExcludeConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Shared:         SharedExclude,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+	sharedZoneConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		Shared:         SharedOwnZone,
+		SharedZone:     "shared.corp.example.com.",
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true, "shared.corp.example.com.": true},
+	}
+	sharedPeers := []*ipnstate.PeerStatus{
+		{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, Tags: vs(t, []string{"tag:prod"})},
+		{DNSName: "guest.other-tailnet.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, Tags: vs(t, []string{"tag:prod"})},
+		{DNSName: "visitor.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, ShareeNode: true},
+	}
+
+	sharedMatchConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		Users:          map[string]string{"alice@example.com": "alice.corp.example.com."},
+		OSZones:        map[string]string{"linux": "servers.corp.example.com."},
+		AliasTagPrefix: "dns-alias-",
+		ReloadInterval: time.Second * 300,
+		Shared:         SharedOwnZone,
+		SharedZone:     "shared.corp.example.com.",
+		fastZoneLookup: map[string]bool{
+			"corp.example.com.":         true,
+			"example.com.":              true,
+			"alice.corp.example.com.":   true,
+			"servers.corp.example.com.": true,
+			"shared.corp.example.com.":  true,
+		},
+	}
+
+	keyExpiryTTLConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		KeyExpiryTTL:   true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	pruneConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		PruneAfter:     24 * time.Hour,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+	longAgo := time.Now().Add(-90 * 24 * time.Hour)
+
+	ephemeralConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		EphemeralTTL:   time.Second * 30,
+		EphemeralTags:  map[string]bool{"ci-runner": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	excludeOSConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		ExcludeOS:      map[string]bool{"ios": true, "macos": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	requireConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		Reverse:        true,
+		RequireTags:    map[string]bool{"corp": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	usersConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Users:          map[string]string{"alice@example.com": "alice.corp.example.com."},
+		ReloadInterval: time.Second * 300,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "alice.corp.example.com.": true},
+	}
+
+	osZonesConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		OSZones:        map[string]string{"linux": "servers.corp.example.com.", "macos": "macs.corp.example.com."},
+		ReloadInterval: time.Second * 300,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "servers.corp.example.com.": true, "macs.corp.example.com.": true},
+	}
+
+	aliasesConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		Aliases:        map[string]string{"wiki": "foo", "git": "missing", "bar": "foo"},
+		ReloadInterval: time.Second * 300,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	noAuthorityConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		NoAuthority:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	extraZonesConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ExtraZones:     []string{"internal.example.net."},
+		ReloadInterval: time.Second * 300,
+		Reverse:        true,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "internal.example.net.": true},
+	}
+
+	excludeSelfConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		Reverse:        true,
+		ExcludeSelf:    true,
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
+	selfZonesConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		SelfZones:      map[string]bool{"example.com.": true},
+		TaggedServices: []TaggedService{{Tag: "prod", Name: "http", Proto: "tcp", Port: 80}},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+	selfZonesSelf := &ipnstate.PeerStatus{
+		DNSName:      "self.magic-dns.ts.net",
+		TailscaleIPs: []netip.Addr{ip(t, "100.111.112.113")},
+		Tags:         vs(t, []string{"tag:prod"}),
+	}
+
+	selfZonesNameTagConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		NameTagPrefix:  "dns-name-",
+		SelfZones:      map[string]bool{"example.com.": true},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	nsNameConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		Zones:          map[string]string{"prod": "example.com."},
+		ReloadInterval: time.Second * 300,
+		NSNames:        map[string]string{"": "dns1", "example.com.": "ns1.example.net."},
+		fastZoneLookup: map[string]bool{"corp.example.com.": true, "example.com.": true},
+	}
+
+	nameserverConfig := Config{
+		DefaultZone:    "corp.example.com.",
+		ReloadInterval: time.Second * 300,
+		NameserverTag:  "dns-ns",
+		fastZoneLookup: map[string]bool{"corp.example.com.": true},
+	}
+
 	for tn, tc := range map[string]struct {
-		config Config
-		peers  []*ipnstate.PeerStatus
+		config   Config
+		peers    []*ipnstate.PeerStatus
+		hostinfo map[tailcfg.StableNodeID]tailcfg.HostinfoView
+		users    map[tailcfg.UserID]tailcfg.UserProfile
+		self     *ipnstate.PeerStatus // testSelf if nil.
 
 		want records
 	}{
@@ -26,422 +386,2596 @@ func TestAssemble(t *testing.T) {
 		"no peers": {
 			config: fullTestConfig,
 			want: records{
-				"self.corp.example.com.":   {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.corp.example.com.":     {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.den.corp.example.com.": {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.rdu.corp.example.com.": {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.example.com.":          {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
+				"self.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.den.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.rdu.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":          {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
 			},
 		},
-		"peer without ts dns name": {
-			config: fullTestConfig,
+		"wildcard": {
+			config: wildcardConfig,
 			peers: []*ipnstate.PeerStatus{
 				{
-					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
 				},
 			},
 			want: records{
-				"self.corp.example.com.":   {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.corp.example.com.":     {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.den.corp.example.com.": {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.rdu.corp.example.com.": {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.example.com.":          {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
+				"self.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"*.self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":    {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"*.foo.corp.example.com.":  {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
 			},
 		},
-		"peer with no matching tags": {
-			config: fullTestConfig,
+		"apex": {
+			config: apexConfig,
 			peers: []*ipnstate.PeerStatus{
 				{
 					DNSName:      "foo.magic-dns.ts.net",
 					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
-					Tags:         vs[string](t, []string{"tag:foo", "tag:bar"}),
+					Tags:         vs(t, []string{"tag:www"}),
 				},
 			},
 			want: records{
-				"self.corp.example.com.":   {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"foo.corp.example.com.":    {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-				"ns.corp.example.com.":     {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.den.corp.example.com.": {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.rdu.corp.example.com.": {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.example.com.":          {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":  {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+				"corp.example.com.": {
+					rrs: []dns.RR{
+						rr(t, "corp.example.com. 300 IN A 100.101.102.103"),
+						rr(t, "corp.example.com. 300 IN AAAA fd7a::abcd"),
+					},
+				},
 			},
 		},
-		"peer with matching tags": {
-			config: fullTestConfig,
+		"tagged service": {
+			config: taggedServiceConfig,
 			peers: []*ipnstate.PeerStatus{
 				{
-					DNSName:      "foo.magic-dns.ts.net",
-					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
-					Tags:         vs[string](t, []string{"tag:campus-den", "tag:prod"}),
+					DNSName:      "dc1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:dc"}),
+				},
+				{
+					DNSName:      "dc2.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					Tags:         vs(t, []string{"tag:dc"}),
 				},
 			},
 			want: records{
-				"self.corp.example.com.":    {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"foo.corp.example.com.":     {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-				"foo.example.com.":          {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-				"foo.den.corp.example.com.": {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-				"ns.corp.example.com.":      {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.den.corp.example.com.":  {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.rdu.corp.example.com.":  {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-				"ns.example.com.":           {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"dc1.corp.example.com.":  {name: "dc1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"dc2.corp.example.com.":  {name: "dc2.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"_ldap._tcp.corp.example.com.": {
+					rrs: []dns.RR{
+						rr(t, "_ldap._tcp.corp.example.com. 300 IN SRV 0 0 389 dc1.magic-dns.ts.net."),
+						rr(t, "_ldap._tcp.corp.example.com. 300 IN SRV 0 0 389 dc2.magic-dns.ts.net."),
+					},
+				},
 			},
 		},
-	} {
-		t.Run(tn, func(t *testing.T) {
-			got := assemble(&tc.config, testSelf, tc.peers)
-			if diff := cmp.Diff(got, tc.want, cmpOpts...); diff != "" {
-				t.Errorf("mismatch: (-got,+want):\n%v", diff)
-			}
-		})
-	}
-}
-
-func TestTailscale_Ready(t *testing.T) {
-	ts := &Tailscale{
-		Config: fullTestConfig,
-		client: &fakeLocalClient{},
-	}
-	if ready := ts.Ready(); ready {
-		t.Errorf("should not be ready before first call to Startup")
-	}
-	ts.Startup()
-	if ready := ts.Ready(); !ready {
-		t.Errorf("should be ready following call to Startup")
-	}
-	ts.Shutdown()
-	if ready := ts.Ready(); ready {
-		t.Errorf("should not be ready following call to Startup")
-	}
-}
-
-func TestTailscale_ServeDNS(t *testing.T) {
-	testTS := Tailscale{
-		Config: fullTestConfig,
-		serial: 8675309,
-		hosts: records{
-			"foo.corp.example.com.":     {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-			"foo.den.corp.example.com.": {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-			"foo.example.com.":          {"foo.magic-dns.ts.net.", ips(t, "100.101.102.103"), ips(t, "fd7a::abcd")},
-			"ns.corp.example.com.":      {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-			"ns.den.corp.example.com.":  {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-			"ns.example.com.":           {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-			"ns.rdu.corp.example.com.":  {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-			"self.corp.example.com.":    {"self.magic-dns.ts.net.", ips(t, "100.111.112.113"), ips(t, "fd7a::dead:beef")},
-		},
-	}
-	for tn, tc := range map[string]struct {
-		req  dns.Msg
-		want *dns.Msg
-	}{
-		// the "invalid" cases test handler behavior in various unsupported
-		// situations.
-
-		"invalid CHAOS A": { // unsupported qclass
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}},
+		"dns64": {
+			config: dns64Config,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+			},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":  {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "64:ff9b::6465:6667")},
 			},
 		},
-
-		// the "miss" cases test handler behavior when qname is not found.
-
-		"miss IN A": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+		"label": {
+			config: labelConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "db1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:campus-iad"}),
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+			want: records{
+				"self.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"db1.corp.example.com.":     {name: "db1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"db1.iad.corp.example.com.": {name: "db1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"_ldap._tcp.corp.example.com.": {
+					rrs: []dns.RR{
+						rr(t, "_ldap._tcp.corp.example.com. 300 IN SRV 0 0 389 db1.magic-dns.ts.net."),
+					},
 				},
 			},
 		},
-		"miss IN AAAA": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+		"tags txt": {
+			config: tagsTXTConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:campus-den", "tag:prod"}),
+				},
+				{
+					DNSName:      "bar.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.": {
+					name: "foo.magic-dns.ts.net.",
+					v4:   ips(t, "100.101.102.103"),
+					rrs:  []dns.RR{rr(t, `foo.magic-dns.ts.net. 300 IN TXT "tags=campus-den,prod"`)},
 				},
+				"bar.corp.example.com.": {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
 			},
 		},
-		"miss IN ANY": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+		"node attrs": {
+			config: nodeAttrsConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Capabilities: []string{"funnel", "https://tailscale.com/cap/funnel-ports?ports=443,8443", "https://tailscale.com/cap/ssh"},
+				},
+				{
+					DNSName:      "bar.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					Capabilities: []string{"https://tailscale.com/cap/ssh"},
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.": {
+					name: "foo.magic-dns.ts.net.",
+					v4:   ips(t, "100.101.102.103"),
+					rrs:  []dns.RR{rr(t, `foo.magic-dns.ts.net. 300 IN TXT "attr=funnel" "attr=https://tailscale.com/cap/funnel-ports?ports=443,8443"`)},
 				},
+				"bar.corp.example.com.": {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
 			},
 		},
-		"miss IN CNAME": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
-			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+		"template": {
+			config: templateConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "web1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod", "tag:canary"}),
 				},
 			},
-		},
-		"miss IN MX": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+			want: records{
+				"self.hosts.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":         {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":              {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.hosts.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1-prod.example.com.":       {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1-canary.example.com.":     {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+		},
+		"name tag": {
+			config: nameTagConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "ip-10-0-0-1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod", "tag:dns-name-Mail"}),
+				},
+				{
+					DNSName:      "bar.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					Tags:         vs(t, []string{"tag:dns-name-"}),
 				},
 			},
-		},
-
-		// the "peer hit" cases test handler behavior when qname matches a peer
-		// in our Tailnet.
-
-		"peer hit ANY A": { // tests ANY class behavior
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"mail.corp.example.com.": {name: "ip-10-0-0-1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), host: "mail"},
+				"mail.example.com.":      {name: "ip-10-0-0-1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), host: "mail"},
+				// An empty name is ignored.
+				"bar.corp.example.com.": {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
-					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
-					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
+		},
+		"alias tags": {
+			config: aliasTagConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "mon1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod", "tag:dns-alias-grafana", "tag:dns-alias-metrics"}),
 				},
 			},
+			want: records{
+				"self.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"mon1.corp.example.com.":    {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"grafana.corp.example.com.": {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"metrics.corp.example.com.": {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"mon1.example.com.":         {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"grafana.example.com.":      {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"metrics.example.com.":      {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
 		},
-		"peer hit IN A": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+		"conflicting name tags": {
+			config: nameTagConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "n2",
+					DNSName:      "ip-10-0-0-2.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					Tags:         vs(t, []string{"tag:dns-name-mail"}),
+				},
+				{
+					ID:           "n1",
+					DNSName:      "ip-10-0-0-1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:dns-name-mail"}),
+				},
+				{
+					ID:           "n3",
+					DNSName:      "web.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")},
+				},
+				{
+					ID:           "n0",
+					DNSName:      "ip-10-0-0-3.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.106")},
+					Tags:         vs(t, []string{"tag:dns-name-web"}),
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
-					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
-					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				// The peer with the lowest stable node ID wins a name.
+				"mail.corp.example.com.": {name: "ip-10-0-0-1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), host: "mail"},
+				// Host names taken from MagicDNS names win over name tags.
+				"web.corp.example.com.": {name: "web.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+			},
+		},
+		"conflicting name with reverse": {
+			config: nameTagReverseConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "n3",
+					DNSName:      "web.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")},
 				},
+				{
+					ID:           "n0",
+					DNSName:      "ip-10-0-0-3.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.106")},
+					Tags:         vs(t, []string{"tag:dns-name-web", "tag:prod"}),
+				},
+			},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.100.in-addr.arpa.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web.corp.example.com.":  {name: "web.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+				"web.example.com.":       {name: "ip-10-0-0-3.magic-dns.ts.net.", v4: ips(t, "100.101.102.106"), host: "web"},
+
+				"113.112.111.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "113.112.111.100.in-addr.arpa. 300 IN PTR self.corp.example.com.")}},
+				"105.102.101.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "105.102.101.100.in-addr.arpa. 300 IN PTR web.corp.example.com.")}},
+				// A peer beaten to its default zone name points at the first
+				// name it won.
+				"106.102.101.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "106.102.101.100.in-addr.arpa. 300 IN PTR web.example.com.")}},
 			},
 		},
-		"peer hit IN AAAA": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+		"conflicting alias tags": {
+			config: aliasTagConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "n2",
+					DNSName:      "mon2.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					Tags:         vs(t, []string{"tag:dns-alias-grafana", "tag:dns-alias-mon1"}),
+				},
+				{
+					ID:           "n1",
+					DNSName:      "mon1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:dns-alias-grafana"}),
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
-					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
-					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				// Host names win over aliases.
+				"mon1.corp.example.com.": {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"mon2.corp.example.com.": {name: "mon2.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				// The peer with the lowest stable node ID wins an alias.
+				"grafana.corp.example.com.": {name: "mon1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
+		},
+		"excluded peer": {
+			config: excludeConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "runner1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod", "tag:ci-runner"}),
 				},
 			},
+			want: records{
+				"self.corp.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":          {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":               {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"113.112.111.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "113.112.111.100.in-addr.arpa. 300 IN PTR self.corp.example.com.")}},
+			},
 		},
-		"peer hit IN ANY": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+		"included os": {
+			config: includeOSConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, OS: "linux"},
+				{DNSName: "dc1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, OS: "windows"},
+				{DNSName: "phone.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, OS: "iOS"},
+				{DNSName: "unknown.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.106")}},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
-					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
-					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
-				},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"dc1.corp.example.com.":  {name: "dc1.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
 			},
 		},
-		"peer hit IN CNAME": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+		"online only": {
+			config: onlineOnlyConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, Online: true},
+				{DNSName: "laptop.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
-					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
-					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
-				},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
 			},
 		},
-		"peer hit IN NS": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
+		"excluded expired": {
+			config: excludeExpiredConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, KeyExpiry: &future},
+				{DNSName: "web2.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, Expired: true},
+				{DNSName: "web3.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, KeyExpiry: &past},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
 			},
 		},
-		"peer hit IN SOA": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
+		"owner zone": {
+			config: ownerZoneConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "laptop.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, UserID: 1},
+				{DNSName: "phone.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, UserID: 2},
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, UserID: 1, Tags: vs(t, []string{"tag:prod"})},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			users: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {ID: 1, LoginName: "Alice@example.com"},
+				2: {ID: 2, LoginName: "bob.smith@example.com"},
+			},
+			want: records{
+				"ns.corp.example.com.":                    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.users.corp.example.com.":              {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"laptop.corp.example.com.":                {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"phone.corp.example.com.":                 {name: "phone.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"web1.corp.example.com.":                  {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+				"laptop.alice.users.corp.example.com.":    {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"phone.bob-smith.users.corp.example.com.": {name: "phone.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
 			},
 		},
-		"peer hit IN MX": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+		"owner zone with colliding logins": {
+			config: ownerZoneConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "laptop.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, UserID: 1},
+				{DNSName: "guest.other-tailnet.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, UserID: 2},
+				{DNSName: "phone.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, UserID: 3},
+				{DNSName: "desktop.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.106")}, UserID: 4},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			users: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {ID: 1, LoginName: "alice@example.com"},
+				2: {ID: 2, LoginName: "alice@example.net"},
+				3: {ID: 3, LoginName: "bob@example.com"},
+				4: {ID: 4, LoginName: "bob@example.org"},
+				5: {ID: 5, LoginName: "bob-example-org@example.com"},
+			},
+			want: records{
+				"ns.corp.example.com.":       {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.users.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"laptop.corp.example.com.":   {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"guest.corp.example.com.":    {name: "guest.other-tailnet.ts.net.", v4: ips(t, "100.101.102.104")},
+				"phone.corp.example.com.":    {name: "phone.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+				"desktop.corp.example.com.":  {name: "desktop.magic-dns.ts.net.", v4: ips(t, "100.101.102.106")},
+				// Users whose logins differ only in their domains are told
+				// apart by them.
+				"laptop.alice-example-com.users.corp.example.com.": {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"guest.alice-example-net.users.corp.example.com.":  {name: "guest.other-tailnet.ts.net.", v4: ips(t, "100.101.102.104")},
+				"phone.bob-example-com.users.corp.example.com.":    {name: "phone.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+				// Labels which still collide are left out.
 			},
 		},
-
-		// the "zone hit" cases test handler behavior when qname exists in our
-		// records, regardless of whether the record type is supported or not.
-
-		"zone hit ANY A": { // tests ANY class behavior
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
+		"shared exclude": {
+			config: sharedExcludeConfig,
+			peers:  sharedPeers,
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+		},
+		"shared zone": {
+			config: sharedZoneConfig,
+			peers:  sharedPeers,
+			want: records{
+				"self.corp.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":             {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":                  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.shared.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.":           {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1.example.com.":                {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"guest.shared.corp.example.com.":   {name: "guest.other-tailnet.ts.net.", v4: ips(t, "100.101.102.104")},
+				"visitor.shared.corp.example.com.": {name: "visitor.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
 			},
 		},
-		"zone hit IN A": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+		"shared zone with matching user and os": {
+			config: sharedMatchConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, UserID: 1, OS: "linux"},
+				{DNSName: "guest.other-tailnet.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, UserID: 1, OS: "linux", Tags: vs(t, []string{"tag:prod", "tag:dns-alias-www"})},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			users: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {LoginName: "alice@example.com"},
+			},
+			want: records{
+				"self.corp.example.com.":         {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":                {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.alice.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.servers.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.shared.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.":         {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1.alice.corp.example.com.":   {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1.servers.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				// Neither the tags, user nor OS of a shared peer place it
+				// anywhere but the shared zone.
+				"guest.shared.corp.example.com.": {name: "guest.other-tailnet.ts.net.", v4: ips(t, "100.101.102.104")},
 			},
 		},
-		"zone hit IN AAAA": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+		"key expiry ttl": {
+			config: keyExpiryTTLConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, KeyExpiry: &future},
+				{DNSName: "web2.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, Expired: true},
+				{DNSName: "web3.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), keyExpiry: future},
+				"web3.corp.example.com.": {name: "web3.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
 			},
 		},
-		"zone hit IN ANY": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+		"prune after": {
+			config: pruneConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, LastSeen: past},
+				{DNSName: "web2.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, LastSeen: longAgo},
+				{DNSName: "web3.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, LastSeen: longAgo, Online: true},
+				{DNSName: "web4.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.106")}},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web3.corp.example.com.": {name: "web3.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+				"web4.corp.example.com.": {name: "web4.magic-dns.ts.net.", v4: ips(t, "100.101.102.106")},
 			},
 		},
-		"zone hit IN CNAME": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+		"ephemeral": {
+			config: ephemeralConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}},
+				{DNSName: "runner1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, Tags: vs(t, []string{"tag:ci-runner"})},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
-				},
+			want: records{
+				"self.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.":    {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"runner1.corp.example.com.": {name: "runner1.magic-dns.ts.net.", v4: ips(t, "100.101.102.104"), ttl: 30},
 			},
 		},
-		"zone hit IN NS": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
+		"excluded os": {
+			config: excludeOSConfig,
+			peers: []*ipnstate.PeerStatus{
+				{DNSName: "web1.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")}, OS: "linux"},
+				{DNSName: "laptop.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")}, OS: "macOS"},
+				{DNSName: "phone.magic-dns.ts.net", TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")}, OS: "iOS"},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "corp.example.com. 300 IN NS ns.corp.example.com."),
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
+		},
+		"required tag": {
+			config: requireConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "laptop.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+				{
+					DNSName:      "web1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					Tags:         vs(t, []string{"tag:corp", "tag:prod"}),
+				},
+				{
+					DNSName:      "web2.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")},
+					Tags:         vs(t, []string{"tag:prod"}),
 				},
 			},
+			want: records{
+				// Self is untagged, so it is only served as a nameserver.
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"web1.example.com.":      {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"web2.example.com.":      {name: "web2.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
+
+				"104.102.101.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "104.102.101.100.in-addr.arpa. 300 IN PTR web1.corp.example.com.")}},
+				"105.102.101.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "105.102.101.100.in-addr.arpa. 300 IN PTR web2.example.com.")}},
+			},
 		},
-		"zone hit IN SOA": {
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
+		"users": {
+			config: usersConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "laptop.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					UserID:       1,
+				},
+				{
+					DNSName:      "desktop.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					UserID:       2,
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Answer: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+			users: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {ID: 1, LoginName: "Alice@example.com"},
+				2: {ID: 2, LoginName: "bob@example.com"},
+			},
+			want: records{
+				"ns.corp.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.alice.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"laptop.corp.example.com.":       {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"laptop.alice.corp.example.com.": {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"desktop.corp.example.com.":      {name: "desktop.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+			},
+		},
+		"os zones": {
+			config: osZonesConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "web1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					OS:           "linux",
+				},
+				{
+					DNSName:      "laptop.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+					OS:           "macOS",
 				},
+				{
+					DNSName:      "phone.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.105")},
+					OS:           "iOS",
+				},
+			},
+			want: records{
+				"ns.corp.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.servers.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.macs.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"web1.corp.example.com.":         {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1.servers.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"laptop.corp.example.com.":       {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"laptop.macs.corp.example.com.":  {name: "laptop.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"phone.corp.example.com.":        {name: "phone.magic-dns.ts.net.", v4: ips(t, "100.101.102.105")},
 			},
 		},
-		"zone hit IN MX": { // MX is an unsupported record type.
-			req: dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+		"aliases": {
+			config: aliasesConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod"}),
+				},
+				{
+					DNSName:      "bar.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+				},
 			},
-			want: &dns.Msg{
-				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
-				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
-				Compress: true,
-				Ns: []dns.RR{
-					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+			want: records{
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":  {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"foo.example.com.":       {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"wiki.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"wiki.example.com.":      {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				// The peer named bar takes precedence over the alias.
+				"bar.corp.example.com.": {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"bar.example.com.":      {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
+		},
+		"no authority": {
+			config: noAuthorityConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
 				},
 			},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":  {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
 		},
-	} {
+		"extra zones": {
+			config: extraZonesConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+			},
+			want: records{
+				"ns.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.internal.example.net.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":     {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"foo.internal.example.net.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+
+				// Reverse records point at the name in the DefaultZone.
+				"103.102.101.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "103.102.101.100.in-addr.arpa. 300 IN PTR foo.corp.example.com.")}},
+			},
+		},
+		"excluded self": {
+			config: excludeSelfConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+			},
+			want: records{
+				"ns.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+
+				"103.102.101.100.in-addr.arpa.": {rrs: []dns.RR{rr(t, "103.102.101.100.in-addr.arpa. 300 IN PTR foo.corp.example.com.")}},
+			},
+		},
+		"self zones": {
+			config: selfZonesConfig,
+			self:   selfZonesSelf,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "web1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod"}),
+				},
+			},
+			want: records{
+				"ns.corp.example.com.":         {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+				"ns.example.com.":              {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+				"self.example.com.":            {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+				"web1.corp.example.com.":       {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"web1.example.com.":            {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"_http._tcp.corp.example.com.": {rrs: []dns.RR{rr(t, "_http._tcp.corp.example.com. 300 IN SRV 0 0 80 web1.magic-dns.ts.net.")}},
+				"_http._tcp.example.com.": {
+					rrs: []dns.RR{
+						rr(t, "_http._tcp.example.com. 300 IN SRV 0 0 80 self.magic-dns.ts.net."),
+						rr(t, "_http._tcp.example.com. 300 IN SRV 0 0 80 web1.magic-dns.ts.net."),
+					},
+				},
+			},
+		},
+		"self zones conflicting with peer": {
+			config: selfZonesNameTagConfig,
+			self: &ipnstate.PeerStatus{
+				ID:           "n1",
+				DNSName:      "self.magic-dns.ts.net",
+				TailscaleIPs: []netip.Addr{ip(t, "100.111.112.113")},
+				Tags:         vs(t, []string{"tag:prod", "tag:dns-name-web1"}),
+			},
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "n2",
+					DNSName:      "web1.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:prod"}),
+				},
+			},
+			want: records{
+				"ns.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), host: "web1"},
+				"ns.example.com.":        {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), host: "web1"},
+				"web1.corp.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				// Self is settled with the peers, so the peer's host name wins
+				// over the name tag of self.
+				"web1.example.com.": {name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
+		},
+		"single-label zone": {
+			config: Config{
+				DefaultZone:    "ts.",
+				ReloadInterval: time.Second * 300,
+				fastZoneLookup: map[string]bool{"ts.": true},
+			},
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "grafana.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+			},
+			want: records{
+				"self.ts.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.ts.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"grafana.ts.": {name: "grafana.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
+		},
+		"ns-name": {
+			config: nsNameConfig,
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"dns1.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"nameserver": {
+			config: nameserverConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					Tags:         vs(t, []string{"tag:dns-ns"}),
+				},
+			},
+			want: records{
+				"self.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":    {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"foo.ns.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			},
+		},
+		"peer without ts dns name": {
+			config: fullTestConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+				},
+			},
+			want: records{
+				"self.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.den.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.rdu.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":          {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"peer with no matching tags": {
+			config: fullTestConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+					Tags:         vs[string](t, []string{"tag:foo", "tag:bar"}),
+				},
+			},
+			want: records{
+				"self.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":    {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+				"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.den.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.rdu.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":          {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"peer with tailscale addresses": {
+			config: reverseConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a:115c:a1e0::1")},
+				},
+			},
+			want: records{
+				"self.corp.example.com.":               {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":                {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a:115c:a1e0::1")},
+				"ns.corp.example.com.":                 {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.100.in-addr.arpa.":                 {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+
+				"113.112.111.100.in-addr.arpa.":                                             {rrs: []dns.RR{rr(t, "113.112.111.100.in-addr.arpa. 300 IN PTR self.corp.example.com.")}},
+				"103.102.101.100.in-addr.arpa.":                                             {rrs: []dns.RR{rr(t, "103.102.101.100.in-addr.arpa. 300 IN PTR foo.corp.example.com.")}},
+				"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": {rrs: []dns.RR{rr(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. 300 IN PTR foo.corp.example.com.")}},
+			},
+		},
+		"peer with metadata and hostinfo": {
+			config: metadataConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "nFooCNTRL",
+					DNSName:      "foo.magic-dns.ts.net",
+					OS:           "linux",
+					Created:      time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC),
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+				},
+			},
+			hostinfo: map[tailcfg.StableNodeID]tailcfg.HostinfoView{
+				"nFooCNTRL": (&tailcfg.Hostinfo{
+					IPNVersion: "1.48.1-t1234abcd",
+					Machine:    "x86_64",
+					OSVersion:  "6.1.0",
+				}).View(),
+			},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.": {
+					name: "foo.magic-dns.ts.net.",
+					v4:   ips(t, "100.101.102.103"),
+					v6:   ips(t, "fd7a::abcd"),
+					rrs: []dns.RR{
+						rr(t, `foo.magic-dns.ts.net. 300 IN TXT "id=nFooCNTRL" "os=linux" "version=1.48.1-t1234abcd" "created=2023-09-01T12:00:00Z"`),
+						rr(t, `foo.magic-dns.ts.net. 300 IN HINFO "x86_64" "linux 6.1.0"`),
+					},
+				},
+				"ns.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"peer with services": {
+			config: servicesConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "nFooCNTRL",
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+					Tags:         vs[string](t, []string{"tag:prod"}),
+				},
+			},
+			hostinfo: map[tailcfg.StableNodeID]tailcfg.HostinfoView{
+				"nFooCNTRL": (&tailcfg.Hostinfo{
+					Services: []tailcfg.Service{
+						{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+						{Proto: tailcfg.TCP, Port: 80, Description: "nginx"},
+						{Proto: tailcfg.TCP, Port: 80, Description: "nginx"},
+						{Proto: tailcfg.PeerAPI4, Port: 80},
+					},
+				}).View(),
+			},
+			want: records{
+				"self.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.": {
+					name: "foo.magic-dns.ts.net.",
+					v4:   ips(t, "100.101.102.103"),
+					v6:   ips(t, "fd7a::abcd"),
+				},
+				"foo.example.com.": {
+					name: "foo.magic-dns.ts.net.",
+					v4:   ips(t, "100.101.102.103"),
+					v6:   ips(t, "fd7a::abcd"),
+				},
+				"ns.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+
+				"_http._tcp.foo.corp.example.com.": {rrs: []dns.RR{rr(t, "_http._tcp.foo.corp.example.com. 300 IN SRV 0 0 80 foo.magic-dns.ts.net.")}},
+				"_http._tcp.foo.example.com.":      {rrs: []dns.RR{rr(t, "_http._tcp.foo.example.com. 300 IN SRV 0 0 80 foo.magic-dns.ts.net.")}},
+			},
+		},
+		"posture": {
+			config: postureConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "nFooCNTRL",
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+					KeyExpiry:    &keyExpiry,
+					Expired:      true,
+				},
+				{
+					ID:           "nBarCNTRL",
+					DNSName:      "bar.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+				},
+			},
+			hostinfo: map[tailcfg.StableNodeID]tailcfg.HostinfoView{
+				"nBarCNTRL": (&tailcfg.Hostinfo{IPNVersion: "1.48.1-t1234567-gabcdef"}).View(),
+			},
+			want: records{
+				"foo.corp.example.com.":          {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"bar.corp.example.com.":          {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"_posture.foo.corp.example.com.": {rrs: []dns.RR{rr(t, `_posture.foo.corp.example.com. 300 IN TXT "key-expiry=2023-09-01T12:00:00Z" "expired=true"`)}},
+				"_posture.bar.corp.example.com.": {rrs: []dns.RR{rr(t, `_posture.bar.corp.example.com. 300 IN TXT "version=1.48.1-t1234567-gabcdef" "key-expiry=never"`)}},
+				"ns.corp.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"peer with funnel": {
+			config: funnelConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					ID:           "nFooCNTRL",
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+				{
+					ID:           "nBarCNTRL",
+					DNSName:      "bar.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.104")},
+				},
+			},
+			hostinfo: map[tailcfg.StableNodeID]tailcfg.HostinfoView{
+				"nFooCNTRL": (&tailcfg.Hostinfo{WireIngress: true}).View(),
+				"nBarCNTRL": (&tailcfg.Hostinfo{}).View(),
+			},
+			want: records{
+				"self.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":   {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"bar.corp.example.com.":   {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+				"foo.public.example.com.": {rrs: []dns.RR{rr(t, "foo.public.example.com. 300 IN CNAME foo.magic-dns.ts.net.")}},
+				"ns.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.public.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"static records": {
+			config: staticConfig,
+			want: records{
+				"self.corp.example.com.": {
+					name: "self.magic-dns.ts.net.",
+					v4:   ips(t, "100.111.112.113"),
+					v6:   ips(t, "fd7a::dead:beef"),
+					rrs:  []dns.RR{rr(t, `self.corp.example.com. 300 IN TXT "static"`)},
+				},
+				"mail.corp.example.com.":   {rrs: []dns.RR{rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net.")}},
+				"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.den.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.rdu.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":          {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"static records without self": {
+			config: Config{
+				DefaultZone:    "corp.example.com.",
+				ReloadInterval: time.Second * 300,
+				Records:        []dns.RR{rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net.")},
+				fastZoneLookup: map[string]bool{"corp.example.com.": true},
+			},
+			// Without a MagicDNS name, no self record is assembled.
+			self: &ipnstate.PeerStatus{},
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+				},
+			},
+			want: records{
+				"foo.corp.example.com.":  {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				"mail.corp.example.com.": {rrs: []dns.RR{rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net.")}},
+			},
+		},
+		"peer with matching tags": {
+			config: fullTestConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+					Tags:         vs[string](t, []string{"tag:campus-den", "tag:prod"}),
+				},
+			},
+			want: records{
+				"self.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":     {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+				"foo.example.com.":          {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+				"foo.den.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+				"ns.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.den.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.rdu.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.example.com.":           {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+		"peer with location": {
+			config: locationConfig,
+			peers: []*ipnstate.PeerStatus{
+				{
+					DNSName:      "foo.magic-dns.ts.net",
+					TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103"), ip(t, "fd7a::abcd")},
+					Tags:         vs[string](t, []string{"tag:campus-den"}),
+				},
+			},
+			want: records{
+				"self.corp.example.com.":    {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"foo.corp.example.com.":     denFoo,
+				"foo.den.corp.example.com.": denFoo,
+				"ns.corp.example.com.":      {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+				"ns.den.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			self := tc.self
+			if self == nil {
+				self = testSelf
+			}
+			got := assemble(&tc.config, self, tc.peers, tc.hostinfo, nil, tc.users)
+			if diff := cmp.Diff(got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		n     Normalization
+		label string
+		want  string
+	}{
+		{label: "café", want: "café"},
+		{n: Normalization{Punycode: true}, label: "café", want: "xn--caf-dma"},
+		{n: Normalization{Punycode: true}, label: "foo", want: "foo"},
+		{n: Normalization{Strip: true}, label: "café", want: "caf"},
+		{n: Normalization{Strip: true}, label: "🚀-db_1", want: "db1"},
+		{n: Normalization{Punycode: true, Strip: true}, label: "🚀_café", want: "xn--caf-dma"},
+	} {
+		if got := normalize(tc.n, tc.label); got != tc.want {
+			t.Errorf("normalize(%+v, %q): got %q, want %q", tc.n, tc.label, got, tc.want)
+		}
+	}
+}
+
+func TestPeerHostname(t *testing.T) {
+	peer := &ipnstate.PeerStatus{
+		DNSName:  "ws-1.example.ts.net.",
+		HostName: "Build_Server.corp.lan",
+	}
+	for _, tc := range []struct {
+		config Config
+		peer   *ipnstate.PeerStatus
+		want   string
+	}{
+		{peer: peer, want: "ws-1"},
+		{config: Config{LabelSource: LabelDNSName}, peer: peer, want: "ws-1"},
+		{config: Config{LabelSource: LabelHostName}, peer: peer, want: "build-server"},
+		{
+			config: Config{LabelSource: LabelHostName},
+			peer:   &ipnstate.PeerStatus{DNSName: "ws-2.example.ts.net.", HostName: "mac-mini.local"},
+			want:   "mac-mini",
+		},
+		{
+			config: Config{LabelSource: LabelHostName, Normalize: Normalization{Punycode: true}},
+			peer:   &ipnstate.PeerStatus{DNSName: "ws-3.example.ts.net.", HostName: "café"},
+			want:   "xn--caf-dma",
+		},
+	} {
+		if got := peerHostname(&tc.config, tc.peer); got != tc.want {
+			t.Errorf("peerHostname(%q, %q): got %q, want %q", tc.config.LabelSource, tc.peer.HostName, got, tc.want)
+		}
+	}
+}
+
+func TestSynthesize(t *testing.T) {
+	// Examples from RFC 6052 section 2.4.
+	for prefix, want := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	} {
+		t.Run(prefix, func(t *testing.T) {
+			if got := synthesize(netip.MustParsePrefix(prefix), ip(t, "192.0.2.33")); got != ip(t, want) {
+				t.Errorf("synthesize: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTailscale_reorder(t *testing.T) {
+	config := fullTestConfig
+	config.Order = OrderRoundRobin
+	ts := &Tailscale{Config: config}
+	for i, want := range []string{"100.101.102.104", "100.101.102.103", "100.101.102.104"} {
+		rrs := []dns.RR{
+			rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+			rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.103"),
+			rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.104"),
+			rr(t, "foo.magic-dns.ts.net. 300 IN AAAA fd7a::abcd"),
+		}
+		ts.reorder(rrs)
+		if _, ok := rrs[0].(*dns.CNAME); !ok {
+			t.Fatalf("reorder %d: CNAME moved: %v", i, rrs)
+		}
+		if got := rrs[1].(*dns.A).A.String(); got != want {
+			t.Errorf("reorder %d: got first address %v, want %v", i, got, want)
+		}
+		if _, ok := rrs[3].(*dns.AAAA); !ok {
+			t.Errorf("reorder %d: AAAA moved: %v", i, rrs)
+		}
+	}
+}
+
+func TestTailscale_reorder_sorted(t *testing.T) {
+	config := fullTestConfig
+	config.Order = OrderSorted
+	ts := &Tailscale{Config: config}
+	rrs := []dns.RR{
+		rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::abcd"),
+		rr(t, "foo.corp.example.com. 300 IN A 100.101.102.104"),
+		rr(t, `foo.corp.example.com. 300 IN TXT "os=linux"`),
+		rr(t, "foo.corp.example.com. 300 IN A 100.101.102.103"),
+		rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::1"),
+	}
+	want := []dns.RR{
+		rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::1"),
+		rr(t, "foo.corp.example.com. 300 IN A 100.101.102.103"),
+		rr(t, `foo.corp.example.com. 300 IN TXT "os=linux"`),
+		rr(t, "foo.corp.example.com. 300 IN A 100.101.102.104"),
+		rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::abcd"),
+	}
+	ts.reorder(rrs)
+	if diff := cmp.Diff(rrs, want, cmpOpts...); diff != "" {
+		t.Errorf("mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestNonTerminals(t *testing.T) {
+	srv := &record{rrs: []dns.RR{rr(t, "_ldap._tcp.dc.corp.example.com. 300 IN SRV 0 0 389 dc1.magic-dns.ts.net.")}}
+	www := &record{rrs: []dns.RR{rr(t, "www.corp.example.com. 300 IN A 100.101.102.103")}}
+	r := records{
+		"_ldap._tcp.dc.corp.example.com.": srv,
+		"www.corp.example.com.":           www,
+		"www.example.net.":                www, // not in a served zone.
+	}
+	nonTerminals(&fullTestConfig, r)
+	want := records{
+		"_ldap._tcp.dc.corp.example.com.": srv,
+		"_tcp.dc.corp.example.com.":       {},
+		"dc.corp.example.com.":            {},
+		"www.corp.example.com.":           www,
+		"www.example.net.":                www,
+	}
+	if diff := cmp.Diff(r, want, cmpOpts...); diff != "" {
+		t.Errorf("mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestTailscale_Ready(t *testing.T) {
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		client: &fakeLocalClient{},
+	}
+	if ready := ts.Ready(); ready {
+		t.Errorf("should not be ready before first call to Startup")
+	}
+	ts.Startup()
+	if ready := ts.Ready(); !ready {
+		t.Errorf("should be ready following call to Startup")
+	}
+	ts.Shutdown()
+	if ready := ts.Ready(); ready {
+		t.Errorf("should not be ready following call to Startup")
+	}
+}
+
+func TestTailscale_ServeDNS(t *testing.T) {
+	testTS := Tailscale{
+		Config: fullTestConfig,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {
+				name: "foo.magic-dns.ts.net.",
+				v4:   ips(t, "100.101.102.103"),
+				v6:   ips(t, "fd7a::abcd"),
+				rrs: []dns.RR{
+					rr(t, `foo.magic-dns.ts.net. 300 IN TXT "os=linux"`),
+				},
+			},
+			"foo.den.corp.example.com.": {
+				name: "foo.magic-dns.ts.net.",
+				v4:   ips(t, "100.101.102.103"),
+				v6:   ips(t, "fd7a::abcd"),
+				rrs: []dns.RR{
+					rr(t, `foo.magic-dns.ts.net. 300 IN HINFO "arm64" "linux"`),
+				},
+			},
+			"foo.example.com.":         {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+			"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			"ns.den.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			"ns.example.com.":          {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			"ns.rdu.corp.example.com.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			"self.corp.example.com.":   {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+
+			"example.com.":                     {rrs: []dns.RR{rr(t, "example.com. 300 IN A 100.101.102.103")}},
+			"mail.corp.example.com.":           {rrs: []dns.RR{rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net.")}},
+			"www.example.com.":                 {rrs: []dns.RR{rr(t, "www.example.com. 300 IN CNAME foo.example.com.")}},
+			"_http._tcp.foo.corp.example.com.": {rrs: []dns.RR{rr(t, "_http._tcp.foo.corp.example.com. 300 IN SRV 0 0 80 foo.magic-dns.ts.net.")}},
+			"_tcp.foo.corp.example.com.":       {},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		req  dns.Msg
+		want *dns.Msg
+	}{
+		// the "invalid" cases test handler behavior in various unsupported
+		// situations.
+
+		"invalid CHAOS A": { // unsupported qclass
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}},
+			},
+		},
+
+		// the "miss" cases test handler behavior when qname is not found.
+
+		"miss IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"miss IN AAAA": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"miss IN ANY": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"miss IN CNAME": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"miss IN MX": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "bar.corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+
+		// the "peer hit" cases test handler behavior when qname matches a peer
+		// in our Tailnet.
+
+		"peer hit ANY A": { // tests ANY class behavior
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
+				},
+			},
+		},
+		"peer hit IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
+				},
+			},
+		},
+		"peer hit IN AAAA": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
+				},
+			},
+		},
+		"peer hit IN ANY": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+					rr(t, "foo.magic-dns.ts.net. 300 IN A     100.101.102.103"),
+					rr(t, "foo.magic-dns.ts.net. 300 IN AAAA  fd7a::abcd"),
+				},
+			},
+		},
+		"peer hit IN CNAME": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				},
+			},
+		},
+		"peer hit IN TXT": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, `foo.corp.example.com. 300 IN TXT "os=linux"`),
+				},
+			},
+		},
+		"service hit IN SRV": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "_http._tcp.foo.corp.example.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "_http._tcp.foo.corp.example.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "_http._tcp.foo.corp.example.com. 300 IN SRV 0 0 80 foo.magic-dns.ts.net."),
+				},
+			},
+		},
+		"service miss IN SRV": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "_ssh._tcp.foo.corp.example.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "_ssh._tcp.foo.corp.example.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"peer hit IN HINFO": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.den.corp.example.com.", Qtype: dns.TypeHINFO, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.den.corp.example.com.", Qtype: dns.TypeHINFO, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, `foo.den.corp.example.com. 300 IN HINFO "arm64" "linux"`),
+				},
+			},
+		},
+		"static hit IN MX": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "mail.corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "mail.corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "mail.corp.example.com. 300 IN MX 10 mx.example.net."),
+				},
+			},
+		},
+		"static hit IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "mail.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "mail.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"static CNAME hit IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "www.example.com. 300 IN CNAME foo.example.com."),
+				},
+			},
+		},
+		"peer hit IN NS": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"empty non-terminal IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "_tcp.foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "_tcp.foo.corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"peer hit IN SOA": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "foo.corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"peer hit IN MX": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+
+		// the "zone hit" cases test handler behavior when qname exists in our
+		// records, regardless of whether the record type is supported or not.
+
+		"zone hit ANY A": { // tests ANY class behavior
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"zone hit IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"apex hit IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "example.com. 300 IN A 100.101.102.103"),
+				},
+			},
+		},
+		"apex miss IN AAAA": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "example.com. 300 IN SOA ns.example.com root.ns.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"zone hit IN AAAA": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"zone hit IN ANY": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"zone hit IN CNAME": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"zone hit IN NS": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "corp.example.com. 300 IN NS ns.corp.example.com."),
+				},
+				Extra: []dns.RR{
+					rr(t, "ns.corp.example.com. 300 IN A 100.111.112.113"),
+					rr(t, "ns.corp.example.com. 300 IN AAAA fd7a::dead:beef"),
+				},
+			},
+		},
+		"zone hit IN SOA": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN NS ns.corp.example.com."),
+				},
+			},
+		},
+		"zone hit IN MX": { // MX is an unsupported record type.
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "corp.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com root.ns.corp.example.com 8675309 300 150 600 150"),
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			rr := &recorder{}
+			testTS.ServeDNS(context.Background(), rr, &tc.req)
+			if diff := cmp.Diff(rr.got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_reverse(t *testing.T) {
+	config := fullTestConfig
+	config.Reverse = true
+	config.fastZoneLookup = map[string]bool{
+		"corp.example.com.":                 true,
+		"100.in-addr.arpa.":                 true,
+		"0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": true,
+	}
+	ts := Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.":                {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a:115c:a1e0::1")},
+			"ns.corp.example.com.":                 {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			"ns.100.in-addr.arpa.":                 {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+			"ns.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113"), v6: ips(t, "fd7a::dead:beef")},
+
+			"103.102.101.100.in-addr.arpa.":                                             {rrs: []dns.RR{rr(t, "103.102.101.100.in-addr.arpa. 300 IN PTR foo.corp.example.com.")}},
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.": {rrs: []dns.RR{rr(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. 300 IN PTR foo.corp.example.com.")}},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		req  dns.Msg
+		want *dns.Msg
+	}{
+		"reverse hit IN PTR": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "103.102.101.100.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "103.102.101.100.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "103.102.101.100.in-addr.arpa. 300 IN PTR foo.corp.example.com."),
+				},
+			},
+		},
+		"reverse hit IN A": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "103.102.101.100.in-addr.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "103.102.101.100.in-addr.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "100.in-addr.arpa. 300 IN SOA ns.100.in-addr.arpa. root.ns.100.in-addr.arpa. 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"reverse hit IN PTR ip6": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true},
+				Compress: true,
+				Answer: []dns.RR{
+					rr(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. 300 IN PTR foo.corp.example.com."),
+				},
+			},
+		},
+		"reverse miss IN PTR ip6": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. 300 IN SOA ns.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. root.ns.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. 8675309 300 150 600 150"),
+				},
+			},
+		},
+		"reverse miss IN PTR": {
+			req: dns.Msg{
+				Question: []dns.Question{{Name: "1.0.64.100.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+			},
+			want: &dns.Msg{
+				Question: []dns.Question{{Name: "1.0.64.100.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+				MsgHdr:   dns.MsgHdr{Response: true, Authoritative: true, Rcode: dns.RcodeNameError},
+				Compress: true,
+				Ns: []dns.RR{
+					rr(t, "100.in-addr.arpa. 300 IN SOA ns.100.in-addr.arpa. root.ns.100.in-addr.arpa. 8675309 300 150 600 150"),
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			rr := &recorder{}
+			ts.ServeDNS(context.Background(), rr, &tc.req)
+			if diff := cmp.Diff(rr.got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_flatten(t *testing.T) {
+	config := fullTestConfig
+	config.Answer = AnswerFlatten
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {
+				name: "foo.magic-dns.ts.net.",
+				v4:   ips(t, "100.101.102.103"),
+				v6:   ips(t, "fd7a::abcd"),
+				rrs:  []dns.RR{rr(t, `foo.magic-dns.ts.net. 300 IN TXT "os=linux"`)},
+			},
+			"bar.corp.example.com.": {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR
+	}{
+		"A": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeA,
+			want: []dns.RR{rr(t, "foo.corp.example.com. 300 IN A 100.101.102.103")},
+		},
+		"AAAA": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeAAAA,
+			want: []dns.RR{rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::abcd")},
+		},
+		"ANY": {
+			qn: "foo.corp.example.com.",
+			qt: dns.TypeANY,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN A 100.101.102.103"),
+				rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::abcd"),
+				rr(t, `foo.corp.example.com. 300 IN TXT "os=linux"`),
+			},
+		},
+		"TXT": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeTXT,
+			want: []dns.RR{rr(t, `foo.corp.example.com. 300 IN TXT "os=linux"`)},
+		},
+		"no CNAME": {qn: "foo.corp.example.com.", qt: dns.TypeCNAME},
+		"no AAAA":  {qn: "bar.corp.example.com.", qt: dns.TypeAAAA},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_zone(t *testing.T) {
+	config := fullTestConfig
+	config.Answer = AnswerZone
+	foo := &record{name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")}
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.":     foo,
+			"foo.den.corp.example.com.": foo,
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR
+	}{
+		"A": {
+			qn: "foo.den.corp.example.com.",
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo.den.corp.example.com. 300 IN CNAME foo.corp.example.com."),
+				rr(t, "foo.corp.example.com. 300 IN A 100.101.102.103"),
+			},
+		},
+		"CNAME": {
+			qn:   "foo.den.corp.example.com.",
+			qt:   dns.TypeCNAME,
+			want: []dns.RR{rr(t, "foo.den.corp.example.com. 300 IN CNAME foo.corp.example.com.")},
+		},
+		"target A": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeA,
+			want: []dns.RR{rr(t, "foo.corp.example.com. 300 IN A 100.101.102.103")},
+		},
+		"target AAAA": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeAAAA,
+			want: []dns.RR{rr(t, "foo.corp.example.com. 300 IN AAAA fd7a::abcd")},
+		},
+		"target no CNAME": {qn: "foo.corp.example.com.", qt: dns.TypeCNAME},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_zoneAnswers(t *testing.T) {
+	config := fullTestConfig
+	config.ZoneAnswers = map[string]AnswerMode{"example.com.": AnswerFlatten}
+	foo := &record{name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")}
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": foo,
+			"foo.example.com.":      foo,
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		want []dns.RR
+	}{
+		"cname": {
+			qn: "foo.corp.example.com.",
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.103"),
+			},
+		},
+		"flattened": {
+			qn:   "foo.example.com.",
+			want: []dns.RR{rr(t, "foo.example.com. 300 IN A 100.101.102.103")},
+		},
+	} {
 		t.Run(tn, func(t *testing.T) {
-			rr := &recorder{}
-			testTS.ServeDNS(context.Background(), rr, &tc.req)
-			if diff := cmp.Diff(rr.got, tc.want, cmpOpts...); diff != "" {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, dns.TypeA)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_families(t *testing.T) {
+	config := fullTestConfig
+	config.Families = map[string]AddressFamily{"": FamilyIPv4Only, "example.com.": FamilyIPv6Only}
+	foo := &record{name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")}
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": foo,
+			"foo.example.com.":      foo,
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR
+	}{
+		"A": {
+			qn: "foo.corp.example.com.",
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.103"),
+			},
+		},
+		"suppressed AAAA": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeAAAA,
+			want: []dns.RR{rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net.")},
+		},
+		"ANY": {
+			qn: "foo.example.com.",
+			qt: dns.TypeANY,
+			want: []dns.RR{
+				rr(t, "foo.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN AAAA fd7a::abcd"),
+			},
+		},
+		"suppressed A": {
+			qn:   "foo.example.com.",
+			qt:   dns.TypeA,
+			want: []dns.RR{rr(t, "foo.example.com. 300 IN CNAME foo.magic-dns.ts.net.")},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_types(t *testing.T) {
+	config := fullTestConfig
+	config.Types = map[string]map[uint16]bool{
+		"example.com.":      {dns.TypeA: true, dns.TypeAAAA: true},
+		"corp.example.com.": {dns.TypeCNAME: true, dns.TypeA: true, dns.TypeAAAA: true, dns.TypeTXT: true},
+	}
+	foo := &record{
+		name: "foo.magic-dns.ts.net.",
+		v4:   ips(t, "100.101.102.103"),
+		rrs: []dns.RR{
+			rr(t, `foo.magic-dns.ts.net. 300 IN TXT "os=linux"`),
+			rr(t, `foo.magic-dns.ts.net. 300 IN HINFO "x86_64" "linux"`),
+		},
+	}
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": foo,
+			"foo.example.com.":      foo,
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR
+	}{
+		"CNAME": {
+			qn: "foo.corp.example.com.",
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.103"),
+			},
+		},
+		"TXT": {
+			qn:   "foo.corp.example.com.",
+			qt:   dns.TypeTXT,
+			want: []dns.RR{rr(t, `foo.corp.example.com. 300 IN TXT "os=linux"`)},
+		},
+		"no HINFO": {qn: "foo.corp.example.com.", qt: dns.TypeHINFO},
+		"flattened": {
+			qn:   "foo.example.com.",
+			qt:   dns.TypeA,
+			want: []dns.RR{rr(t, "foo.example.com. 300 IN A 100.101.102.103")},
+		},
+		"flattened ANY": {
+			qn:   "foo.example.com.",
+			qt:   dns.TypeANY,
+			want: []dns.RR{rr(t, "foo.example.com. 300 IN A 100.101.102.103")},
+		},
+		"no TXT":   {qn: "foo.example.com.", qt: dns.TypeTXT},
+		"no CNAME": {qn: "foo.example.com.", qt: dns.TypeCNAME},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_shortNames(t *testing.T) {
+	config := fullTestConfig
+	config.ShortNames = true
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			"www.corp.example.com.": {rrs: []dns.RR{rr(t, "www.corp.example.com. 300 IN CNAME foo.corp.example.com.")}},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR // Nil if the query should be left to the next plugin.
+	}{
+		"A": {
+			qn: "foo.",
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.103"),
+			},
+		},
+		"miss":            {qn: "bar.", qt: dns.TypeA},
+		"static records":  {qn: "www.", qt: dns.TypeA},
+		"other type":      {qn: "foo.", qt: dns.TypeMX},
+		"multiple labels": {qn: "foo.example.net.", qt: dns.TypeA},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if tc.want == nil {
+				if rec.got != nil {
+					t.Errorf("got response %v, want none", rec.got)
+				}
+				return
+			}
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_noAuthority(t *testing.T) {
+	config := fullTestConfig
+	config.NoAuthority = true
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR // Nil if the query should be left to the next plugin.
+	}{
+		"A": {
+			qn: "foo.corp.example.com.",
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN A 100.101.102.103"),
+			},
+		},
+		"NS":       {qn: "corp.example.com.", qt: dns.TypeNS},
+		"SOA":      {qn: "corp.example.com.", qt: dns.TypeSOA},
+		"NODATA":   {qn: "foo.corp.example.com.", qt: dns.TypeMX},
+		"NXDOMAIN": {qn: "bar.corp.example.com.", qt: dns.TypeA},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if tc.want == nil {
+				if rec.got != nil {
+					t.Errorf("got response %v, want none", rec.got)
+				}
+				return
+			}
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+			if len(rec.got.Ns) > 0 {
+				t.Errorf("got authority section %v, want none", rec.got.Ns)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNS_nameservers(t *testing.T) {
+	ts := &Tailscale{
+		Config:           fullTestConfig,
+		serial:           8675309,
+		nameserverLabels: []string{"bar", "foo"},
+		hosts: records{
+			"ns.corp.example.com.":     {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+			"bar.ns.corp.example.com.": {name: "bar.magic-dns.ts.net.", v4: ips(t, "100.101.102.104")},
+			"foo.ns.corp.example.com.": {name: "foo.magic-dns.ts.net.", v6: ips(t, "fd7a::abcd")},
+		},
+	}
+	req := &dns.Msg{}
+	req.SetQuestion("corp.example.com.", dns.TypeNS)
+	rec := &recorder{}
+	ts.ServeDNS(context.Background(), rec, req)
+	if rec.got == nil {
+		t.Fatal("no response written")
+	}
+	wantAnswer := []dns.RR{
+		rr(t, "corp.example.com. 300 IN NS ns.corp.example.com."),
+		rr(t, "corp.example.com. 300 IN NS bar.ns.corp.example.com."),
+		rr(t, "corp.example.com. 300 IN NS foo.ns.corp.example.com."),
+	}
+	if diff := cmp.Diff(rec.got.Answer, wantAnswer, cmpOpts...); diff != "" {
+		t.Errorf("answer mismatch: (-got,+want):\n%v", diff)
+	}
+	wantExtra := []dns.RR{
+		rr(t, "ns.corp.example.com. 300 IN A 100.111.112.113"),
+		rr(t, "bar.ns.corp.example.com. 300 IN A 100.101.102.104"),
+		rr(t, "foo.ns.corp.example.com. 300 IN AAAA fd7a::abcd"),
+	}
+	if diff := cmp.Diff(rec.got.Extra, wantExtra, cmpOpts...); diff != "" {
+		t.Errorf("extra mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestTailscale_ServeDNS_authority(t *testing.T) {
+	config := fullTestConfig
+	config.Authority = true
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.den.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	req := &dns.Msg{}
+	req.SetQuestion("foo.den.corp.example.com.", dns.TypeA)
+	rec := &recorder{}
+	ts.ServeDNS(context.Background(), rec, req)
+	if rec.got == nil {
+		t.Fatal("no response written")
+	}
+	want := []dns.RR{rr(t, "den.corp.example.com. 300 IN NS ns.den.corp.example.com.")}
+	if diff := cmp.Diff(rec.got.Ns, want, cmpOpts...); diff != "" {
+		t.Errorf("mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestTailscale_ServeDNS_minimal(t *testing.T) {
+	config := fullTestConfig
+	config.Authority = true
+	config.Minimal = true
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			"ns.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn string
+		qt uint16
+	}{
+		"NS":    {qn: "corp.example.com.", qt: dns.TypeNS},
+		"SOA":   {qn: "corp.example.com.", qt: dns.TypeSOA},
+		"CNAME": {qn: "foo.corp.example.com.", qt: dns.TypeA},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if len(rec.got.Answer) == 0 {
+				t.Errorf("got no answer")
+			}
+			if len(rec.got.Ns) > 0 || len(rec.got.Extra) > 0 {
+				t.Errorf("got optional data: authority %v, additional %v", rec.got.Ns, rec.got.Extra)
+			}
+		})
+	}
+}
+
+func TestTailscale_authority(t *testing.T) {
+	config := fullTestConfig
+	ts := &Tailscale{Config: config}
+	want := rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com. root.ns.corp.example.com. 8675309 300 150 600 150")
+	if diff := cmp.Diff(ts.authority("corp.example.com.", 8675309), want, cmpOpts...); diff != "" {
+		t.Errorf("derived timers mismatch: (-got,+want):\n%v", diff)
+	}
+
+	ts.SOA = SOATimers{Refresh: time.Hour, Retry: 15 * time.Minute, Expire: 168 * time.Hour, Minimum: 30 * time.Second}
+	want = rr(t, "corp.example.com. 300 IN SOA ns.corp.example.com. root.ns.corp.example.com. 8675309 3600 900 604800 30")
+	if diff := cmp.Diff(ts.authority("corp.example.com.", 8675309), want, cmpOpts...); diff != "" {
+		t.Errorf("configured timers mismatch: (-got,+want):\n%v", diff)
+	}
+
+	ts.SOA = SOATimers{}
+	ts.NSNames = map[string]string{"": "dns1", "example.com.": "ns1.example.net."}
+	for zone, want := range map[string]string{
+		"corp.example.com.": "dns1.corp.example.com.",
+		"example.com.":      "ns1.example.net.",
+	} {
+		if got := ts.authority(zone, 8675309).Ns; got != want {
+			t.Errorf("nameserver of %v: got %q, want %q", zone, got, want)
+		}
+	}
+
+	ts.Mailboxes = map[string]string{"": "hostmaster.example.com.", "example.com.": `first\.last.example.com.`}
+	for zone, want := range map[string]string{
+		"corp.example.com.": "hostmaster.example.com.",
+		"example.com.":      `first\.last.example.com.`,
+	} {
+		if got := ts.authority(zone, 8675309).Mbox; got != want {
+			t.Errorf("mailbox of %v: got %q, want %q", zone, got, want)
+		}
+	}
+
+	ts.NSNames, ts.Mailboxes = nil, nil
+	ts.SOA = SOATimers{Refresh: time.Hour, Retry: 15 * time.Minute, Expire: 168 * time.Hour, Minimum: 30 * time.Second}
+	ts.ZoneSOA = map[string]SOATimers{"example.com.": {Refresh: 2 * time.Hour, Retry: time.Hour, Expire: 336 * time.Hour, Minimum: time.Hour}}
+	for zone, want := range map[string]string{
+		"corp.example.com.": "corp.example.com. 300 IN SOA ns.corp.example.com. root.ns.corp.example.com. 8675309 3600 900 604800 30",
+		"example.com.":      "example.com. 300 IN SOA ns.example.com. root.ns.example.com. 8675309 7200 3600 1209600 3600",
+	} {
+		if diff := cmp.Diff(ts.authority(zone, 8675309), rr(t, want), cmpOpts...); diff != "" {
+			t.Errorf("zone timers of %v mismatch: (-got,+want):\n%v", zone, diff)
+		}
+	}
+}
+
+func TestTailscale_ServeDNS_negativeTTL(t *testing.T) {
+	config := fullTestConfig
+	config.NegativeTTL = 10 * time.Second
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn string
+		qt uint16
+	}{
+		"NXDOMAIN": {qn: "bar.corp.example.com.", qt: dns.TypeA},
+		"NODATA":   {qn: "foo.corp.example.com.", qt: dns.TypeMX},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			want := []dns.RR{rr(t, "corp.example.com. 10 IN SOA ns.corp.example.com. root.ns.corp.example.com. 8675309 300 150 600 10")}
+			if diff := cmp.Diff(rec.got.Ns, want, cmpOpts...); diff != "" {
 				t.Errorf("mismatch: (-got,+want):\n%v", diff)
 			}
 		})
 	}
 }
+
+func TestTailscale_ServeDNS_ttl(t *testing.T) {
+	config := fullTestConfig
+	config.TTL = 30 * time.Second
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		qt   uint16
+		want []dns.RR
+	}{
+		"A": {
+			qn: "foo.corp.example.com.",
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 30 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 30 IN A 100.101.102.103"),
+			},
+		},
+		"SOA": {
+			// The timers are still derived from the ReloadInterval.
+			qn:   "corp.example.com.",
+			qt:   dns.TypeSOA,
+			want: []dns.RR{rr(t, "corp.example.com. 30 IN SOA ns.corp.example.com. root.ns.corp.example.com. 8675309 300 150 600 150")},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tc.qn, tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_reload(t *testing.T) {
+	client := &fakeLocalClient{
+		status: ipnstate.Status{
+			Self: &ipnstate.PeerStatus{
+				DNSName:      "self.magic-dns.ts.net.",
+				TailscaleIPs: []netip.Addr{ip(t, "100.111.112.113")},
+			},
+		},
+	}
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		client: client,
+	}
+	ts.reload()
+	ts.bumpSerials(ts.zones(), time.Unix(8675309, 0))
+	first := ts.serial
+
+	ts.reload()
+	if ts.serial != first {
+		t.Errorf("serial changed by reload which did not change records")
+	}
+
+	client.status.Peer = map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {
+			DNSName:      "foo.magic-dns.ts.net.",
+			TailscaleIPs: []netip.Addr{ip(t, "100.101.102.103")},
+		},
+	}
+	ts.reload()
+	if ts.serial == first {
+		t.Errorf("serial not changed by reload which changed records")
+	}
+	if ts.serialOf("corp.example.com.") == first {
+		t.Errorf("serial of changed zone not changed by reload")
+	}
+	if ts.serialOf("example.com.") != first {
+		t.Errorf("serial of unchanged zone changed by reload")
+	}
+}
+
+func TestTailscale_reloadTimeout(t *testing.T) {
+	config := fullTestConfig
+	config.Timeout = 10 * time.Millisecond
+	ts := &Tailscale{
+		Config: config,
+		client: &fakeLocalClient{hang: true},
+	}
+	done := make(chan struct{})
+	go func() {
+		ts.reload()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reload not bounded by the timeout")
+	}
+	if ts.hosts != nil {
+		t.Errorf("records assembled from a Status call which timed out")
+	}
+}
+
+func TestTailscale_ServeDNS_flags(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		noAuthoritative    bool
+		recursionAvailable bool
+	}{
+		"default":             {},
+		"not authoritative":   {noAuthoritative: true},
+		"recursion available": {recursionAvailable: true},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			config := fullTestConfig
+			config.NoAuthoritative = tc.noAuthoritative
+			config.RecursionAvailable = tc.recursionAvailable
+			ts := &Tailscale{
+				Config: config,
+				serial: 8675309,
+				hosts: records{
+					"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+				},
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("foo.corp.example.com.", dns.TypeA)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if got, want := rec.got.Authoritative, !tc.noAuthoritative; got != want {
+				t.Errorf("Authoritative = %v, want %v", got, want)
+			}
+			if got, want := rec.got.RecursionAvailable, tc.recursionAvailable; got != want {
+				t.Errorf("RecursionAvailable = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTailscale_ServeDNSStale(t *testing.T) {
+	config := fullTestConfig
+	config.MaxStale = time.Hour
+	ts := &Tailscale{
+		Config: config,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+		},
+		Next: test.NextHandler(dns.RcodeRefused, nil),
+	}
+	for tn, tc := range map[string]struct {
+		reloaded  time.Duration // ago.
+		qn        string
+		wantRcode int
+	}{
+		"fresh":             {reloaded: time.Minute, qn: "foo.corp.example.com.", wantRcode: dns.RcodeSuccess},
+		"stale":             {reloaded: 2 * time.Hour, qn: "foo.corp.example.com.", wantRcode: dns.RcodeServerFailure},
+		"stale not covered": {reloaded: 2 * time.Hour, qn: "foo.example.net.", wantRcode: dns.RcodeRefused},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			ts.reloaded = time.Now().Add(-tc.reloaded)
+			if got, want := ts.Ready(), tc.reloaded < config.MaxStale; got != want {
+				t.Errorf("Ready() = %v, want %v", got, want)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qn, dns.TypeA)
+			rcode, _ := ts.ServeDNS(context.Background(), &recorder{}, req)
+			if rcode != tc.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tc.wantRcode])
+			}
+		})
+	}
+}
+
+func TestTailscale_lookup(t *testing.T) {
+	foo := &record{name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")}
+	apps := &record{rrs: []dns.RR{rr(t, "*.apps.corp.example.com. 300 IN CNAME ingress.corp.example.com.")}}
+	api := &record{rrs: []dns.RR{rr(t, "api.apps.corp.example.com. 300 IN A 100.101.102.104")}}
+	ldap := &record{rrs: []dns.RR{rr(t, "_ldap._tcp.corp.example.com. 300 IN SRV 0 0 389 dc1.corp.example.com.")}}
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		serial: 8675309,
+		hosts: records{
+			"foo.corp.example.com.":      foo,
+			"*.foo.corp.example.com.":    foo,
+			"*.apps.corp.example.com.":   apps,
+			"api.apps.corp.example.com.": api,
+
+			"_ldap._tcp.corp.example.com.": ldap,
+		},
+	}
+	for tn, tc := range map[string]struct {
+		qn   string
+		want *record
+	}{
+		"exact":                 {qn: "foo.corp.example.com.", want: foo},
+		"wildcard":              {qn: "www.foo.corp.example.com.", want: foo},
+		"wildcard deeper":       {qn: "a.b.foo.corp.example.com.", want: foo},
+		"static wildcard":       {qn: "www.apps.corp.example.com.", want: apps},
+		"closer existing name":  {qn: "v1.api.apps.corp.example.com."},
+		"existing name":         {qn: "api.apps.corp.example.com.", want: api},
+		"underscore labels":     {qn: "_ldap._tcp.corp.example.com.", want: ldap},
+		"no wildcard":           {qn: "www.bar.corp.example.com."},
+		"wildcard is not apex":  {qn: "apps.corp.example.com."},
+		"miss at zone boundary": {qn: "corp.example.com."},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got, _ := ts.lookup(tc.qn, "corp.example.com.")
+			if diff := cmp.Diff(got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("lookup(%q) mismatch: (-got,+want):\n%v", tc.qn, diff)
+			}
+		})
+	}
+}
+
+func TestTailscale_peerTTL(t *testing.T) {
+	ts := &Tailscale{Config: fullTestConfig}
+	regular := &record{name: "web1.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")}
+	ephemeral := &record{name: "runner1.magic-dns.ts.net.", v4: ips(t, "100.101.102.104"), ttl: 30}
+	expiring := func(in time.Duration) *record {
+		return &record{name: "web2.magic-dns.ts.net.", v4: ips(t, "100.101.102.105"), keyExpiry: time.Now().Add(in)}
+	}
+	for tn, tc := range map[string]struct {
+		hr   *record
+		want uint32
+	}{
+		"regular":           {hr: regular, want: 300},
+		"ephemeral":         {hr: ephemeral, want: 30},
+		"key expires later": {hr: expiring(time.Hour), want: 300},
+		"key expires soon":  {hr: expiring(60*time.Second + 500*time.Millisecond), want: 60},
+		"key expired":       {hr: expiring(-time.Minute), want: 1},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			rrs := append(ts.A("corp.example.com.", tc.hr), ts.cname("foo.corp.example.com.", "corp.example.com.", tc.hr))
+			rrs = append(rrs, ts.flat("foo.corp.example.com.", dns.TypeA, tc.hr)...)
+			for _, rr := range rrs {
+				if got := rr.Header().Ttl; got != tc.want {
+					t.Errorf("TTL of %v = %d, want %d", rr, got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -3,13 +3,16 @@ package corednstailscale
 import (
 	"context"
 	"net/netip"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/google/go-cmp/cmp"
 	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
 )
 
@@ -21,6 +24,9 @@ var (
 		cmp.Comparer(func(l, r netip.Addr) bool {
 			return l.Compare(r) == 0
 		}),
+		cmp.Comparer(func(l, r netip.Prefix) bool {
+			return l == r
+		}),
 	}
 
 	// fullTestConfig in which all fields are populated and can be used to
@@ -45,13 +51,53 @@ var (
 // fakeLocalClient implements the clientish interface for testing.
 type fakeLocalClient struct {
 	status ipnstate.Status
-	err    error
+	netmap netmap.NetworkMap
+	whois  map[string]*apitype.WhoIsResponse // keyed by remote address.
+
+	whoisCalls atomic.Int32 // number of calls to WhoIs.
+	err        error
+	hang       bool // Status blocks until its context is done.
+
+	// changes are sent to the watcher of the network map, which blocks until
+	// its context is done if nil.
+	changes chan struct{}
 }
 
-func (c *fakeLocalClient) Status(context.Context) (*ipnstate.Status, error) {
+func (c *fakeLocalClient) Status(ctx context.Context) (*ipnstate.Status, error) {
+	if c.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 	return &c.status, c.err
 }
 
+func (c *fakeLocalClient) NetMap(context.Context) (*netmap.NetworkMap, error) {
+	return &c.netmap, c.err
+}
+
+func (c *fakeLocalClient) WatchNetMap(ctx context.Context, changed func()) error {
+	for {
+		select {
+		case <-c.changes:
+			changed()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *fakeLocalClient) WhoIs(_ context.Context, addr string) (*apitype.WhoIsResponse, error) {
+	c.whoisCalls.Add(1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	who, has := c.whois[addr]
+	if !has {
+		return nil, errNoNode
+	}
+	return who, nil
+}
+
 // recorder implements the ResponseWriter interface for testing.
 type recorder struct {
 	test.ResponseWriter
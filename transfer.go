@@ -0,0 +1,93 @@
+package corednstailscale
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// zoneRecords returns all of the records in zone, ordered by name. Names which
+// belong to a more specific zone served by this plugin are excluded, as are
+// those of owned peers in the personal zone, since the requester of a transfer
+// can't be told apart. Must be called with the read lock held.
+func (ts *Tailscale) zoneRecords(zone string) []dns.RR {
+	var names []string
+	for name := range ts.hosts.in(&ts.Config, zone) {
+		if zone == ts.PersonalZone && ts.hosts.ownerOf(name, zone) != 0 {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rrs []dns.RR
+	for _, name := range names {
+		hr := ts.hosts[name]
+		if hr.name != "" && !ts.flattened(name, zone, hr) {
+			// A CNAME can't coexist with other data, so any additional records
+			// are omitted. The addresses belong to the target, which is served
+			// under its own name.
+			rrs = append(rrs, ts.cname(name, zone, hr))
+			continue
+		}
+		if hr.name != "" {
+			rrs = append(rrs, ts.flat(name, dns.TypeANY, hr)...)
+			continue
+		}
+		for _, rr := range hr.rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+	}
+
+	// The nested zones are delegated, with glue for nameservers within them.
+	for _, child := range ts.delegations(zone) {
+		nss := ts.nameservers(child)
+		rrs = append(rrs, nss...)
+		for _, ns := range nss {
+			target := ns.(*dns.NS).Ns
+			if hr := ts.hosts[target]; hr != nil && dns.IsSubDomain(child, target) {
+				rrs = append(rrs, addresses(&ts.Config, target, append(hr.v4[:len(hr.v4):len(hr.v4)], hr.v6...))...)
+			}
+		}
+	}
+	return ts.served(zone, rrs)
+}
+
+// Transfer the contents of a zone served by this plugin. Satisfies the coredns
+// transfer.Transferer interface.
+func (ts *Tailscale) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	zone = dns.CanonicalName(zone)
+	if !ts.fastZoneLookup[zone] || ts.NoAuthority {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	ts.RLock()
+	defer ts.RUnlock()
+	if ts.hosts == nil {
+		return nil, errors.New("records not yet assembled")
+	}
+	soa := ts.authority(zone, ts.serialOf(zone))
+	nss := ts.nameservers(zone)
+	var rrs []dns.RR
+	if serial != soa.Serial {
+		rrs = ts.zoneRecords(zone)
+	}
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+		if serial != 0 && serial == soa.Serial {
+			// The requester is up to date, so only the SOA is sent.
+			ch <- []dns.RR{soa}
+			return
+		}
+		ch <- append([]dns.RR{soa}, nss...)
+		ch <- rrs
+		ch <- []dns.RR{soa}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,73 @@
+package corednstailscale
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestTailscale_Transfer(t *testing.T) {
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		serial: 8675309,
+		hosts: records{
+			"foo.example.com.":      {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), rrs: []dns.RR{rr(t, `foo.magic-dns.ts.net. 300 IN TXT "os=linux"`)}},
+			"ns.example.com.":       {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+			"www.example.com.":      {rrs: []dns.RR{rr(t, "www.example.com. 300 IN CNAME foo.example.com.")}},
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103")},
+			"ns.corp.example.com.":  {name: "self.magic-dns.ts.net.", v4: ips(t, "100.111.112.113")},
+		},
+	}
+	soa := rr(t, "example.com. 300 IN SOA ns.example.com. root.ns.example.com. 8675309 300 150 600 150")
+
+	for tn, tc := range map[string]struct {
+		zone    string
+		serial  uint32
+		want    []dns.RR
+		wantErr error
+	}{
+		"axfr": {
+			zone: "example.com.",
+			want: []dns.RR{
+				soa,
+				rr(t, "example.com. 300 IN NS ns.example.com."),
+				rr(t, "foo.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "ns.example.com. 300 IN CNAME self.magic-dns.ts.net."),
+				rr(t, "www.example.com. 300 IN CNAME foo.example.com."),
+				// The nested corp.example.com. is delegated, with glue.
+				rr(t, "corp.example.com. 300 IN NS ns.corp.example.com."),
+				rr(t, "ns.corp.example.com. 300 IN A 100.111.112.113"),
+				soa,
+			},
+		},
+		"ixfr up to date": {
+			zone:   "example.com.",
+			serial: 8675309,
+			want:   []dns.RR{soa},
+		},
+		"not authoritative": {
+			zone:    "example.net.",
+			wantErr: transfer.ErrNotAuthoritative,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			ch, err := ts.Transfer(tc.zone, tc.serial)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Transfer(%q): got error %v, want %v", tc.zone, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []dns.RR
+			for rrs := range ch {
+				got = append(got, rrs...)
+			}
+			if diff := cmp.Diff(got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
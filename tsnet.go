@@ -0,0 +1,92 @@
+//go:build tsnet
+
+package corednstailscale
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// embeddedNode is a node run with tsnet.
+type embeddedNode struct {
+	*localClient // set once started.
+
+	config    *TSNet
+	server    *tsnet.Server
+	listeners []net.Listener
+}
+
+// newNode returns the embedded node configured by config, which joins the
+// tailnet once started.
+func newNode(config *TSNet) (node, error) {
+	return &embeddedNode{
+		config: config,
+		server: &tsnet.Server{
+			Hostname:   config.Hostname,
+			Dir:        config.StateDir,
+			Ephemeral:  config.Ephemeral,
+			ControlURL: config.ControlURL,
+			Logf: func(format string, args ...any) {
+				log.Debugf(format, args...)
+			},
+		},
+	}, nil
+}
+
+func (n *embeddedNode) start(h plugin.Handler) error {
+	key, err := authKey(n.config)
+	if err != nil {
+		return err
+	}
+	n.server.AuthKey = key
+	lc, err := n.server.LocalClient()
+	if err != nil {
+		return fmt.Errorf("failed starting tsnet: %v", err)
+	}
+	n.localClient = &localClient{tailscale.LocalClient{Dial: lc.Dial}}
+
+	handler := handlerFor(h)
+	for _, addr := range n.config.Listen {
+		tcp, err := n.server.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed listening on %s over tsnet: %v", addr, err)
+		}
+		n.listeners = append(n.listeners, tcp)
+		go func() {
+			srv := &dns.Server{Listener: tcp, Net: "tcp", Handler: handler}
+			if err := srv.ActivateAndServe(); err != nil {
+				log.Debugf("Stopped serving TCP over tsnet: %v", err)
+			}
+		}()
+
+		udp, err := n.server.Listen("udp", addr)
+		if err != nil {
+			return fmt.Errorf("failed listening on %s over tsnet: %v", addr, err)
+		}
+		n.listeners = append(n.listeners, udp)
+		go func() {
+			for {
+				conn, err := udp.Accept()
+				if err != nil {
+					log.Debugf("Stopped serving UDP over tsnet: %v", err)
+					return
+				}
+				go serveFlow(conn, handler)
+			}
+		}()
+	}
+	return nil
+}
+
+// Close stops serving, and leaves the tailnet.
+func (n *embeddedNode) Close() error {
+	for _, ln := range n.listeners {
+		ln.Close()
+	}
+	return n.server.Close()
+}
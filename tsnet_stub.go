@@ -0,0 +1,11 @@
+//go:build !tsnet
+
+package corednstailscale
+
+import "errors"
+
+// newNode fails, since tsnet and its dependencies are only built with the
+// tsnet build tag.
+func newNode(*TSNet) (node, error) {
+	return nil, errors.New("tsnet requires CoreDNS built with -tags tsnet")
+}
@@ -0,0 +1,301 @@
+package corednstailscale
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// acmeChallengeLabel is prepended to a name to form the owner of the TXT
+// records for ACME DNS-01 challenges, per RFC 8555 section 8.4.
+const acmeChallengeLabel = "_acme-challenge"
+
+// withUpdates returns the assembled records with those added by dynamic
+// updates merged in. The assembled records are not modified. Must be called
+// with the lock held.
+func (ts *Tailscale) withUpdates(assembled records) records {
+	if len(ts.updates) == 0 || assembled == nil {
+		return assembled
+	}
+	r := make(records, len(assembled)+len(ts.updates))
+	for name, rec := range assembled {
+		r[name] = rec
+	}
+	merge(r, ts.updates)
+	nonTerminals(&ts.Config, r)
+	return r
+}
+
+// whois returns the tailnet node at addr, or nil if it can't be identified.
+func (ts *Tailscale) whois(ctx context.Context, addr net.Addr) *tailcfg.Node {
+	if addr == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, ts.timeout())
+	defer cancel()
+	who, err := ts.client.WhoIs(ctx, addr.String())
+	if err != nil {
+		log.Warningf("Failed identifying update sender %v: %v", addr, err)
+		return nil
+	}
+	if who == nil {
+		return nil
+	}
+	return who.Node
+}
+
+// authorized returns true if node carries the tag which permits dynamic
+// updates.
+func (ts *Tailscale) authorized(node *tailcfg.Node) bool {
+	if node == nil || ts.UpdateTag == "" {
+		return false
+	}
+	want := "tag:" + ts.UpdateTag
+	for _, tag := range node.Tags {
+		if tag == want {
+			return true
+		}
+	}
+	return false
+}
+
+// challenges returns true if the updates only touch ACME DNS-01 challenge TXT
+// records for names of node, which any node may publish when enabled.
+func (ts *Tailscale) challenges(node *tailcfg.Node, updates []dns.RR) bool {
+	if node == nil || !ts.ACME || len(updates) == 0 {
+		return false
+	}
+	tsdns := dns.CanonicalName(node.Name)
+	ts.RLock()
+	defer ts.RUnlock()
+	for _, rr := range updates {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeTXT {
+			return false
+		}
+		name, found := strings.CutPrefix(dns.CanonicalName(h.Name), acmeChallengeLabel+".")
+		if !found {
+			return false
+		}
+		if hr := ts.hosts[name]; hr == nil || hr.name != tsdns {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUpdate validates the update section of a dynamic update for zone, and
+// returns the response code with which invalid updates should be refused.
+func checkUpdate(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, dns.CanonicalName(h.Name)) {
+			return dns.RcodeNotZone
+		}
+		switch h.Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+			// These are synthesized, and cannot be updated.
+			return dns.RcodeRefused
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if h.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || h.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate applies the update section of a dynamic update to the existing
+// records, per RFC 2136 section 3.4.2, and returns the result.
+func applyUpdate(existing, updates []dns.RR) []dns.RR {
+	ret := existing[:len(existing):len(existing)]
+	for _, u := range updates {
+		h := u.Header()
+		name := dns.CanonicalName(h.Name)
+		switch h.Class {
+		case dns.ClassINET:
+			rr := dns.Copy(u)
+			rr.Header().Name = name
+			var dup bool
+			for _, e := range ret {
+				if dns.IsDuplicate(e, rr) {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				ret = append(ret, rr)
+			}
+
+		case dns.ClassANY:
+			// Delete an RRset, or all RRsets at the name.
+			ret = filter(ret, func(e dns.RR) bool {
+				eh := e.Header()
+				return eh.Name == name && (h.Rrtype == dns.TypeANY || eh.Rrtype == h.Rrtype)
+			})
+
+		case dns.ClassNONE:
+			// Delete a single RR.
+			rr := dns.Copy(u)
+			rr.Header().Name = name
+			rr.Header().Class = dns.ClassINET
+			ret = filter(ret, func(e dns.RR) bool {
+				return dns.IsDuplicate(e, rr)
+			})
+		}
+	}
+	return ret
+}
+
+// filter returns a new slice of the records for which drop returns false.
+func filter(rrs []dns.RR, drop func(dns.RR) bool) []dns.RR {
+	var ret []dns.RR
+	for _, rr := range rrs {
+		if !drop(rr) {
+			ret = append(ret, rr)
+		}
+	}
+	return ret
+}
+
+// loadUpdates reads records added by dynamic updates from the update file, if
+// one is configured and exists.
+func (ts *Tailscale) loadUpdates() error {
+	if ts.UpdateFile == "" {
+		return nil
+	}
+	f, err := os.Open(ts.UpdateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var updates []dns.RR
+	zp := dns.NewZoneParser(f, ".", ts.UpdateFile)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if ts.zoneOf(rr.Header().Name) == "" {
+			log.Warningf("Ignoring updated record outside of served zones: %v", rr)
+			continue
+		}
+		updates = append(updates, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+	ts.updates = updates
+	return nil
+}
+
+// saveUpdates writes records added by dynamic updates to the update file, if
+// one is configured, so that they survive restarts. Must be called with the
+// lock held.
+func (ts *Tailscale) saveUpdates() error {
+	if ts.UpdateFile == "" {
+		return nil
+	}
+	var b strings.Builder
+	for _, rr := range ts.updates {
+		fmt.Fprintln(&b, rr.String())
+	}
+	return writeFile(ts.UpdateFile, []byte(b.String()))
+}
+
+// writeFile writes data to the named file. It writes to a temporary file and
+// renames it, so a crash can't leave a partially written file behind.
+func writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// serveUpdate handles RFC 2136 dynamic updates for the zones served by this
+// plugin, from nodes carrying the configured tag, or of ACME challenges from
+// the nodes they are for. Prerequisites are not supported.
+func (ts *Tailscale) serveUpdate(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: req}
+	zone := state.QName()
+	if !ts.fastZoneLookup[zone] {
+		return plugin.NextOrFailure(ts.Name(), ts.next(ctx), ctx, w, req)
+	}
+	if node := ts.whois(ctx, w.RemoteAddr()); !ts.authorized(node) && !ts.challenges(node, req.Ns) {
+		return ts.serveRcode(w, req, dns.RcodeRefused)
+	}
+	if len(req.Answer) > 0 {
+		return ts.serveRcode(w, req, dns.RcodeNotImplemented)
+	}
+	if rcode := checkUpdate(zone, req.Ns); rcode != dns.RcodeSuccess {
+		return ts.serveRcode(w, req, rcode)
+	}
+
+	ts.Lock()
+	prev := ts.updates
+	ts.updates = applyUpdate(ts.updates, req.Ns)
+	if err := ts.saveUpdates(); err != nil {
+		ts.updates = prev
+		ts.Unlock()
+		return dns.RcodeServerFailure, fmt.Errorf("failed saving updates: %w", err)
+	}
+	prevHosts := ts.hosts
+	ts.hosts = ts.withUpdates(ts.assembled)
+	changed := ts.changedZones(prevHosts)
+	if len(changed) > 0 {
+		ts.bumpSerials(changed, time.Now())
+	}
+	ts.Unlock()
+	log.Infof("Applied dynamic update of %d records to %s", len(req.Ns), zone)
+	if len(changed) > 0 {
+		go ts.changed(changed)
+	}
+	return ts.serveRcode(w, req, dns.RcodeSuccess)
+}
+
+// serveRcode responds to req with rcode and no data. CoreDNS writes its own
+// response for some rcodes, so those are returned without writing anything.
+func (ts *Tailscale) serveRcode(w dns.ResponseWriter, req *dns.Msg, rcode int) (int, error) {
+	if !plugin.ClientWrite(rcode) {
+		return rcode, nil
+	}
+	ans := &dns.Msg{}
+	ans.SetRcode(req, rcode)
+	if err := w.WriteMsg(ans); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return rcode, nil
+}
@@ -0,0 +1,190 @@
+package corednstailscale
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	existing := []dns.RR{
+		rr(t, "app.corp.example.com. 300 IN A 100.101.102.103"),
+		rr(t, "app.corp.example.com. 300 IN A 100.101.102.104"),
+		rr(t, `app.corp.example.com. 300 IN TXT "owner=ops"`),
+	}
+	for tn, tc := range map[string]struct {
+		existing []dns.RR
+		updates  []dns.RR
+		want     []dns.RR
+	}{
+		"add to empty": {
+			updates: []dns.RR{rr(t, "app.corp.example.com. 60 IN A 100.101.102.103")},
+			want:    []dns.RR{rr(t, "app.corp.example.com. 60 IN A 100.101.102.103")},
+		},
+		"add duplicate": {
+			existing: existing,
+			updates:  []dns.RR{rr(t, "app.corp.example.com. 60 IN A 100.101.102.103")},
+			want:     existing,
+		},
+		"delete rrset": {
+			existing: existing,
+			updates:  []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "app.corp.example.com.", Rrtype: dns.TypeA, Class: dns.ClassANY}}},
+			want:     []dns.RR{rr(t, `app.corp.example.com. 300 IN TXT "owner=ops"`)},
+		},
+		"delete name": {
+			existing: existing,
+			updates:  []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "app.corp.example.com.", Rrtype: dns.TypeANY, Class: dns.ClassANY}}},
+		},
+		"delete rr": {
+			existing: existing,
+			updates:  []dns.RR{rr(t, "app.corp.example.com. 0 NONE A 100.101.102.104")},
+			want: []dns.RR{
+				rr(t, "app.corp.example.com. 300 IN A 100.101.102.103"),
+				rr(t, `app.corp.example.com. 300 IN TXT "owner=ops"`),
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := applyUpdate(tc.existing, tc.updates)
+			if diff := cmp.Diff(got, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestCheckUpdate(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		updates []dns.RR
+		want    int
+	}{
+		"add":              {[]dns.RR{rr(t, "app.corp.example.com. 60 IN A 100.101.102.103")}, dns.RcodeSuccess},
+		"delete rr":        {[]dns.RR{rr(t, "app.corp.example.com. 0 NONE A 100.101.102.103")}, dns.RcodeSuccess},
+		"outside zone":     {[]dns.RR{rr(t, "app.example.com. 60 IN A 100.101.102.103")}, dns.RcodeNotZone},
+		"synthesized type": {[]dns.RR{rr(t, "corp.example.com. 60 IN NS ns.example.com.")}, dns.RcodeRefused},
+		"bad class":        {[]dns.RR{rr(t, "app.corp.example.com. 60 CH A 100.101.102.103")}, dns.RcodeFormatError},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := checkUpdate("corp.example.com.", tc.updates); got != tc.want {
+				t.Errorf("checkUpdate: got %v, want %v", dns.RcodeToString[got], dns.RcodeToString[tc.want])
+			}
+		})
+	}
+}
+
+func TestTailscale_serveUpdate(t *testing.T) {
+	updateFile := filepath.Join(t.TempDir(), "updates.db")
+	config := fullTestConfig
+	config.UpdateTag = "dns-updater"
+	config.UpdateFile = updateFile
+	ts := &Tailscale{
+		Config: config,
+		client: &fakeLocalClient{
+			whois: map[string]*apitype.WhoIsResponse{
+				"10.240.0.1:40212": {Node: &tailcfg.Node{Tags: []string{"tag:dns-updater"}}},
+				"10.240.0.2:40212": {Node: &tailcfg.Node{Tags: []string{"tag:prod"}}},
+			},
+		},
+		serial:    8675309,
+		assembled: records{},
+		hosts:     records{},
+	}
+
+	update := func(remote string, prereqs, updates []dns.RR) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetUpdate("corp.example.com.")
+		req.Answer = prereqs
+		req.Ns = updates
+		rr := &recorder{ResponseWriter: test.ResponseWriter{RemoteIP: remote}}
+		rcode, _ := ts.ServeDNS(context.Background(), rr, req)
+		if rr.got == nil {
+			// CoreDNS writes the response for some rcodes.
+			rr.got = &dns.Msg{}
+			rr.got.SetRcode(req, rcode)
+		}
+		return rr.got
+	}
+
+	add := []dns.RR{rr(t, "app.corp.example.com. 60 IN A 100.101.102.103")}
+	if got := update("10.240.0.2", nil, add); got.Rcode != dns.RcodeRefused {
+		t.Errorf("update from untagged node: got rcode %v, want REFUSED", dns.RcodeToString[got.Rcode])
+	}
+	if got := update("10.240.0.1", add, add); got.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("update with prerequisites: got rcode %v, want NOTIMP", dns.RcodeToString[got.Rcode])
+	}
+	if got := update("10.240.0.1", nil, add); got.Rcode != dns.RcodeSuccess {
+		t.Errorf("update from tagged node: got rcode %v, want NOERROR", dns.RcodeToString[got.Rcode])
+	}
+
+	want := records{"app.corp.example.com.": {rrs: add}}
+	if diff := cmp.Diff(ts.hosts, want, cmpOpts...); diff != "" {
+		t.Errorf("hosts mismatch: (-got,+want):\n%v", diff)
+	}
+	if ts.serial == 8675309 {
+		t.Errorf("serial was not changed by update")
+	}
+
+	// The update should survive a restart.
+	b, err := os.ReadFile(updateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "app.corp.example.com.\t60\tIN\tA\t100.101.102.103\n"; got != want {
+		t.Errorf("update file: got %q, want %q", got, want)
+	}
+	ts.updates = nil
+	if err := ts.loadUpdates(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ts.updates, add, cmpOpts...); diff != "" {
+		t.Errorf("loaded updates mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestTailscale_serveUpdate_acme(t *testing.T) {
+	config := fullTestConfig
+	config.ACME = true
+	ts := &Tailscale{
+		Config: config,
+		client: &fakeLocalClient{
+			whois: map[string]*apitype.WhoIsResponse{
+				"10.240.0.1:40212": {Node: &tailcfg.Node{Name: "foo.magic-dns.ts.net."}},
+			},
+		},
+		serial: 8675309,
+		assembled: records{
+			"foo.corp.example.com.": {name: "foo.magic-dns.ts.net."},
+			"bar.corp.example.com.": {name: "bar.magic-dns.ts.net."},
+		},
+	}
+	ts.hosts = ts.assembled
+
+	for tn, tc := range map[string]struct {
+		updates []dns.RR
+		want    int
+	}{
+		"own challenge":     {[]dns.RR{rr(t, `_acme-challenge.foo.corp.example.com. 60 IN TXT "token"`)}, dns.RcodeSuccess},
+		"delete challenge":  {[]dns.RR{rr(t, `_acme-challenge.foo.corp.example.com. 0 NONE TXT "token"`)}, dns.RcodeSuccess},
+		"other challenge":   {[]dns.RR{rr(t, `_acme-challenge.bar.corp.example.com. 60 IN TXT "token"`)}, dns.RcodeRefused},
+		"not a challenge":   {[]dns.RR{rr(t, `foo.corp.example.com. 60 IN TXT "token"`)}, dns.RcodeRefused},
+		"challenge of type": {[]dns.RR{rr(t, "_acme-challenge.foo.corp.example.com. 60 IN A 100.101.102.103")}, dns.RcodeRefused},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetUpdate("corp.example.com.")
+			req.Ns = tc.updates
+			rec := &recorder{ResponseWriter: test.ResponseWriter{RemoteIP: "10.240.0.1"}}
+			rcode, _ := ts.ServeDNS(context.Background(), rec, req)
+			if rcode != tc.want {
+				t.Errorf("got rcode %v, want %v", dns.RcodeToString[rcode], dns.RcodeToString[tc.want])
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package corednstailscale
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exchanger describes the subset of dns.Client used to query the upstream.
+type exchanger interface {
+	ExchangeContext(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error)
+}
+
+// targetAddrs returns the address records of type qt, or of both types for
+// ANY, which follow the CNAME in zone to the peer with host record hr. MagicDNS names
+// are resolved by the upstream if one is configured, so that its current
+// addresses are served rather than those of the last reload, falling back to
+// the latter if it fails.
+func (ts *Tailscale) targetAddrs(ctx context.Context, qt uint16, zone string, hr *record) []dns.RR {
+	if ts.Upstream != "" && ts.target(zone, hr) == hr.name {
+		rrs, err := ts.resolveUpstream(ctx, hr.name, qt)
+		if err == nil {
+			return rrs
+		}
+		log.Warningf("Failed resolving %s upstream; serving cached addresses: %v", hr.name, err)
+	}
+	var rrs []dns.RR
+	if qt == dns.TypeA || qt == dns.TypeANY {
+		rrs = append(rrs, ts.A(zone, hr)...)
+	}
+	if qt == dns.TypeAAAA || qt == dns.TypeANY {
+		rrs = append(rrs, ts.AAAA(zone, hr)...)
+	}
+	return rrs
+}
+
+// resolveUpstream queries the upstream for the address records of type qt, or
+// of both types for ANY, owned by target.
+func (ts *Tailscale) resolveUpstream(ctx context.Context, target string, qt uint16) ([]dns.RR, error) {
+	var types []uint16
+	switch qt {
+	case dns.TypeA, dns.TypeAAAA:
+		types = []uint16{qt}
+	case dns.TypeANY:
+		types = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+	var rrs []dns.RR
+	for _, rt := range types {
+		m := &dns.Msg{}
+		m.SetQuestion(target, rt)
+		ctx, cancel := context.WithTimeout(ctx, ts.timeout())
+		ret, _, err := ts.upstreamClient().ExchangeContext(ctx, m, ts.Upstream)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if ret.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("rcode was %v", dns.RcodeToString[ret.Rcode])
+		}
+		for _, rr := range ret.Answer {
+			if h := rr.Header(); h.Rrtype == rt && dns.CanonicalName(h.Name) == target {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs, nil
+}
+
+// upstreamClient returns the client with which the upstream is queried.
+func (ts *Tailscale) upstreamClient() exchanger {
+	if ts.upstream != nil {
+		return ts.upstream
+	}
+	return &dns.Client{}
+}
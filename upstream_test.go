@@ -0,0 +1,94 @@
+package corednstailscale
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+// fakeExchanger answers queries from a map of records keyed by qtype, failing
+// if err is set.
+type fakeExchanger struct {
+	answers map[uint16][]dns.RR
+	err     error
+}
+
+func (e *fakeExchanger) ExchangeContext(_ context.Context, m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	if e.err != nil {
+		return nil, 0, e.err
+	}
+	ret := &dns.Msg{}
+	ret.SetReply(m)
+	ret.Answer = e.answers[m.Question[0].Qtype]
+	return ret, 0, nil
+}
+
+func TestTailscale_ServeDNS_upstream(t *testing.T) {
+	config := fullTestConfig
+	config.Upstream = "100.100.100.100:53"
+	hosts := records{
+		"foo.corp.example.com.": {name: "foo.magic-dns.ts.net.", v4: ips(t, "100.101.102.103"), v6: ips(t, "fd7a::abcd")},
+	}
+	upstream := map[uint16][]dns.RR{
+		dns.TypeA:    {rr(t, "foo.magic-dns.ts.net. 600 IN A 100.101.102.199")},
+		dns.TypeAAAA: {rr(t, "foo.magic-dns.ts.net. 600 IN AAAA fd7a::beef")},
+	}
+	for tn, tc := range map[string]struct {
+		qt   uint16
+		err  error
+		want []dns.RR
+	}{
+		"A": {
+			qt: dns.TypeA,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 600 IN A 100.101.102.199"),
+			},
+		},
+		"ANY": {
+			qt: dns.TypeANY,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 600 IN A 100.101.102.199"),
+				rr(t, "foo.magic-dns.ts.net. 600 IN AAAA fd7a::beef"),
+			},
+		},
+		"CNAME": {
+			qt: dns.TypeCNAME,
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+			},
+		},
+		"upstream failure": {
+			qt:  dns.TypeAAAA,
+			err: errors.New("i/o timeout"),
+			want: []dns.RR{
+				rr(t, "foo.corp.example.com. 300 IN CNAME foo.magic-dns.ts.net."),
+				rr(t, "foo.magic-dns.ts.net. 300 IN AAAA fd7a::abcd"),
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			ts := &Tailscale{
+				Config:   config,
+				serial:   8675309,
+				hosts:    hosts,
+				upstream: &fakeExchanger{answers: upstream, err: tc.err},
+			}
+			req := &dns.Msg{}
+			req.SetQuestion("foo.corp.example.com.", tc.qt)
+			rec := &recorder{}
+			ts.ServeDNS(context.Background(), rec, req)
+			if rec.got == nil {
+				t.Fatal("no response written")
+			}
+			if diff := cmp.Diff(rec.got.Answer, tc.want, cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package corednstailscale
+
+import (
+	"io"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+)
+
+// Validate parses the Corefile read from r, and checks the configuration of
+// each tailscale block in it as setup would, without starting any servers or
+// contacting tailscaled. Filename is used in error messages. It allows
+// Corefiles to be checked, such as in CI, before they are deployed.
+//
+// Nothing is fetched over the network, so tag zones are only taken from policy
+// files read from disk, not from the API. Served zones outside of the zones of
+// their server block, which setup only warns about, are errors here.
+func Validate(filename string, r io.Reader) error {
+	blocks, err := caddyfile.Parse(filename, r, nil)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		tokens := block.Tokens[name]
+		if len(tokens) == 0 {
+			continue
+		}
+		c := &caddy.Controller{Dispenser: caddyfile.NewDispenserTokens(filename, tokens)}
+		var config Config
+		if err := parseWith(c, &config, localPolicy); err != nil {
+			return err
+		}
+		unrouted, err := checkBlock(&config, block.Keys, len(block.Tokens["bind"]) > 0)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if len(unrouted) > 0 {
+			return c.Errf("zone %q is not within the zones of the server block %v, so would not be queried", unrouted[0], block.Keys)
+		}
+	}
+	return nil
+}
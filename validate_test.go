@@ -0,0 +1,134 @@
+package corednstailscale
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	// Validating never fetches the policy from the API.
+	var fetched bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	policy := filepath.Join(t.TempDir(), "policy.hujson")
+	if err := os.WriteFile(policy, []byte(testPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for tn, tc := range map[string]struct {
+		corefile string
+		wantErr  bool
+	}{
+		"valid": {
+			corefile: `.:53 {
+				tailscale corp.example.com. {
+					tag prod example.com.
+				}
+				forward . 100.100.100.100
+			}`,
+		},
+		"without plugin": {
+			corefile: `.:53 {
+				forward . 100.100.100.100
+			}`,
+		},
+		"invalid in second block": {
+			corefile: `.:53 {
+				tailscale corp.example.com.
+			}
+			.:5353 {
+				tailscale corp.example.com. {
+					label servers
+				}
+			}`,
+			wantErr: true,
+		},
+		"zones within block": {
+			corefile: `corp.example.com:53 example.net:53 {
+				tailscale corp.example.com. {
+					tag prod example.net.
+				}
+			}`,
+		},
+		"zone outside block": {
+			corefile: `corp.example.com:53 {
+				tailscale corp.example.com. {
+					tag prod example.net.
+				}
+			}`,
+			wantErr: true,
+		},
+		"reverse zones outside block": {
+			corefile: `corp.example.com:53 {
+				tailscale corp.example.com. {
+					reverse
+				}
+			}`,
+			wantErr: true,
+		},
+		"bind-tailnet": {
+			corefile: `.:53 {
+				tailscale corp.example.com. {
+					bind-tailnet
+				}
+			}`,
+		},
+		"bind-tailnet with bind": {
+			corefile: `.:53 {
+				bind 127.0.0.1
+				tailscale corp.example.com. {
+					bind-tailnet
+				}
+			}`,
+			wantErr: true,
+		},
+		"policy file": {
+			corefile: fmt.Sprintf(`.:53 {
+				tailscale corp.example.com. {
+					acl-policy %s
+				}
+			}`, policy),
+		},
+		"policy file zone outside block": {
+			corefile: fmt.Sprintf(`corp.example.com:53 {
+				tailscale corp.example.com. {
+					acl-policy %s
+				}
+			}`, policy),
+			wantErr: true,
+		},
+		"policy from API": {
+			corefile: fmt.Sprintf(`.:53 {
+				tailscale corp.example.com. {
+					acl-policy api example.com tskey-api-test
+					api-url %s
+				}
+			}`, srv.URL),
+		},
+		"unknown option": {
+			corefile: `.:53 {
+				tailscale corp.example.com. {
+					bogus
+				}
+			}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if err := Validate("Corefile", strings.NewReader(tc.corefile)); (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error value: %v", err)
+			}
+		})
+	}
+	if fetched {
+		t.Error("policy fetched from the API while validating")
+	}
+}
@@ -0,0 +1,70 @@
+package corednstailscale
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/types/netmap"
+)
+
+// vipServices returns the virtual IPs of the Tailscale Services (VIP services)
+// in the network map nm, by their MagicDNS names. Control sends them to every
+// node as extra DNS records in the tailnet's MagicDNS domain, beside those of
+// the nodes, so any which name no node are taken to be services.
+func vipServices(nm *netmap.NetworkMap) map[string][]netip.Addr {
+	if nm == nil {
+		return nil
+	}
+	suffix := dns.CanonicalName(nm.MagicDNSSuffix())
+	if suffix == "." {
+		return nil
+	}
+	nodeNames := make(map[string]bool)
+	for _, node := range nodes(nm) {
+		if node != nil {
+			nodeNames[dns.CanonicalName(node.Name)] = true
+		}
+	}
+	services := make(map[string][]netip.Addr)
+	for _, rec := range nm.DNS.ExtraRecords {
+		// Other types are ignored by tailscaled too.
+		if rec.Type != "" && rec.Type != "A" && rec.Type != "AAAA" {
+			continue
+		}
+		name := dns.CanonicalName(rec.Name)
+		if nodeNames[name] || !dns.IsSubDomain(suffix, name) || dns.CountLabel(name) != dns.CountLabel(suffix)+1 {
+			continue
+		}
+		addr, err := netip.ParseAddr(rec.Value)
+		if err != nil {
+			log.Warningf("Invalid address %q of Tailscale Service %q; skipping", rec.Value, name)
+			continue
+		}
+		if !slices.Contains(services[name], addr) {
+			services[name] = append(services[name], addr)
+		}
+	}
+	return services
+}
+
+// assembleVIPServices adds the Tailscale Services to r, served in each default
+// zone by the first labels of their MagicDNS names, to which they are CNAMEs.
+// Names of peers take precedence over those of services.
+func assembleVIPServices(config *Config, services map[string][]netip.Addr, r records) {
+	for svc, addrs := range services {
+		label, _, _ := strings.Cut(svc, ".")
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		rec := &record{name: svc}
+		rec.v4, rec.v6 = bucketAddrs(addrs)
+		for _, zone := range config.defaultZones() {
+			name := dns.CanonicalName(label + "." + zone)
+			if prev := r[name]; prev != nil {
+				log.Warningf("Tailscale Service %q conflicts with existing records; skipping", name)
+				continue
+			}
+			r[name] = rec
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package corednstailscale
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// vipNetMap is a network map with Tailscale Services among its extra records.
+var vipNetMap = netmap.NetworkMap{
+	Name:     "self.magic-dns.ts.net.",
+	SelfNode: &tailcfg.Node{StableID: "self", Name: "self.magic-dns.ts.net."},
+	Peers: []*tailcfg.Node{
+		{StableID: "web", Name: "web.magic-dns.ts.net."},
+	},
+	DNS: tailcfg.DNSConfig{
+		ExtraRecords: []tailcfg.DNSRecord{
+			{Name: "grafana.magic-dns.ts.net", Value: "100.100.200.1"},
+			{Name: "grafana.magic-dns.ts.net", Value: "fd7a:115c:a1e0::c801"},
+			{Name: "ldap.magic-dns.ts.net.", Type: "A", Value: "100.100.200.2"},
+			// Not services.
+			{Name: "web.magic-dns.ts.net", Value: "100.101.102.1"},
+			{Name: "db.example.com", Value: "192.0.2.1"},
+			{Name: "a.b.magic-dns.ts.net", Value: "100.100.200.3"},
+			{Name: "mail.magic-dns.ts.net", Type: "MX", Value: "10 mx.example.com."},
+			{Name: "bad.magic-dns.ts.net", Value: "not an address"},
+		},
+	},
+}
+
+func TestVIPServices(t *testing.T) {
+	want := map[string][]netip.Addr{
+		"grafana.magic-dns.ts.net.": ips(t, "100.100.200.1", "fd7a:115c:a1e0::c801"),
+		"ldap.magic-dns.ts.net.":    ips(t, "100.100.200.2"),
+	}
+	if diff := cmp.Diff(vipServices(&vipNetMap), want, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("vipServices mismatch: (-got,+want):\n%v", diff)
+	}
+	if got := vipServices(nil); got != nil {
+		t.Errorf("vipServices(nil) = %v, want nil", got)
+	}
+}
+
+func TestTailscale_vipServices(t *testing.T) {
+	config := fullTestConfig
+	config.VIPServices = true
+	client := &fakeLocalClient{
+		status: ipnstate.Status{
+			BackendState: ipn.Running.String(),
+			Self:         &ipnstate.PeerStatus{DNSName: "self.magic-dns.ts.net.", TailscaleIPs: ips(t, "100.111.112.113")},
+			Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+				key.NewNode().Public(): {
+					DNSName:      "ldap.magic-dns.ts.net.",
+					TailscaleIPs: ips(t, "100.101.102.104"),
+				},
+			},
+		},
+		netmap: vipNetMap,
+	}
+	ts := &Tailscale{Config: config, client: client}
+	ts.reload()
+
+	for qn, want := range map[string][]dns.RR{
+		"grafana.corp.example.com.": {
+			rr(t, "grafana.corp.example.com. 300 IN CNAME grafana.magic-dns.ts.net."),
+			rr(t, "grafana.magic-dns.ts.net. 300 IN A 100.100.200.1"),
+		},
+		// Peers take precedence over services.
+		"ldap.corp.example.com.": {
+			rr(t, "ldap.corp.example.com. 300 IN CNAME ldap.magic-dns.ts.net."),
+			rr(t, "ldap.magic-dns.ts.net. 300 IN A 100.101.102.104"),
+		},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(qn, dns.TypeA)
+		w := &recorder{}
+		if _, err := ts.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(w.got.Answer, want); diff != "" {
+			t.Errorf("%s: answer mismatch: (-got,+want):\n%v", qn, diff)
+		}
+	}
+}
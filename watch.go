@@ -0,0 +1,107 @@
+package corednstailscale
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
+)
+
+// watchRetryInterval is how long to wait before watching the IPN bus again
+// after it fails, such as while tailscaled is restarting.
+const watchRetryInterval = 5 * time.Second
+
+// WatchNetMap watches the IPN bus, calling changed with the initial network map
+// and whenever it changes in a way that may be served, until ctx is done or the
+// bus fails. Changes of state, login and profile, which may not come with a
+// network map when logging out, are signalled too.
+func (lc *localClient) WatchNetMap(ctx context.Context, changed func()) error {
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	var last string
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap != nil {
+			// Network maps are sent whenever any peer's endpoints or DERP
+			// region change, which is far more often than anything served.
+			if fp := fingerprint(n.NetMap); fp == "" || fp != last {
+				last = fp
+				changed()
+			}
+		} else if n.State != nil || n.LoginFinished != nil || n.Prefs != nil {
+			last = ""
+			changed()
+		}
+	}
+}
+
+// fingerprint returns a summary of the network map nm which changes along with
+// anything served from it, or from the status of its nodes. The endpoints,
+// DERP regions, disco keys and network conditions of nodes, which change often
+// as they roam, are left out. It is empty if the network map can't be summed
+// up, in which case it should be taken as changed.
+func fingerprint(nm *netmap.NetworkMap) string {
+	var ns []*tailcfg.Node
+	for _, node := range nodes(nm) {
+		if node == nil {
+			continue
+		}
+		n := node.Clone()
+		n.Endpoints, n.DERP, n.DiscoKey = nil, "", key.DiscoPublic{}
+		if n.Hostinfo.Valid() {
+			hi := n.Hostinfo.AsStruct()
+			hi.NetInfo = nil
+			n.Hostinfo = hi.View()
+		}
+		ns = append(ns, n)
+	}
+	b, err := json.Marshal(struct {
+		Name         string
+		Nodes        []*tailcfg.Node
+		DNS          tailcfg.DNSConfig
+		PacketFilter views.Slice[tailcfg.FilterRule]
+		UserProfiles map[tailcfg.UserID]tailcfg.UserProfile
+	}{nm.Name, ns, nm.DNS, nm.PacketFilterRules, nm.UserProfiles})
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// watch the network map of the tailnet until ctx is done, signalling changes
+// to the polling goroutine so that they are served without waiting for the
+// next reload. The initial network map is signalled too, so that changes made
+// while the bus wasn't watched aren't missed.
+func (ts *Tailscale) watch(ctx context.Context) {
+	log.Debug("Watching the IPN bus")
+	defer log.Debug("Stopped watching the IPN bus")
+	for {
+		err := ts.client.WatchNetMap(ctx, func() {
+			// Changes which arrive while a reload is pending are served by it.
+			select {
+			case ts.netmapChanged <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("Failed watching the IPN bus, retrying in %v: %v", watchRetryInterval, err)
+		select {
+		case <-time.After(watchRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
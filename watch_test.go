@@ -0,0 +1,183 @@
+package corednstailscale
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestTailscale_watch(t *testing.T) {
+	client := &fakeLocalClient{
+		status:  ipnstate.Status{Self: &ipnstate.PeerStatus{DNSName: "self.magic-dns.ts.net."}},
+		changes: make(chan struct{}),
+	}
+	config := fullTestConfig
+	config.ReloadInterval = time.Hour
+	ts := &Tailscale{Config: config, client: client}
+	ts.Startup()
+	defer ts.Shutdown()
+
+	has := func(name string) bool {
+		ts.RLock()
+		defer ts.RUnlock()
+		_, has := ts.hosts[name]
+		return has
+	}
+	if has("laptop.corp.example.com.") {
+		t.Fatal("new peer served before joining")
+	}
+
+	// The status is only read again once the change has been signalled.
+	client.status.Peer = map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {
+			DNSName:      "laptop.magic-dns.ts.net.",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.101.102.104")},
+		},
+	}
+	client.changes <- struct{}{}
+	for deadline := time.Now().Add(5 * time.Second); !has("laptop.corp.example.com."); {
+		if time.Now().After(deadline) {
+			t.Fatal("new peer not served after the network map changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	netMap := func(edit func(*tailcfg.Node)) *netmap.NetworkMap {
+		peer := &tailcfg.Node{
+			ID:        1,
+			Name:      "laptop.magic-dns.ts.net.",
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.101.102.104/32")},
+			Endpoints: []string{"192.0.2.1:41641"},
+			DERP:      "127.3.3.40:1",
+			Hostinfo:  (&tailcfg.Hostinfo{Hostname: "laptop", NetInfo: &tailcfg.NetInfo{PreferredDERP: 1}}).View(),
+		}
+		edit(peer)
+		return &netmap.NetworkMap{
+			SelfNode: &tailcfg.Node{ID: 2, Name: "self.magic-dns.ts.net."},
+			Peers:    []*tailcfg.Node{peer},
+		}
+	}
+	base := fingerprint(netMap(func(*tailcfg.Node) {}))
+	for name, tc := range map[string]struct {
+		edit    func(*tailcfg.Node)
+		changed bool
+	}{
+		"endpoints": {
+			edit: func(n *tailcfg.Node) { n.Endpoints = []string{"198.51.100.1:41641"} },
+		},
+		"DERP region": {
+			edit: func(n *tailcfg.Node) { n.DERP = "127.3.3.40:2" },
+		},
+		"network conditions": {
+			edit: func(n *tailcfg.Node) {
+				n.Hostinfo = (&tailcfg.Hostinfo{Hostname: "laptop", NetInfo: &tailcfg.NetInfo{PreferredDERP: 2}}).View()
+			},
+		},
+		"addresses": {
+			edit:    func(n *tailcfg.Node) { n.Addresses = []netip.Prefix{netip.MustParsePrefix("100.101.102.105/32")} },
+			changed: true,
+		},
+		"name": {
+			edit:    func(n *tailcfg.Node) { n.Name = "desktop.magic-dns.ts.net." },
+			changed: true,
+		},
+		"host name": {
+			edit: func(n *tailcfg.Node) {
+				n.Hostinfo = (&tailcfg.Hostinfo{Hostname: "desktop", NetInfo: &tailcfg.NetInfo{PreferredDERP: 1}}).View()
+			},
+			changed: true,
+		},
+		"online": {
+			edit: func(n *tailcfg.Node) {
+				online := true
+				n.Online = &online
+			},
+			changed: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := fingerprint(netMap(tc.edit))
+			if got == "" {
+				t.Fatal("no fingerprint")
+			}
+			if changed := got != base; changed != tc.changed {
+				t.Errorf("changed = %t, want %t", changed, tc.changed)
+			}
+		})
+	}
+}
+
+func TestTailscale_noWatch(t *testing.T) {
+	client := &fakeLocalClient{changes: make(chan struct{})}
+	config := fullTestConfig
+	config.NoWatch = true
+	ts := &Tailscale{Config: config, client: client}
+	ts.Startup()
+	defer ts.Shutdown()
+	select {
+	case client.changes <- struct{}{}:
+		t.Error("IPN bus watched with watch off")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTailscale_reloadInactive(t *testing.T) {
+	client := &fakeLocalClient{
+		status: ipnstate.Status{
+			BackendState: ipn.Running.String(),
+			Self:         &ipnstate.PeerStatus{DNSName: "self.magic-dns.ts.net."},
+			Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+				key.NewNode().Public(): {
+					DNSName:      "laptop.magic-dns.ts.net.",
+					TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.101.102.104")},
+				},
+			},
+		},
+	}
+	ts := &Tailscale{
+		Config: fullTestConfig,
+		client: client,
+		Next:   test.NextHandler(dns.RcodeRefused, nil),
+	}
+	query := func() int {
+		req := new(dns.Msg)
+		req.SetQuestion("laptop.corp.example.com.", dns.TypeA)
+		rcode, _ := ts.ServeDNS(context.Background(), &recorder{}, req)
+		return rcode
+	}
+
+	ts.reload()
+	if !ts.Ready() || query() != dns.RcodeSuccess {
+		t.Fatal("peer not served while running")
+	}
+
+	// Logging out leaves the previous peers in the status.
+	client.status.BackendState = ipn.NeedsLogin.String()
+	ts.reload()
+	if ts.Ready() {
+		t.Error("ready while logged out")
+	}
+	if rcode := query(); rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode while logged out = %v, want SERVFAIL", dns.RcodeToString[rcode])
+	}
+	if rcode, _ := ts.ServeDNS(context.Background(), &recorder{}, new(dns.Msg).SetQuestion("example.net.", dns.TypeA)); rcode != dns.RcodeRefused {
+		t.Errorf("query outside of zones not passed on while logged out")
+	}
+
+	client.status.BackendState = ipn.Running.String()
+	ts.reload()
+	if !ts.Ready() || query() != dns.RcodeSuccess {
+		t.Error("peer not served after logging in again")
+	}
+}
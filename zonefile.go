@@ -0,0 +1,41 @@
+package corednstailscale
+
+import (
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readZoneFile reads the records of zone from the zone file at path, and
+// returns them along with its modification time. SOA and NS records are
+// synthesized by this plugin, and records outside of zone aren't its to
+// serve, so those are skipped.
+func readZoneFile(config *Config, zone, path string) ([]dns.RR, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(f, zone, path)
+	zp.SetDefaultTTL(config.ttl())
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		h.Name = dns.CanonicalName(h.Name)
+		switch {
+		case h.Rrtype == dns.TypeSOA || h.Rrtype == dns.TypeNS:
+			log.Debugf("Skipping synthesized %s record at %s in %s", dns.TypeToString[h.Rrtype], h.Name, path)
+		case config.zoneOf(h.Name) != zone:
+			log.Warningf("Skipping record at %s outside of %s in %s", h.Name, zone, path)
+		default:
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, fi.ModTime(), zp.Err()
+}
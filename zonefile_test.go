@@ -0,0 +1,49 @@
+package corednstailscale
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestReadZoneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.example.com")
+	content := `$ORIGIN example.com.
+$TTL 300
+@       3600 IN SOA ns1.example.net. hostmaster.example.com. 1 7200 3600 1209600 3600
+@            IN NS  ns1.example.net.
+@            IN MX  10 mail
+mail    60   IN A   192.0.2.25
+www          IN CNAME foo.example.com.
+foo.corp     IN A   192.0.2.26 ; In corp.example.com., which is served apart.
+other.example.net. IN A 192.0.2.27
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := readZoneFile(&fullTestConfig, "example.com.", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dns.RR{
+		rr(t, "example.com. 300 IN MX 10 mail.example.com."),
+		rr(t, "mail.example.com. 60 IN A 192.0.2.25"),
+		rr(t, "www.example.com. 300 IN CNAME foo.example.com."),
+	}
+	if diff := cmp.Diff(got, want, cmpOpts...); diff != "" {
+		t.Errorf("mismatch: (-got,+want):\n%v", diff)
+	}
+}
+
+func TestReadZoneFile_invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.example.com")
+	if err := os.WriteFile(path, []byte("www IN BOGUS data\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readZoneFile(&fullTestConfig, "example.com.", path); err == nil {
+		t.Errorf("expected error reading invalid zone file")
+	}
+}
@@ -0,0 +1,157 @@
+package corednstailscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// zonesFrom is the content of a zones-from file, which maps tags to zones and
+// filters peers as the tag, require-tag, exclude-tag, include-os and
+// exclude-os options do.
+type zonesFrom struct {
+	Tags        map[string]string `json:"tags"`
+	RequireTags []string          `json:"require-tags"`
+	ExcludeTags []string          `json:"exclude-tags"`
+	IncludeOS   []string          `json:"include-os"`
+	ExcludeOS   []string          `json:"exclude-os"`
+}
+
+// readZonesFrom reads the JSON zones-from file at path, and returns its
+// content along with its modification time.
+func readZonesFrom(path string) (*zonesFrom, time.Time, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var zf zonesFrom
+	if err := dec.Decode(&zf); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &zf, fi.ModTime(), nil
+}
+
+// apply the content of a zones-from file to config, alongside the options of
+// the Corefile.
+func (zf *zonesFrom) apply(config *Config) error {
+	for tag, zn := range zf.Tags {
+		tag = strings.TrimPrefix(tag, "tag:")
+		zone, err := parseZoneName(zn)
+		if err != nil {
+			return fmt.Errorf("invalid zone for tag %q: %v", tag, err)
+		}
+		if config.Zones == nil {
+			config.Zones = make(map[string]string)
+		}
+		if prev, has := config.Zones[tag]; has {
+			return fmt.Errorf("tag %q already configured; previous value was %q", tag, prev)
+		}
+		config.Zones[tag] = zone
+	}
+	for _, tag := range zf.RequireTags {
+		if config.RequireTags == nil {
+			config.RequireTags = make(map[string]bool)
+		}
+		config.RequireTags[strings.TrimPrefix(tag, "tag:")] = true
+	}
+	for _, tag := range zf.ExcludeTags {
+		if config.ExcludeTags == nil {
+			config.ExcludeTags = make(map[string]bool)
+		}
+		config.ExcludeTags[strings.TrimPrefix(tag, "tag:")] = true
+	}
+	for _, os := range zf.IncludeOS {
+		if config.IncludeOS == nil {
+			config.IncludeOS = make(map[string]bool)
+		}
+		config.IncludeOS[osName(os)] = true
+	}
+	for _, os := range zf.ExcludeOS {
+		if config.ExcludeOS == nil {
+			config.ExcludeOS = make(map[string]bool)
+		}
+		config.ExcludeOS[osName(os)] = true
+	}
+	for os := range config.IncludeOS {
+		if config.ExcludeOS[os] {
+			return fmt.Errorf("os %q both included and excluded", os)
+		}
+	}
+	return nil
+}
+
+// zonesFromChanged returns true if the zones-from file has been modified since
+// it was last seen. Only called from the polling goroutine.
+func (ts *Tailscale) zonesFromChanged() bool {
+	fi, err := os.Stat(ts.ZonesFile)
+	if err != nil || fi.ModTime().Equal(ts.zonesFromMod) {
+		return false
+	}
+	ts.zonesFromMod = fi.ModTime()
+	return true
+}
+
+// restart CoreDNS with its running Corefile, so that the zones-from file is
+// read again along with it. Zones can't change while the plugin runs, since
+// CoreDNS routes queries to server blocks by them. An invalid file is skipped
+// rather than failing the restart.
+func (ts *Tailscale) restart() {
+	if _, _, err := readZonesFrom(ts.ZonesFile); err != nil {
+		log.Errorf("Not applying invalid zones-from file %q: %v", ts.ZonesFile, err)
+		return
+	}
+	running.Lock()
+	inst := running.instance
+	running.Unlock()
+	if inst == nil {
+		log.Warningf("Can't apply zones-from file %q: no running instance", ts.ZonesFile)
+		return
+	}
+	log.Infof("Restarting to apply zones-from file %q", ts.ZonesFile)
+	// Restarting shuts this plugin down, which waits for polling to stop, so it
+	// mustn't happen on the polling goroutine.
+	go func() {
+		if _, err := inst.Restart(inst.Caddyfile()); err != nil {
+			log.Errorf("Failed restarting to apply zones-from file %q: %v", ts.ZonesFile, err)
+		}
+	}()
+}
+
+// running is the CoreDNS instance which is restarted to apply changes to
+// zones-from files.
+var running struct {
+	sync.Mutex
+	instance *caddy.Instance
+}
+
+// registerStartupHook registers the hook recording the running instance, if it
+// isn't registered already. CoreDNS drops event hooks when it is reloaded by
+// signal, so this is done on each setup.
+func registerStartupHook() {
+	defer func() {
+		_ = recover() // the hook is already registered.
+	}()
+	caddy.RegisterEventHook(name, func(event caddy.EventName, info interface{}) error {
+		if event != caddy.InstanceStartupEvent {
+			return nil
+		}
+		if inst, ok := info.(*caddy.Instance); ok {
+			running.Lock()
+			running.instance = inst
+			running.Unlock()
+		}
+		return nil
+	})
+}
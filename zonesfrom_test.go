@@ -0,0 +1,131 @@
+package corednstailscale
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseConfig_zonesFrom(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		content string
+		options string
+		want    func(path string, mod time.Time) Config
+		wantErr bool
+	}{
+		"zones and filters": {
+			content: `{
+				"tags": {"prod": "example.com", "tag:campus-den": "den.corp.example.com."},
+				"exclude-tags": ["ci-runner"],
+				"include-os": ["linux", "darwin"]
+			}`,
+			options: "tag lab lab.corp.example.com.",
+			want: func(path string, mod time.Time) Config {
+				return Config{
+					DefaultZone:    "corp.example.com.",
+					ReloadInterval: defaultReloadInterval,
+					ZonesFile:      path,
+					Zones: map[string]string{
+						"prod":       "example.com.",
+						"campus-den": "den.corp.example.com.",
+						"lab":        "lab.corp.example.com.",
+					},
+					ExcludeTags: map[string]bool{"ci-runner": true},
+					IncludeOS:   map[string]bool{"linux": true, "macos": true},
+					fastZoneLookup: map[string]bool{
+						"corp.example.com.":     true,
+						"example.com.":          true,
+						"den.corp.example.com.": true,
+						"lab.corp.example.com.": true,
+					},
+					zonesFromMod: mod,
+				}
+			},
+		},
+		"tag also in Corefile": {
+			content: `{"tags": {"prod": "example.com."}}`,
+			options: "tag prod example.net.",
+			wantErr: true,
+		},
+		"unknown field": {
+			content: `{"zones": {"prod": "example.com."}}`,
+			wantErr: true,
+		},
+		"invalid zone": {
+			content: `{"tags": {"prod": ""}}`,
+			wantErr: true,
+		},
+		"os both included and excluded": {
+			content: `{"include-os": ["linux"], "exclude-os": ["linux"]}`,
+			wantErr: true,
+		},
+		"not json": {
+			content: "prod example.com.",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ts-zones.json")
+			if err := os.WriteFile(path, []byte(tc.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := caddy.NewTestController("dns", fmt.Sprintf(`tailscale corp.example.com. {
+				zones-from %s
+				%s
+			}`, path, tc.options))
+			var got Config
+			if err := parse(c, &got); (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error value: %v", err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(got, tc.want(path, fi.ModTime()), cmpOpts...); diff != "" {
+				t.Errorf("mismatch: (-got,+want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfig_zonesFromMissing(t *testing.T) {
+	c := caddy.NewTestController("dns", fmt.Sprintf(`tailscale corp.example.com. {
+		zones-from %s
+	}`, filepath.Join(t.TempDir(), "missing.json")))
+	if err := parse(c, &Config{}); err == nil {
+		t.Errorf("no error for missing zones-from file")
+	}
+}
+
+func TestTailscale_zonesFromChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ts-zones.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &Tailscale{Config: Config{ZonesFile: path, zonesFromMod: fi.ModTime()}}
+	if ts.zonesFromChanged() {
+		t.Errorf("unmodified file reported as changed")
+	}
+	later := fi.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.zonesFromChanged() {
+		t.Errorf("modified file not reported as changed")
+	}
+	if ts.zonesFromChanged() {
+		t.Errorf("file reported as changed again without being modified")
+	}
+}